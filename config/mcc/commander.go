@@ -1,4 +1,13 @@
 package mcc
 
 type Commander struct {
+	// MaxAttempts is how often a job failing for a transient cause, such
+	// as an unreachable store, is tried before it fails.  0 or 1 disables
+	// retries.
+	MaxAttempts int
+	// RetryBackoffSec is the delay before the first retry, doubling with
+	// every further one up to MaxRetryBackoffSec; 0 selects 30 seconds
+	// and 30 minutes.
+	RetryBackoffSec    int
+	MaxRetryBackoffSec int
 }
@@ -1,4 +1,47 @@
 package mcc
 
 type Runner struct {
+	// DBCacheDir holds unzipped databases between jobs.  Caching is
+	// disabled when empty.
+	DBCacheDir string
+	// DBCacheMaxMB bounds the disk space used by DBCacheDir.
+	DBCacheMaxMB int64
+	// PackCacheDir holds compiled query packs between jobs.  Caching is
+	// disabled when empty.
+	PackCacheDir string
+	// PackCacheMaxMB bounds the disk space used by PackCacheDir.
+	PackCacheMaxMB int64
+	// MaxPrefetch is the number of jobs the agent's workers may take from
+	// the queue ahead of time to fetch their databases.  0 disables it.
+	MaxPrefetch int
+	// QueryServers is the number of persistent CodeQL query servers the
+	// agent's workers share.  0 runs every analysis with fresh CLI
+	// invocations.
+	QueryServers int
+	// RAMMB and Threads bound the CodeQL evaluation of each worker; 0
+	// keeps the defaults of 2048 MB and one thread.  Threads may be
+	// negative to leave that many cores free, as with --threads.
+	RAMMB   int
+	Threads int
+	// ScratchDir holds the agent's per-job temporary files; empty uses
+	// the system temporary directory.
+	ScratchDir string
+	// MinFreeDiskMB is the disk space that must remain free after a
+	// database is extracted.  Jobs whose database does not fit are
+	// deferred until space is freed.
+	MinFreeDiskMB int64
+	// MinWorkers and MaxWorkers bound an adaptive worker pool, which
+	// grows with the job queue while memory and CPU allow.  A MaxWorkers
+	// of 0 keeps the worker count fixed.
+	MinWorkers int
+	MaxWorkers int
+	// MaxLoadPerCPU stops the pool growing once the one-minute load
+	// average per CPU reaches it; 0 selects 1.0.
+	MaxLoadPerCPU float64
+	// ScaleIntervalSec is the time between pool size checks; 0 selects
+	// 30 seconds.
+	ScaleIntervalSec int
+	// MetricsAddr is the address, e.g. ":9100", the agent serves its
+	// expvar metrics on at /debug/vars.  Empty serves none.
+	MetricsAddr string
 }
@@ -2,18 +2,20 @@ package agent
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/hohn/mrvacommander/pkg/artifactstore"
 	"github.com/hohn/mrvacommander/pkg/codeql"
 	"github.com/hohn/mrvacommander/pkg/common"
 	"github.com/hohn/mrvacommander/pkg/qldbstore"
 	"github.com/hohn/mrvacommander/pkg/queue"
-	"github.com/hohn/mrvacommander/pkg/state"
 	"github.com/hohn/mrvacommander/utils"
 
 	"github.com/google/uuid"
@@ -48,18 +50,20 @@ func (r *RunnerSingle) worker(wid int) {
 }
 */
 
-const (
-	workerMemoryMB = 2048 // 2 GB
-)
-
+// StartAndMonitorWorkers runs desiredWorkerCount workers, or an adaptive
+// pool bounded by v.Autoscale if the count is not given, until ctx is
+// cancelled.
 func StartAndMonitorWorkers(ctx context.Context,
-	artifacts artifactstore.Store,
-	databases qldbstore.Store,
-	queue queue.Queue,
-	serverState state.ServerState,
+	v *Visibles,
 	desiredWorkerCount int,
 	wg *sync.WaitGroup) {
 
+	if desiredWorkerCount <= 0 && v.Autoscale != nil {
+		go sendHeartbeats(ctx, v)
+		v.Autoscale.run(ctx, v, wg)
+		return
+	}
+
 	var workerCount int
 	if desiredWorkerCount > 0 {
 		workerCount = desiredWorkerCount
@@ -69,13 +73,15 @@ func StartAndMonitorWorkers(ctx context.Context,
 		slog.Info("Starting preset number of workers", slog.Int("count", workerCount))
 	}
 
+	go sendHeartbeats(ctx, v)
+
 	stopChans := make([]chan struct{}, workerCount)
 
 	for i := 0; i < workerCount; i++ {
 		stopChan := make(chan struct{})
 		stopChans[i] = stopChan
 		wg.Add(1)
-		go RunWorker(ctx, artifacts, databases, queue, serverState, stopChan, wg)
+		go RunWorker(ctx, v, stopChan, wg)
 	}
 
 	// Wait for context cancellation
@@ -87,64 +93,133 @@ func StartAndMonitorWorkers(ctx context.Context,
 }
 
 // RunAnalysisJob runs a CodeQL analysis job (AnalyzeJob) returning an AnalyzeResult
-func RunAnalysisJob(
-	job queue.AnalyzeJob, artifacts artifactstore.Store, dbs qldbstore.Store) (queue.AnalyzeResult, error) {
-	var result = queue.AnalyzeResult{
+func RunAnalysisJob(job queue.AnalyzeJob, v *Visibles) (queue.AnalyzeResult, error) {
+	inputs, err := prepareJob(job, v)
+	if err != nil {
+		return failureResult(job, err), err
+	}
+	defer inputs.cleanup()
+
+	result, err := analyzeJob(job, inputs, v)
+	if err != nil {
+		return failureResult(job, err), err
+	}
+	return result, nil
+}
+
+// jobInputs are the query pack and database of a job, ready on local disk.
+type jobInputs struct {
+	tempDir          string
+	cliVersion       string
+	queryPackPath    string
+	releaseQueryPack func()
+	modelPacks       []codeql.ModelPack
+	databasePath     string
+	databaseIdentity string
+	releaseDatabase  func()
+}
+
+// cleanup releases the query pack and database and removes the job's
+// temporary files.
+func (in *jobInputs) cleanup() {
+	if in.releaseQueryPack != nil {
+		in.releaseQueryPack()
+	}
+	if in.releaseDatabase != nil {
+		in.releaseDatabase()
+	}
+	os.RemoveAll(in.tempDir)
+}
+
+func failedResult(job queue.AnalyzeJob) queue.AnalyzeResult {
+	return queue.AnalyzeResult{
 		Spec:           job.Spec,
 		ResultCount:    0,
 		ResultLocation: artifactstore.ArtifactLocation{},
 		Status:         common.StatusFailed,
 	}
+}
 
-	// Create a temporary directory
-	tempDir := filepath.Join(os.TempDir(), uuid.New().String())
-	if err := os.MkdirAll(tempDir, 0600); err != nil {
-		return result, fmt.Errorf("failed to create temporary directory: %v", err)
+// failureResult is a failed result recording why the job failed, so the
+// cause can be shown with the repository.
+func failureResult(job queue.AnalyzeJob, err error) queue.AnalyzeResult {
+	result := failedResult(job)
+	diagnostic := codeql.DiagnosticFor(err)
+	var dse *DiskSpaceError
+	var se *StorageError
+	switch {
+	case errors.As(err, &dse):
+		diagnostic.Kind = common.DiagnosticInsufficientDisk
+	case errors.As(err, &se):
+		diagnostic.Kind = se.kind()
 	}
-	defer os.RemoveAll(tempDir)
+	result.Diagnostic = &diagnostic
+	return result
+}
 
-	// Download the query pack as a byte slice
-	queryPackData, err := artifacts.GetQueryPack(job.QueryPackLocation)
-	if err != nil {
-		return result, fmt.Errorf("failed to download query pack: %w", err)
+// errJobCompleted is returned by prepareJob for a job delivered again after
+// its result was recorded.
+var errJobCompleted = errors.New("job already completed")
+
+// prepareJob fetches and extracts the job's database and query pack, and
+// selects the CLI to analyse them with.
+func prepareJob(job queue.AnalyzeJob, v *Visibles) (*jobInputs, error) {
+	if status, err := v.State.GetStatus(job.Spec); err == nil && status == common.StatusSucceeded {
+		return nil, errJobCompleted
 	}
 
-	// Write the query pack data to the filesystem
-	queryPackArchivePath := filepath.Join(tempDir, "query-pack.tar.gz")
-	if err := os.WriteFile(queryPackArchivePath, queryPackData, 0600); err != nil {
-		return result, fmt.Errorf("failed to write query pack archive to disk: %w", err)
+	// Create a temporary directory
+	tempDir := filepath.Join(v.Scratch.dir(), uuid.New().String())
+	if err := os.MkdirAll(tempDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %v", err)
 	}
+	inputs := &jobInputs{tempDir: tempDir}
 
-	// Make a directory and extract the query pack
-	queryPackPath := filepath.Join(tempDir, "pack")
-	if err := os.Mkdir(queryPackPath, 0600); err != nil {
-		return result, fmt.Errorf("failed to create query pack directory: %w", err)
+	// Get the unzipped database, from the cache if possible
+	var err error
+	inputs.databasePath, inputs.databaseIdentity, inputs.releaseDatabase, err =
+		prepareDatabase(job, v, tempDir)
+	if err != nil {
+		inputs.cleanup()
+		return nil, err
 	}
-	if err := utils.UntarGz(queryPackArchivePath, queryPackPath); err != nil {
-		return result, fmt.Errorf("failed to extract query pack: %w", err)
+
+	// Pick the CLI for the database
+	inputs.cliVersion, err = v.Runner.SelectCLI(job, inputs.databasePath)
+	if err != nil {
+		inputs.cleanup()
+		return nil, fmt.Errorf("failed to select CodeQL CLI: %w", err)
 	}
 
-	databaseData, err := dbs.GetDatabase(job.Spec.NameWithOwner)
+	// Get the extracted query pack, from the cache if possible
+	inputs.queryPackPath, inputs.releaseQueryPack, err =
+		prepareQueryPack(job, inputs.cliVersion, v, tempDir)
 	if err != nil {
-		slog.Error("Failed to get database",
-			slog.String("owner", job.Spec.Owner),
-			slog.String("repo", job.Spec.Repo),
-			slog.Int("session_id", job.Spec.SessionID),
-			slog.String("operation", "GetDatabase"),
-			slog.Any("error", err),
-		)
-		return result, fmt.Errorf("failed to get database for %s/%s: %w",
-			job.Spec.Owner, job.Spec.Repo, err)
+		inputs.cleanup()
+		return nil, err
 	}
 
-	// Write the CodeQL database data to the filesystem
-	databasePath := filepath.Join(tempDir, "database.zip")
-	if err := os.WriteFile(databasePath, databaseData, 0600); err != nil {
-		return result, fmt.Errorf("failed to write CodeQL database to disk: %w", err)
+	// Extract the model packs
+	for i, ref := range job.ModelPacks {
+		dir := filepath.Join(tempDir, "model-packs", strconv.Itoa(i))
+		if err := fetchPack(v.Artifacts, ref.Location, dir, tempDir); err != nil {
+			inputs.cleanup()
+			return nil, fmt.Errorf("model pack %s: %w", ref.Name, err)
+		}
+		inputs.modelPacks = append(inputs.modelPacks, codeql.ModelPack{Name: ref.Name, Path: dir})
 	}
 
-	// Perform the CodeQL analysis
-	runResult, err := codeql.RunQuery(databasePath, job.QueryLanguage, queryPackPath, tempDir)
+	return inputs, nil
+}
+
+// analyzeJob runs the analysis on prepared inputs and uploads the results.
+func analyzeJob(job queue.AnalyzeJob, inputs *jobInputs, v *Visibles) (queue.AnalyzeResult, error) {
+	result := failedResult(job)
+
+	// Perform the CodeQL analysis with the selected CLI
+	job.CLIVersion = inputs.cliVersion
+	packs := codeql.AnalysisPacks{QueryPack: inputs.queryPackPath, ModelPacks: inputs.modelPacks}
+	runResult, err := v.Runner.RunQuery(inputs.databasePath, job, packs, inputs.tempDir)
 	if err != nil {
 		return result, fmt.Errorf("failed to run analysis: %w", err)
 	}
@@ -157,9 +232,9 @@ func RunAnalysisJob(
 
 	// Upload the archive to storage
 	slog.Debug("Results archive size", slog.Int("size", len(resultsArchive)))
-	resultsLocation, err := artifacts.SaveResult(job.Spec, resultsArchive)
+	resultsLocation, err := v.Artifacts.SaveResult(job.Spec, resultsArchive)
 	if err != nil {
-		return result, fmt.Errorf("failed to save results archive: %w", err)
+		return result, fmt.Errorf("failed to save results archive: %w", storageFailure(err))
 	}
 
 	result = queue.AnalyzeResult{
@@ -169,17 +244,197 @@ func RunAnalysisJob(
 		Status:               common.StatusSucceeded,
 		SourceLocationPrefix: runResult.SourceLocationPrefix,
 		DatabaseSHA:          runResult.DatabaseSHA,
+		DatabaseIdentity:     inputs.databaseIdentity,
+		QueryPackHash:        job.QueryPackHash,
+		AnalysisHash:         job.AnalysisHash(),
+		CLIVersion:           runResult.CLIVersion,
+		DatabaseUpgraded:     runResult.DatabaseUpgraded,
+		QueryResults:         runResult.QueryResults,
+		SlowPredicates:       runResult.SlowPredicates,
+	}
+
+	// Store the evaluator log summary next to the results
+	if runResult.EvaluatorLogSummary != "" {
+		summary, err := os.ReadFile(runResult.EvaluatorLogSummary)
+		if err == nil {
+			result.EvaluatorLogLocation, err = v.Artifacts.SaveEvaluatorLogSummary(job.Spec, summary)
+		}
+		if err != nil {
+			// The results are complete without it
+			slog.Warn("Failed to save evaluator log summary",
+				slog.Int("session_id", job.Spec.SessionID),
+				slog.String("owner", job.Spec.Owner),
+				slog.String("repo", job.Spec.Repo),
+				slog.Any("error", err),
+			)
+			result.EvaluatorLogLocation = artifactstore.ArtifactLocation{}
+		}
 	}
 
 	return result, nil
 }
 
-// RunWorker runs a worker that processes jobs from queue
+// prepareQueryPack makes the job's query pack available extracted.  With a
+// pack cache, the pack is also precompiled, once per pack and CLI version.
+// It returns the pack path and a function to call once the analysis is done
+// with it.
+func prepareQueryPack(job queue.AnalyzeJob, cliVersion string, v *Visibles, tempDir string) (string, func(), error) {
+	if v.PackCache == nil {
+		queryPackPath := filepath.Join(tempDir, "pack")
+		if err := fetchPack(v.Artifacts, job.QueryPackLocation, queryPackPath, tempDir); err != nil {
+			return "", nil, err
+		}
+		return queryPackPath, func() {}, nil
+	}
+
+	// The compiled queries are only read by the analyses, so concurrent
+	// jobs of a session share the entry.
+	lease, err := v.PackCache.AcquireShared(queryPackCacheKey(job.QueryPackHash, cliVersion),
+		func(dir string) error {
+			if err := fetchPack(v.Artifacts, job.QueryPackLocation, dir, tempDir); err != nil {
+				return err
+			}
+			if err := v.Runner.PrecompileQueryPack(cliVersion, dir); err != nil {
+				return fmt.Errorf("failed to precompile query pack: %w", err)
+			}
+			return nil
+		})
+	if err != nil {
+		return "", nil, err
+	}
+
+	slog.Info("Query pack cache lookup",
+		slog.Int("session_id", job.Spec.SessionID),
+		slog.String("query_pack_hash", job.QueryPackHash),
+		slog.Bool("hit", lease.Hit),
+		slog.Any("stats", v.PackCache.Stats()),
+	)
+	return lease.Dir, lease.Release, nil
+}
+
+// queryPackCacheKey identifies a pack compiled by one CLI version.
+func queryPackCacheKey(queryPackHash, cliVersion string) string {
+	return fmt.Sprintf("%s@%s", queryPackHash, cliVersion)
+}
+
+// fetchPack downloads a query or model pack and extracts it into dest, using
+// tempDir for the archive.
+func fetchPack(artifacts artifactstore.Store, location artifactstore.ArtifactLocation, dest, tempDir string) error {
+	// Download the pack as a byte slice
+	packData, err := artifacts.GetQueryPack(location)
+	if err != nil {
+		return fmt.Errorf("failed to download pack: %w", storageFailure(err))
+	}
+
+	// Write the pack data to the filesystem
+	packArchivePath := filepath.Join(tempDir, "pack.tar.gz")
+	if err := os.WriteFile(packArchivePath, packData, 0600); err != nil {
+		return fmt.Errorf("failed to write pack archive to disk: %w", err)
+	}
+	defer os.Remove(packArchivePath)
+
+	// Make a directory and extract the pack
+	if err := os.MkdirAll(dest, 0700); err != nil {
+		return fmt.Errorf("failed to create pack directory: %w", err)
+	}
+	if err := utils.UntarGz(packArchivePath, dest); err != nil {
+		return fmt.Errorf("failed to extract pack: %w", err)
+	}
+	return nil
+}
+
+// prepareDatabase makes the job's database available unzipped.  It returns
+// the database path, the identity of the database version, and a function to
+// call once the analysis is done with it.
+func prepareDatabase(job queue.AnalyzeJob, v *Visibles, tempDir string) (string, string, func(), error) {
+	info, err := v.CodeQLDBStore.GetDatabaseInfo(job.Spec.NameWithOwner)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("failed to get database info for %s/%s: %w",
+			job.Spec.Owner, job.Spec.Repo, storageFailure(err))
+	}
+
+	if v.DBCache == nil {
+		databasePath := filepath.Join(tempDir, "db")
+		if err := fetchDatabase(job, v.CodeQLDBStore, v.Scratch, databasePath, tempDir); err != nil {
+			return "", "", nil, err
+		}
+		return databasePath, info.Identity(), func() {}, nil
+	}
+
+	lease, err := v.DBCache.Acquire(databaseCacheKey(job.Spec.NameWithOwner, info),
+		func(dir string) error {
+			return fetchDatabase(job, v.CodeQLDBStore, v.Scratch, dir, tempDir)
+		})
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	slog.Info("Database cache lookup",
+		slog.String("owner", job.Spec.Owner),
+		slog.String("repo", job.Spec.Repo),
+		slog.Bool("hit", lease.Hit),
+		slog.Any("stats", v.DBCache.Stats()),
+	)
+	return lease.Dir, info.Identity(), lease.Release, nil
+}
+
+// databaseCacheKey identifies one version of a repository's database.
+// parseDatabaseCacheKey must be kept in sync.
+func databaseCacheKey(nwo common.NameWithOwner, info qldbstore.DatabaseInfo) string {
+	return fmt.Sprintf("%s/%s@%s", nwo.Owner, nwo.Repo, info.Identity())
+}
+
+// fetchDatabase downloads the job's database and unzips it into dest, using
+// tempDir for the archive.  It fails with a *DiskSpaceError, before writing
+// anything, if the archive and its contents would not leave the scratch
+// space's minimum free.
+func fetchDatabase(job queue.AnalyzeJob, dbs qldbstore.Store, scratch Scratch, dest, tempDir string) error {
+	databaseData, err := dbs.GetDatabase(job.Spec.NameWithOwner)
+	if err != nil {
+		slog.Error("Failed to get database",
+			slog.String("owner", job.Spec.Owner),
+			slog.String("repo", job.Spec.Repo),
+			slog.Int("session_id", job.Spec.SessionID),
+			slog.String("operation", "GetDatabase"),
+			slog.Any("error", err),
+		)
+		return fmt.Errorf("failed to get database for %s/%s: %w",
+			job.Spec.Owner, job.Spec.Repo, storageFailure(err))
+	}
+
+	// At the peak, the archive and its contents are both on disk
+	unzippedSize, err := utils.UnzippedSize(databaseData)
+	if err != nil {
+		return fmt.Errorf("failed to read database archive: %w", err)
+	}
+	if err := scratch.checkDiskSpace(tempDir, uint64(len(databaseData))); err != nil {
+		return err
+	}
+	if err := scratch.checkDiskSpace(filepath.Dir(dest), uint64(len(databaseData))+unzippedSize); err != nil {
+		return err
+	}
+
+	// Write the CodeQL database data to the filesystem
+	databaseZipPath := filepath.Join(tempDir, "database.zip")
+	if err := os.WriteFile(databaseZipPath, databaseData, 0600); err != nil {
+		return fmt.Errorf("failed to write CodeQL database to disk: %w", err)
+	}
+	defer os.Remove(databaseZipPath)
+
+	if err := utils.UnzipFile(databaseZipPath, dest); err != nil {
+		return fmt.Errorf("failed to unzip database: %w", err)
+	}
+	return nil
+}
+
+// RunWorker runs a worker that processes jobs from queue.  A job is only
+// removed from the queue once its result is published.
+//
+// If v.Prefetch allows, the worker takes the following job from the queue
+// and prepares its inputs while the current job is analysed.  A prefetched
+// job that has not started when the worker stops is returned to the queue.
 func RunWorker(ctx context.Context,
-	artifacts artifactstore.Store,
-	databases qldbstore.Store,
-	queue queue.Queue,
-	serverState state.ServerState,
+	v *Visibles,
 	stopChan chan struct{},
 	wg *sync.WaitGroup) {
 	const (
@@ -189,6 +444,16 @@ func RunWorker(ctx context.Context,
 
 	defer wg.Done()
 	slog.Info("Worker started")
+	v.Activity.workerStarted()
+	defer v.Activity.workerStopped()
+
+	var next *prefetch
+	defer func() {
+		if next != nil {
+			next.abandon(v)
+		}
+	}()
+
 	for {
 		select {
 		case <-stopChan:
@@ -198,21 +463,36 @@ func RunWorker(ctx context.Context,
 			slog.Info(WORKER_CONTEXT_STOP_MESSAGE)
 			return
 		default:
+		}
+
+		var delivery queue.JobDelivery
+		var inputs *jobInputs
+		var err error
+
+		if next != nil {
 			select {
-			case job, ok := <-queue.Jobs():
-				if !ok {
+			case p := <-next.done:
+				next.finish(v)
+				next = nil
+				if !p.ok {
 					return
 				}
-				slog.Info("Running analysis job", slog.Any("job", job))
-				// Set status to InProgress when starting the job
-				serverState.SetStatus(job.Spec, common.StatusInProgress)
-				result, err := RunAnalysisJob(job, artifacts, databases)
-				if err != nil {
-					slog.Error("Failed to run analysis job", slog.Any("error", err))
-					continue
+				delivery, inputs, err = p.delivery, p.inputs, p.err
+			case <-stopChan:
+				slog.Info(WORKER_COUNT_STOP_MESSAGE)
+				return
+			case <-ctx.Done():
+				slog.Info(WORKER_CONTEXT_STOP_MESSAGE)
+				return
+			}
+		} else {
+			select {
+			case d, ok := <-v.Queue.Deliveries():
+				if !ok {
+					return
 				}
-				slog.Info("Analysis job completed", slog.Any("result", result))
-				queue.Results() <- result
+				delivery = d
+				inputs, err = prepareJob(delivery.Job, v)
 			case <-stopChan:
 				slog.Info(WORKER_COUNT_STOP_MESSAGE)
 				return
@@ -221,5 +501,76 @@ func RunWorker(ctx context.Context,
 				return
 			}
 		}
+
+		job := delivery.Job
+		if errors.Is(err, errJobCompleted) {
+			// Repeat the recorded result, which the server ignores, to
+			// release the job
+			slog.Info("Skipping completed analysis job", slog.Any("job", job))
+			previous, err := v.State.GetResult(job.Spec)
+			if err != nil {
+				previous = failedResult(job)
+			}
+			completeJob(delivery, previous)
+			continue
+		}
+		var dse *DiskSpaceError
+		if errors.As(err, &dse) && dse.transient() {
+			slog.Warn("Deferring analysis job until disk space is freed",
+				slog.Any("job", job), slog.Any("error", err))
+			if err := delivery.Requeue(); err != nil {
+				slog.Error("Failed to defer analysis job", slog.Any("job", job), slog.Any("error", err))
+			}
+			select {
+			case <-time.After(diskDeferDelay):
+			case <-stopChan:
+				slog.Info(WORKER_COUNT_STOP_MESSAGE)
+				return
+			case <-ctx.Done():
+				slog.Info(WORKER_CONTEXT_STOP_MESSAGE)
+				return
+			}
+			continue
+		}
+		if err != nil {
+			slog.Error("Failed to prepare analysis job", slog.Any("job", job), slog.Any("error", err))
+			completeJob(delivery, failureResult(job, err))
+			continue
+		}
+
+		// Only start the next fetch once this job's inputs are held, so two
+		// workers can never wait on each other's cached databases.
+		if v.Prefetch.tryAcquire() {
+			next = startPrefetch(v)
+		}
+
+		slog.Info("Running analysis job", slog.Any("job", job))
+		// Set status to InProgress when starting the job
+		v.State.SetStatus(job.Spec, common.StatusInProgress)
+		v.Autoscale.jobStarted()
+		v.Activity.jobStarted(job.Spec)
+		result, err := analyzeJob(job, inputs, v)
+		v.Activity.jobDone(job.Spec)
+		v.Autoscale.jobDone()
+		inputs.cleanup()
+		if err != nil {
+			slog.Error("Failed to run analysis job", slog.Any("job", job), slog.Any("error", err))
+			result = failureResult(job, err)
+		} else {
+			slog.Info("Analysis job completed", slog.Any("result", result))
+		}
+		completeJob(delivery, result)
+	}
+}
+
+// completeJob publishes the result, carrying the job's earlier attempts,
+// and releases the job from the queue.  On failure the queue delivers the
+// job again.
+func completeJob(delivery queue.JobDelivery, result queue.AnalyzeResult) {
+	if result.Attempts == nil {
+		result.Attempts = delivery.Job.Attempts
+	}
+	if err := delivery.Complete(result); err != nil {
+		slog.Error("Failed to complete analysis job", slog.Any("job", delivery.Job.Spec), slog.Any("error", err))
 	}
 }
@@ -0,0 +1,234 @@
+package agent
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/queue"
+)
+
+// autoscaleMetrics are published under "agent_autoscale" on /debug/vars
+// by ServeMetrics.
+var autoscaleMetrics = expvar.NewMap("agent_autoscale")
+
+const (
+	// idleChecksBeforeShrink is the number of consecutive checks finding
+	// idle workers and an empty queue before a worker is stopped.
+	idleChecksBeforeShrink = 3
+	defaultScaleInterval   = 30 * time.Second
+	defaultMaxLoadPerCPU   = 1.0
+)
+
+// Autoscale bounds the agent's adaptive worker pool.  A nil *Autoscale
+// keeps the worker count fixed.
+//
+// The pool grows while jobs wait in the queue for want of an idle worker and
+// the host has WorkerMemoryMB available per added worker and a load below
+// MaxLoadPerCPU.  It shrinks by one worker after the queue has been empty
+// with idle workers for a few checks.
+type Autoscale struct {
+	MinWorkers     int
+	MaxWorkers     int
+	WorkerMemoryMB int64
+	MaxLoadPerCPU  float64
+	Interval       time.Duration
+
+	busy atomic.Int64
+}
+
+// NewAutoscale returns the bounds of a pool of minWorkers to maxWorkers, or
+// nil if maxWorkers <= 0.  Zero interval and maxLoadPerCPU select defaults.
+func NewAutoscale(minWorkers, maxWorkers int, workerMemoryMB int64,
+	maxLoadPerCPU float64, interval time.Duration) *Autoscale {
+	if maxWorkers <= 0 {
+		return nil
+	}
+	if minWorkers < 1 {
+		minWorkers = 1
+	}
+	if maxWorkers < minWorkers {
+		maxWorkers = minWorkers
+	}
+	if maxLoadPerCPU <= 0 {
+		maxLoadPerCPU = defaultMaxLoadPerCPU
+	}
+	if interval <= 0 {
+		interval = defaultScaleInterval
+	}
+	return &Autoscale{
+		MinWorkers:     minWorkers,
+		MaxWorkers:     maxWorkers,
+		WorkerMemoryMB: workerMemoryMB,
+		MaxLoadPerCPU:  maxLoadPerCPU,
+		Interval:       interval,
+	}
+}
+
+// jobStarted and jobDone count the workers running an analysis.
+func (a *Autoscale) jobStarted() {
+	if a != nil {
+		a.busy.Add(1)
+	}
+}
+
+func (a *Autoscale) jobDone() {
+	if a != nil {
+		a.busy.Add(-1)
+	}
+}
+
+// scaleInput is what a scaling decision is based on.
+type scaleInput struct {
+	workers    int
+	busy       int
+	depth      int
+	haveDepth  bool
+	idleChecks int // consecutive earlier checks that found the pool idle
+	host       hostResources
+}
+
+// decide returns the change in worker count and its reason.
+func (a *Autoscale) decide(in scaleInput) (int, string) {
+	if in.workers < a.MinWorkers {
+		return a.MinWorkers - in.workers, "below minimum"
+	}
+	if !in.haveDepth {
+		return 0, "queue depth unknown"
+	}
+
+	idle := in.workers - in.busy
+	if in.depth > idle {
+		if in.workers >= a.MaxWorkers {
+			return 0, "at maximum"
+		}
+		if in.host.haveLoad && in.host.loadPerCPU >= a.MaxLoadPerCPU {
+			return 0, fmt.Sprintf("load %.2f per CPU", in.host.loadPerCPU)
+		}
+		grow := min(in.depth-idle, a.MaxWorkers-in.workers)
+		if in.host.haveMem && a.WorkerMemoryMB > 0 {
+			grow = min(grow, int(in.host.memAvailableMB/a.WorkerMemoryMB))
+			if grow <= 0 {
+				return 0, fmt.Sprintf("%d MB memory available", in.host.memAvailableMB)
+			}
+		}
+		return grow, fmt.Sprintf("%d jobs waiting, %d workers idle", in.depth, idle)
+	}
+
+	if in.depth == 0 && idle > 0 && in.workers > a.MinWorkers &&
+		in.idleChecks+1 >= idleChecksBeforeShrink {
+		return -1, fmt.Sprintf("queue empty, %d workers idle", idle)
+	}
+	return 0, ""
+}
+
+// run starts MinWorkers workers and adjusts the pool every Interval until
+// ctx is cancelled.
+func (a *Autoscale) run(ctx context.Context, v *Visibles, wg *sync.WaitGroup) {
+	depthReporter, haveDepth := v.Queue.(queue.DepthReporter)
+	if !haveDepth {
+		slog.Warn("Queue does not report its depth; worker pool will not grow")
+	}
+	slog.Info("Starting adaptive worker pool",
+		slog.Int("min", a.MinWorkers), slog.Int("max", a.MaxWorkers),
+		slog.Int64("worker_memory_mb", a.WorkerMemoryMB),
+		slog.Float64("max_load_per_cpu", a.MaxLoadPerCPU),
+		slog.Duration("interval", a.Interval))
+
+	var stopChans []chan struct{}
+	defer func() {
+		for _, stopChan := range stopChans {
+			close(stopChan)
+		}
+		autoscaleMetrics.Set("workers", new(expvar.Int))
+	}()
+
+	ticker := time.NewTicker(a.Interval)
+	defer ticker.Stop()
+
+	var idleChecks int
+	for {
+		in := scaleInput{
+			workers:    len(stopChans),
+			busy:       int(a.busy.Load()),
+			idleChecks: idleChecks,
+			host:       readHostResources(),
+		}
+		if haveDepth {
+			depth, err := depthReporter.Depth()
+			if err != nil {
+				slog.Warn("Failed to get queue depth", slog.Any("error", err))
+			} else {
+				in.depth, in.haveDepth = depth, true
+			}
+		}
+
+		delta, reason := a.decide(in)
+		if in.haveDepth && in.depth == 0 && in.busy < in.workers {
+			idleChecks++
+		} else {
+			idleChecks = 0
+		}
+
+		switch {
+		case delta > 0:
+			for i := 0; i < delta; i++ {
+				stopChan := make(chan struct{})
+				stopChans = append(stopChans, stopChan)
+				wg.Add(1)
+				go RunWorker(ctx, v, stopChan, wg)
+			}
+			autoscaleMetrics.Add("scale_ups", 1)
+		case delta < 0:
+			for i := 0; i < -delta && len(stopChans) > 0; i++ {
+				last := len(stopChans) - 1
+				close(stopChans[last])
+				stopChans = stopChans[:last]
+			}
+			idleChecks = 0
+			autoscaleMetrics.Add("scale_downs", 1)
+		}
+		if delta != 0 {
+			slog.Info("Resized worker pool",
+				slog.Int("from", in.workers), slog.Int("to", len(stopChans)),
+				slog.String("reason", reason), slog.Int("queue_depth", in.depth),
+				slog.Int("busy", in.busy), slog.Int64("mem_available_mb", in.host.memAvailableMB),
+				slog.Float64("load_per_cpu", in.host.loadPerCPU))
+		} else if reason != "" {
+			slog.Debug("Worker pool unchanged", slog.Int("workers", in.workers),
+				slog.String("reason", reason), slog.Int("queue_depth", in.depth))
+		}
+
+		a.publishMetrics(in, len(stopChans), reason)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *Autoscale) publishMetrics(in scaleInput, workers int, reason string) {
+	set := func(key string, value int64) {
+		i := new(expvar.Int)
+		i.Set(value)
+		autoscaleMetrics.Set(key, i)
+	}
+	set("workers", int64(workers))
+	set("busy_workers", int64(in.busy))
+	set("queue_depth", int64(in.depth))
+	set("mem_available_mb", in.host.memAvailableMB)
+	load := new(expvar.Float)
+	load.Set(in.host.loadPerCPU)
+	autoscaleMetrics.Set("load_per_cpu", load)
+	if reason != "" {
+		decision := new(expvar.String)
+		decision.Set(reason)
+		autoscaleMetrics.Set("last_decision", decision)
+	}
+}
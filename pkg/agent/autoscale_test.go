@@ -0,0 +1,138 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAutoscaleDecide(t *testing.T) {
+	a := NewAutoscale(2, 6, 1000, 1.5, time.Minute)
+	roomy := hostResources{memAvailableMB: 16000, haveMem: true, loadPerCPU: 0.5, haveLoad: true}
+
+	for _, tc := range []struct {
+		name   string
+		in     scaleInput
+		want   int
+		reason string
+	}{
+		{
+			name:   "below minimum",
+			in:     scaleInput{workers: 0},
+			want:   2,
+			reason: "below minimum",
+		},
+		{
+			name:   "depth unknown",
+			in:     scaleInput{workers: 3, busy: 3, host: roomy},
+			want:   0,
+			reason: "queue depth unknown",
+		},
+		{
+			name:   "jobs waiting",
+			in:     scaleInput{workers: 2, busy: 2, depth: 2, haveDepth: true, host: roomy},
+			want:   2,
+			reason: "2 jobs waiting, 0 workers idle",
+		},
+		{
+			name: "idle workers take waiting jobs",
+			in:   scaleInput{workers: 4, busy: 2, depth: 2, haveDepth: true, host: roomy},
+			want: 0,
+		},
+		{
+			name:   "clamped to maximum",
+			in:     scaleInput{workers: 4, busy: 4, depth: 10, haveDepth: true, host: roomy},
+			want:   2,
+			reason: "10 jobs waiting",
+		},
+		{
+			name:   "at maximum",
+			in:     scaleInput{workers: 6, busy: 6, depth: 10, haveDepth: true, host: roomy},
+			want:   0,
+			reason: "at maximum",
+		},
+		{
+			name: "load at threshold",
+			in: scaleInput{workers: 2, busy: 2, depth: 3, haveDepth: true,
+				host: hostResources{loadPerCPU: 1.5, haveLoad: true}},
+			want:   0,
+			reason: "load 1.50 per CPU",
+		},
+		{
+			name: "load below threshold",
+			in: scaleInput{workers: 2, busy: 2, depth: 1, haveDepth: true,
+				host: hostResources{loadPerCPU: 1.49, haveLoad: true}},
+			want: 1,
+		},
+		{
+			name: "clamped to memory",
+			in: scaleInput{workers: 2, busy: 2, depth: 3, haveDepth: true,
+				host: hostResources{memAvailableMB: 1999, haveMem: true}},
+			want: 1,
+		},
+		{
+			name: "no memory for a worker",
+			in: scaleInput{workers: 2, busy: 2, depth: 3, haveDepth: true,
+				host: hostResources{memAvailableMB: 999, haveMem: true}},
+			want:   0,
+			reason: "999 MB memory available",
+		},
+		{
+			name: "host unknown",
+			in:   scaleInput{workers: 2, busy: 2, depth: 3, haveDepth: true},
+			want: 3,
+		},
+		{
+			name: "idle, cooling down",
+			in:   scaleInput{workers: 4, busy: 1, haveDepth: true, idleChecks: idleChecksBeforeShrink - 2, host: roomy},
+			want: 0,
+		},
+		{
+			name:   "idle long enough",
+			in:     scaleInput{workers: 4, busy: 1, haveDepth: true, idleChecks: idleChecksBeforeShrink - 1, host: roomy},
+			want:   -1,
+			reason: "queue empty, 3 workers idle",
+		},
+		{
+			name: "idle at minimum",
+			in:   scaleInput{workers: 2, haveDepth: true, idleChecks: 10, host: roomy},
+			want: 0,
+		},
+		{
+			name: "all busy with empty queue",
+			in:   scaleInput{workers: 4, busy: 4, haveDepth: true, idleChecks: 10, host: roomy},
+			want: 0,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, reason := a.decide(tc.in)
+			if got != tc.want || !strings.Contains(reason, tc.reason) {
+				t.Errorf("decide(%+v) = %d, %q, want %d, %q", tc.in, got, reason, tc.want, tc.reason)
+			}
+		})
+	}
+}
+
+func TestNewAutoscale(t *testing.T) {
+	for _, tc := range []struct {
+		min, max         int
+		wantMin, wantMax int
+	}{
+		{1, 4, 1, 4},
+		{0, 4, 1, 4},
+		{-3, 4, 1, 4},
+		{5, 3, 5, 5},
+	} {
+		a := NewAutoscale(tc.min, tc.max, 0, 0, 0)
+		if a == nil || a.MinWorkers != tc.wantMin || a.MaxWorkers != tc.wantMax {
+			t.Errorf("NewAutoscale(%d, %d) = %+v, want %d to %d workers", tc.min, tc.max, a, tc.wantMin, tc.wantMax)
+			continue
+		}
+		if a.Interval != defaultScaleInterval || a.MaxLoadPerCPU != defaultMaxLoadPerCPU {
+			t.Errorf("NewAutoscale(%d, %d) = %+v, want default interval and load", tc.min, tc.max, a)
+		}
+	}
+	if a := NewAutoscale(1, 0, 0, 0, 0); a != nil {
+		t.Errorf("NewAutoscale without maximum = %+v, want nil", a)
+	}
+}
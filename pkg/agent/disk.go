@@ -0,0 +1,69 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// diskDeferDelay is how long a worker waits after deferring a job for lack
+// of disk space, so that running jobs can finish and free theirs.
+const diskDeferDelay = 30 * time.Second
+
+// Scratch is where an agent's jobs keep their temporary files, and the disk
+// space they must leave free.
+type Scratch struct {
+	// Dir is empty for the system temporary directory.
+	Dir           string
+	MinFreeDiskMB int64
+}
+
+func (s Scratch) dir() string {
+	if s.Dir == "" {
+		return os.TempDir()
+	}
+	return s.Dir
+}
+
+// DiskSpaceError reports that a job's files would not leave the minimum free
+// disk space.
+type DiskSpaceError struct {
+	Dir          string
+	NeededBytes  uint64
+	FreeBytes    uint64
+	TotalBytes   uint64
+	MinFreeBytes uint64
+}
+
+func (e *DiskSpaceError) Error() string {
+	return fmt.Sprintf("insufficient disk space in %s: need %d MB and %d MB free, have %d MB of %d MB",
+		e.Dir, e.NeededBytes>>20, e.MinFreeBytes>>20, e.FreeBytes>>20, e.TotalBytes>>20)
+}
+
+// transient reports whether the job would fit once other jobs' files are
+// gone, so that it is worth deferring rather than failing.
+func (e *DiskSpaceError) transient() bool {
+	return e.NeededBytes+e.MinFreeBytes <= e.TotalBytes
+}
+
+// checkDiskSpace returns a *DiskSpaceError if writing needed bytes below dir
+// would leave less than the minimum free.
+func (s Scratch) checkDiskSpace(dir string, needed uint64) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return fmt.Errorf("failed to get free disk space of %s: %w", dir, err)
+	}
+	free := uint64(st.Bavail) * uint64(st.Bsize)
+	minFree := uint64(s.MinFreeDiskMB) << 20
+	if needed+minFree <= free {
+		return nil
+	}
+	return &DiskSpaceError{
+		Dir:          dir,
+		NeededBytes:  needed,
+		FreeBytes:    free,
+		TotalBytes:   uint64(st.Blocks) * uint64(st.Bsize),
+		MinFreeBytes: minFree,
+	}
+}
@@ -0,0 +1,167 @@
+package agent
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/hohn/mrvacommander/pkg/queue"
+)
+
+// sendHeartbeats periodically reports this agent to the server: the
+// databases it has cached, so that jobs for them are routed here first, and
+// the jobs it is running, so that they are recovered should the agent stop.
+// A report is also sent as soon as a job starts.
+func sendHeartbeats(ctx context.Context, v *Visibles) {
+	reporter, ok := v.Queue.(queue.AgentReporter)
+	if !ok {
+		return
+	}
+
+	ticker := time.NewTicker(queue.AgentReportInterval)
+	defer ticker.Stop()
+
+	for {
+		report := queue.AgentReport{
+			RunningJobs: v.Activity.runningJobs(),
+			Workers:     v.Activity.workers(),
+		}
+		if v.DBCache != nil {
+			report.Databases = cachedRepositories(v)
+		}
+		if err := reporter.ReportAgent(report); err != nil {
+			slog.Warn("Failed to send heartbeat", slog.Any("error", err))
+		} else {
+			slog.Debug("Sent heartbeat", slog.Int("databases", len(report.Databases)),
+				slog.Int("running_jobs", len(report.RunningJobs)))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-v.Activity.started():
+		}
+	}
+}
+
+// Activity tracks an agent's workers and the jobs they are running, for its
+// heartbeats.  A nil *Activity tracks nothing.
+type Activity struct {
+	mu      sync.Mutex
+	running map[common.JobSpec]int
+	count   int
+	start   chan struct{} // signalled when a job starts
+}
+
+func NewActivity() *Activity {
+	return &Activity{
+		running: make(map[common.JobSpec]int),
+		start:   make(chan struct{}, 1),
+	}
+}
+
+func (a *Activity) workerStarted() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.count++
+}
+
+func (a *Activity) workerStopped() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.count--
+}
+
+func (a *Activity) jobStarted(spec common.JobSpec) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	a.running[spec]++
+	a.mu.Unlock()
+
+	select {
+	case a.start <- struct{}{}:
+	default:
+	}
+}
+
+func (a *Activity) jobDone(spec common.JobSpec) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.running[spec]--; a.running[spec] <= 0 {
+		delete(a.running, spec)
+	}
+}
+
+func (a *Activity) runningJobs() []common.JobSpec {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	specs := make([]common.JobSpec, 0, len(a.running))
+	for spec := range a.running {
+		specs = append(specs, spec)
+	}
+	return specs
+}
+
+func (a *Activity) workers() int {
+	if a == nil {
+		return 0
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.count
+}
+
+// started is signalled when a job starts; it is nil, never ready, for a
+// nil *Activity.
+func (a *Activity) started() <-chan struct{} {
+	if a == nil {
+		return nil
+	}
+	return a.start
+}
+
+// cachedRepositories lists the repositories with a database in v.DBCache.
+func cachedRepositories(v *Visibles) []common.NameWithOwner {
+	seen := make(map[common.NameWithOwner]bool)
+	var repos []common.NameWithOwner
+	for _, key := range v.DBCache.Keys() {
+		nwo, ok := parseDatabaseCacheKey(key)
+		if !ok || seen[nwo] {
+			continue
+		}
+		seen[nwo] = true
+		repos = append(repos, nwo)
+	}
+	return repos
+}
+
+// parseDatabaseCacheKey recovers the repository from a databaseCacheKey.
+func parseDatabaseCacheKey(key string) (common.NameWithOwner, bool) {
+	nwo, _, found := strings.Cut(key, "@")
+	if !found {
+		return common.NameWithOwner{}, false
+	}
+	owner, repo, found := strings.Cut(nwo, "/")
+	if !found {
+		return common.NameWithOwner{}, false
+	}
+	return common.NameWithOwner{Owner: owner, Repo: repo}, true
+}
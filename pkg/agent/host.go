@@ -0,0 +1,69 @@
+package agent
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// hostResources is a snapshot of the memory and CPU available to new
+// workers.  The fields are only meaningful when the matching have* flag is
+// set; they are read from /proc and missing on other systems.
+type hostResources struct {
+	memAvailableMB int64
+	haveMem        bool
+	loadPerCPU     float64
+	haveLoad       bool
+}
+
+func readHostResources() hostResources {
+	var r hostResources
+	if mb, err := memAvailableMB(); err == nil {
+		r.memAvailableMB, r.haveMem = mb, true
+	}
+	if load, err := loadAverage(); err == nil {
+		r.loadPerCPU, r.haveLoad = load/float64(runtime.NumCPU()), true
+	}
+	return r
+}
+
+// memAvailableMB is the MemAvailable estimate of /proc/meminfo.
+func memAvailableMB() (int64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid MemAvailable %q", fields[1])
+			}
+			return kb / 1024, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("MemAvailable not found in /proc/meminfo")
+}
+
+// loadAverage is the one-minute load average of /proc/loadavg.
+func loadAverage() (float64, error) {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("empty /proc/loadavg")
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
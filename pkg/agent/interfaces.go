@@ -2,12 +2,48 @@ package agent
 
 import (
 	"github.com/hohn/mrvacommander/pkg/artifactstore"
+	"github.com/hohn/mrvacommander/pkg/codeql"
+	"github.com/hohn/mrvacommander/pkg/diskcache"
 	"github.com/hohn/mrvacommander/pkg/qldbstore"
 	"github.com/hohn/mrvacommander/pkg/queue"
+	"github.com/hohn/mrvacommander/pkg/state"
 )
 
+// AnalysisRunner runs a query pack, customized by model packs and the job's
+// threat models, against an unzipped database, writing its outputs under
+// tempDir.  codeql.CLIRunner uses the CodeQL CLI;
+// codeql.FakeRunner produces canned results for tests.
+// The CLI version is job.CLIVersion; when empty, it is chosen as SelectCLI
+// would.
+type AnalysisRunner interface {
+	RunQuery(database string, job queue.AnalyzeJob, packs codeql.AnalysisPacks, tempDir string) (*codeql.RunQueryResult, error)
+	// SelectCLI returns the CLI version to analyse the database with.
+	SelectCLI(job queue.AnalyzeJob, database string) (string, error)
+	// PrecompileQueryPack compiles the queries of the extracted pack in
+	// place with the given CLI version, so that later runs skip compilation.
+	PrecompileQueryPack(cliVersion string, queryPackPath string) error
+}
+
 type Visibles struct {
 	Queue         queue.Queue
 	Artifacts     artifactstore.Store
 	CodeQLDBStore qldbstore.Store
+	State         state.ServerState
+	Runner        AnalysisRunner
+	// DBCache keeps unzipped databases between jobs; nil disables caching.
+	DBCache *diskcache.Cache
+	// PackCache keeps compiled query packs between jobs; nil disables
+	// caching.
+	PackCache *diskcache.Cache
+	// Prefetch bounds jobs prepared ahead of time; nil disables prefetching.
+	Prefetch *PrefetchLimit
+	// Scratch holds the jobs' temporary files; the zero value uses the
+	// system temporary directory.
+	Scratch Scratch
+	// Autoscale bounds an adaptive worker pool; nil keeps the worker count
+	// fixed.
+	Autoscale *Autoscale
+	// Activity tracks the running jobs reported in heartbeats; nil reports
+	// none.
+	Activity *Activity
 }
@@ -0,0 +1,31 @@
+package agent
+
+import (
+	"expvar"
+	"log/slog"
+	"net"
+	"net/http"
+)
+
+// MetricsHandler serves the agent's expvar metrics, among them
+// agent_autoscale, as JSON at /debug/vars.
+func MetricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
+
+// ServeMetrics listens on addr and serves MetricsHandler in the background
+// for the rest of the agent's life.  It returns the address listened on.
+func ServeMetrics(addr string) (net.Addr, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		if err := http.Serve(listener, MetricsHandler()); err != nil {
+			slog.Error("Agent metrics server stopped", slog.Any("error", err))
+		}
+	}()
+	return listener.Addr(), nil
+}
@@ -0,0 +1,58 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestServeMetrics(t *testing.T) {
+	addr, err := ServeMetrics("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ServeMetrics() error = %v", err)
+	}
+
+	a := NewAutoscale(1, 4, 1000, 1.5, 0)
+	in := scaleInput{busy: 2, depth: 5, haveDepth: true,
+		host: hostResources{memAvailableMB: 8000, loadPerCPU: 0.75}}
+	a.publishMetrics(in, 3, "5 jobs waiting")
+
+	resp, err := http.Get("http://" + addr.String() + "/debug/vars")
+	if err != nil {
+		t.Fatalf("GET /debug/vars error = %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /debug/vars status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	var vars struct {
+		Autoscale struct {
+			Workers        int64   `json:"workers"`
+			BusyWorkers    int64   `json:"busy_workers"`
+			QueueDepth     int64   `json:"queue_depth"`
+			MemAvailableMB int64   `json:"mem_available_mb"`
+			LoadPerCPU     float64 `json:"load_per_cpu"`
+			LastDecision   string  `json:"last_decision"`
+		} `json:"agent_autoscale"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&vars); err != nil {
+		t.Fatalf("decoding /debug/vars: %v", err)
+	}
+	got := vars.Autoscale
+	for _, tc := range []struct {
+		key       string
+		got, want any
+	}{
+		{"workers", got.Workers, int64(3)},
+		{"busy_workers", got.BusyWorkers, int64(2)},
+		{"queue_depth", got.QueueDepth, int64(5)},
+		{"mem_available_mb", got.MemAvailableMB, int64(8000)},
+		{"load_per_cpu", got.LoadPerCPU, 0.75},
+		{"last_decision", got.LastDecision, "5 jobs waiting"},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("agent_autoscale.%s = %v, want %v", tc.key, tc.got, tc.want)
+		}
+	}
+}
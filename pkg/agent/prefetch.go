@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"log/slog"
+
+	"github.com/hohn/mrvacommander/pkg/queue"
+)
+
+// PrefetchLimit bounds the number of jobs an agent's workers hold while
+// fetching their inputs ahead of time.  A nil *PrefetchLimit disables
+// prefetching.
+type PrefetchLimit struct {
+	slots chan struct{}
+}
+
+// NewPrefetchLimit allows up to n prefetches at once; n <= 0 returns nil.
+func NewPrefetchLimit(n int) *PrefetchLimit {
+	if n <= 0 {
+		return nil
+	}
+	return &PrefetchLimit{slots: make(chan struct{}, n)}
+}
+
+func (p *PrefetchLimit) tryAcquire() bool {
+	if p == nil {
+		return false
+	}
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *PrefetchLimit) release() {
+	<-p.slots
+}
+
+// prefetch takes one job from the queue and prepares its inputs in the
+// background.
+type prefetch struct {
+	cancel chan struct{}
+	done   chan prefetched
+}
+
+type prefetched struct {
+	ok       bool // false if no job was taken
+	delivery queue.JobDelivery
+	inputs   *jobInputs
+	err      error
+}
+
+// startPrefetch must be called holding a slot of v.Prefetch; finish or
+// abandon gives it back.
+func startPrefetch(v *Visibles) *prefetch {
+	p := &prefetch{
+		cancel: make(chan struct{}),
+		done:   make(chan prefetched, 1),
+	}
+
+	go func() {
+		select {
+		case delivery, ok := <-v.Queue.Deliveries():
+			if !ok {
+				p.done <- prefetched{}
+				return
+			}
+			slog.Debug("Prefetching analysis job", slog.Any("job", delivery.Job))
+			inputs, err := prepareJob(delivery.Job, v)
+			p.done <- prefetched{ok: true, delivery: delivery, inputs: inputs, err: err}
+		case <-p.cancel:
+			p.done <- prefetched{}
+		}
+	}()
+
+	return p
+}
+
+// finish gives back the prefetch slot after the result has been taken.
+func (p *prefetch) finish(v *Visibles) {
+	v.Prefetch.release()
+}
+
+// abandon stops the prefetch and returns its job, if it took one, to the
+// queue.  It waits for a fetch already in progress to complete.
+func (p *prefetch) abandon(v *Visibles) {
+	close(p.cancel)
+	r := <-p.done
+	defer p.finish(v)
+
+	if !r.ok {
+		return
+	}
+	if r.inputs != nil {
+		r.inputs.cleanup()
+	}
+	slog.Info("Returning prefetched job to the queue", slog.Any("job", r.delivery.Job))
+	if err := r.delivery.Return(); err != nil {
+		slog.Error("Failed to return prefetched job", slog.Any("job", r.delivery.Job), slog.Any("error", err))
+	}
+}
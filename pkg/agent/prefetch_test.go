@@ -0,0 +1,280 @@
+package agent
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/artifactstore"
+	"github.com/hohn/mrvacommander/pkg/codeql"
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/hohn/mrvacommander/pkg/qldbstore"
+	"github.com/hohn/mrvacommander/pkg/queue"
+	"github.com/hohn/mrvacommander/pkg/state"
+)
+
+// heldRunner is a codeql.FakeRunner whose analyses wait for release.  It
+// reports the repositories whose inputs were prepared and the analyses
+// started.
+type heldRunner struct {
+	codeql.FakeRunner
+	prepared chan string
+	started  chan string
+	release  chan struct{}
+}
+
+func newHeldRunner() *heldRunner {
+	return &heldRunner{
+		FakeRunner: codeql.FakeRunner{ResultCount: 1},
+		prepared:   make(chan string, 10),
+		started:    make(chan string, 10),
+		release:    make(chan struct{}),
+	}
+}
+
+func (r *heldRunner) SelectCLI(job queue.AnalyzeJob, database string) (string, error) {
+	r.prepared <- job.Spec.Repo
+	return r.FakeRunner.SelectCLI(job, database)
+}
+
+func (r *heldRunner) RunQuery(database string, job queue.AnalyzeJob,
+	packs codeql.AnalysisPacks, tempDir string) (*codeql.RunQueryResult, error) {
+	r.started <- job.Spec.Repo
+	<-r.release
+	return r.FakeRunner.RunQuery(database, job, packs, tempDir)
+}
+
+// prefetchTest runs workers sharing a prefetch limit against a QueueSingle
+// holding one job per repository of the "octo" owner.
+type prefetchTest struct {
+	q      queue.Queue
+	v      *Visibles
+	runner *heldRunner
+	jobs   map[string]queue.AnalyzeJob
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newPrefetchTest(t *testing.T, workers, maxPrefetch int, repos ...string) *prefetchTest {
+	t.Helper()
+
+	dbDir := t.TempDir()
+	artifacts := artifactstore.NewInMemoryArtifactStore()
+	packLocation, err := artifacts.SaveQueryPack(1, testPack(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pt := &prefetchTest{
+		q:      queue.NewQueueSingle(workers),
+		runner: newHeldRunner(),
+		jobs:   make(map[string]queue.AnalyzeJob),
+	}
+	pt.v = &Visibles{
+		Queue:         pt.q,
+		Artifacts:     artifacts,
+		CodeQLDBStore: qldbstore.NewLocalFilesystemCodeQLDatabaseStore(dbDir),
+		State:         state.NewLocalState(1),
+		Runner:        pt.runner,
+		Prefetch:      NewPrefetchLimit(maxPrefetch),
+		Scratch:       Scratch{Dir: t.TempDir()},
+		Activity:      NewActivity(),
+	}
+	for _, repo := range repos {
+		nwo := common.NameWithOwner{Owner: "octo", Repo: repo}
+		writeTestDatabase(t, dbDir, nwo)
+		job := queue.AnalyzeJob{
+			Spec:              common.JobSpec{SessionID: 1, NameWithOwner: nwo},
+			QueryPackLocation: packLocation,
+			QueryLanguage:     "javascript",
+			QueryPackHash:     "pack",
+		}
+		pt.jobs[repo] = job
+		pt.v.State.SetStatus(job.Spec, common.StatusPending)
+		pt.q.Jobs() <- job
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pt.cancel = cancel
+	for i := 0; i < workers; i++ {
+		pt.wg.Add(1)
+		go RunWorker(ctx, pt.v, make(chan struct{}), &pt.wg)
+	}
+	t.Cleanup(func() {
+		select {
+		case <-pt.runner.release:
+		default:
+			close(pt.runner.release)
+		}
+		cancel()
+		pt.wg.Wait()
+	})
+	return pt
+}
+
+// await returns the next repository reported on c.
+func await(t *testing.T, c chan string, what string) string {
+	t.Helper()
+	select {
+	case repo := <-c:
+		return repo
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+		return ""
+	}
+}
+
+func TestPrefetchAbandonedOnShutdown(t *testing.T) {
+	pt := newPrefetchTest(t, 1, 1, "first", "second")
+
+	if repo := await(t, pt.runner.started, "first analysis"); repo != "first" {
+		t.Fatalf("started %s, want first", repo)
+	}
+	await(t, pt.runner.prepared, "first job's inputs")
+	if repo := await(t, pt.runner.prepared, "prefetch"); repo != "second" {
+		t.Fatalf("prefetched %s, want second", repo)
+	}
+
+	pt.cancel()
+	close(pt.runner.release)
+	pt.wg.Wait()
+
+	select {
+	case d := <-pt.q.Results():
+		if d.Result.Spec.Repo != "first" || d.Result.Status != common.StatusSucceeded {
+			t.Errorf("result = %s %v, want first succeeded", d.Result.Spec.Repo, d.Result.Status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the first job's result")
+	}
+	select {
+	case d := <-pt.q.Results():
+		t.Errorf("unexpected result for %s", d.Result.Spec.Repo)
+	default:
+	}
+
+	// The prefetched job is back in the queue, without an attempt counted
+	select {
+	case d := <-pt.q.Deliveries():
+		if d.Job.Spec.Repo != "second" {
+			t.Errorf("redelivered %s, want second", d.Job.Spec.Repo)
+		}
+		if len(d.Job.Attempts) != 0 {
+			t.Errorf("redelivered job has %d attempts, want 0", len(d.Job.Attempts))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("abandoned prefetch was not returned to the queue")
+	}
+
+	if n := len(pt.v.Prefetch.slots); n != 0 {
+		t.Errorf("%d prefetch slots held after shutdown, want 0", n)
+	}
+	entries, err := os.ReadDir(pt.v.Scratch.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("%d scratch entries left after shutdown, want 0", len(entries))
+	}
+}
+
+func TestPrefetchLimit(t *testing.T) {
+	// Two busy workers may hold one prefetched job between them, leaving
+	// the fourth job with the queue and the fifth in its buffer.
+	pt := newPrefetchTest(t, 2, 1, "a", "b", "c", "d", "e")
+
+	await(t, pt.runner.started, "first analysis")
+	await(t, pt.runner.started, "second analysis")
+	for i := 0; i < 3; i++ {
+		await(t, pt.runner.prepared, "inputs")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case repo := <-pt.runner.prepared:
+		t.Fatalf("prepared %s beyond the prefetch limit", repo)
+	default:
+	}
+	if n := len(pt.v.Prefetch.slots); n != 1 {
+		t.Errorf("%d prefetch slots held, want 1", n)
+	}
+	if depth, _ := pt.q.(queue.DepthReporter).Depth(); depth != 1 {
+		t.Errorf("queue depth = %d, want 1", depth)
+	}
+
+	close(pt.runner.release)
+	done := make(map[string]bool)
+	for len(done) < len(pt.jobs) {
+		select {
+		case d := <-pt.q.Results():
+			if d.Result.Status != common.StatusSucceeded {
+				t.Errorf("%s: status %v, want succeeded", d.Result.Spec.Repo, d.Result.Status)
+			}
+			done[d.Result.Spec.Repo] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out with %d of %d jobs done", len(done), len(pt.jobs))
+		}
+	}
+}
+
+// writeTestDatabase stores a minimal database zip in the local store layout.
+func writeTestDatabase(t *testing.T, base string, nwo common.NameWithOwner) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range map[string]string{
+		"db/codeql-database.yml": "primaryLanguage: javascript\n",
+		"db/src.zip":             "",
+	} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(base, nwo.Owner, nwo.Repo)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, nwo.Owner+"_"+nwo.Repo+"_db.zip")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testPack returns a minimal query pack archive.
+func testPack(t *testing.T) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range map[string]string{
+		"qlpack.yml": "name: test/pack\nversion: 0.0.1\n",
+		"Example.ql": "select 1\n",
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
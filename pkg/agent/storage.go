@@ -0,0 +1,42 @@
+package agent
+
+import (
+	"errors"
+	"net"
+	"net/url"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+)
+
+// StorageError is a failure to read from the database store or to read
+// from or write to the artifact store.  Such failures are often transient,
+// so the server may retry the job.
+type StorageError struct {
+	Err error
+}
+
+func (e *StorageError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StorageError) Unwrap() error {
+	return e.Err
+}
+
+// storageFailure marks err, if any, as a StorageError.
+func storageFailure(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &StorageError{Err: err}
+}
+
+// kind tells failures to reach the store from failures reported by it.
+func (e *StorageError) kind() common.DiagnosticKind {
+	var netErr net.Error
+	var urlErr *url.Error
+	if errors.As(e.Err, &netErr) || errors.As(e.Err, &urlErr) {
+		return common.DiagnosticNetworkError
+	}
+	return common.DiagnosticStorageError
+}
@@ -1,5 +1,14 @@
 package artifactstore
 
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+)
+
 // Restrict the keys / values for ArtifactLocation and centralize the common ones
 // here
 var (
@@ -11,3 +20,21 @@ type ArtifactLocation struct {
 	Key    string // location in bucket OR full location for file paths
 	Bucket string // which bucket: packs or results
 }
+
+var ErrModelPackNotFound = errors.New("model pack not found")
+
+// evaluatorLogSummaryKey is the key of a job's evaluator log summary.
+func evaluatorLogSummaryKey(jobSpec common.JobSpec) string {
+	return fmt.Sprintf("%d-evaluator-log-summary-%s", jobSpec.SessionID, jobSpec.NameWithOwner)
+}
+
+// modelPackKey is the key of a named model pack.
+func modelPackKey(name string) string {
+	return "model-packs/" + name + ".tgz"
+}
+
+// queryPackKey is the content-addressed key of a query pack.
+func queryPackKey(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "packs/" + hex.EncodeToString(sum[:])
+}
@@ -6,9 +6,23 @@ type Store interface {
 	// GetQueryPack retrieves the query pack from the specified location.
 	GetQueryPack(location ArtifactLocation) ([]byte, error)
 
-	// SaveQueryPack saves the query pack using the session ID and returns the artifact location.
+	// SaveQueryPack saves the query pack under its content hash, records a
+	// reference from the session, and returns the artifact location.
+	// Identical packs from different sessions share one stored copy.
 	SaveQueryPack(sessionId int, data []byte) (ArtifactLocation, error)
 
+	// ReleaseQueryPack drops the session's reference to the query pack and
+	// deletes the pack once no session references it.
+	ReleaseQueryPack(sessionId int, location ArtifactLocation) error
+
+	// SaveModelPack stores a model pack under its pack name, e.g.
+	// acme/java-models, replacing any earlier upload of that name.
+	SaveModelPack(name string, data []byte) error
+
+	// GetModelPack retrieves the named model pack.  It returns an error
+	// wrapping ErrModelPackNotFound if there is none.
+	GetModelPack(name string) ([]byte, error)
+
 	// GetResult retrieves the result from the specified location.
 	GetResult(location ArtifactLocation) ([]byte, error)
 
@@ -17,4 +31,11 @@ type Store interface {
 
 	// SaveResult saves the result using the JobSpec and returns the artifact location.
 	SaveResult(jobSpec common.JobSpec, data []byte) (ArtifactLocation, error)
+
+	// SaveEvaluatorLogSummary saves the evaluator log summary of a job next
+	// to its result and returns the artifact location.
+	SaveEvaluatorLogSummary(jobSpec common.JobSpec, data []byte) (ArtifactLocation, error)
+
+	// GetEvaluatorLogSummary retrieves the summary from the specified location.
+	GetEvaluatorLogSummary(location ArtifactLocation) ([]byte, error)
 }
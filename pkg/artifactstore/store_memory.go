@@ -9,15 +9,19 @@ import (
 
 // InMemoryArtifactStore is an in-memory implementation of the ArtifactStore interface
 type InMemoryArtifactStore struct {
-	mu      sync.Mutex
-	packs   map[string][]byte
-	results map[string][]byte
+	mu       sync.Mutex
+	packs    map[string][]byte
+	packRefs map[string]map[int]struct{}
+	models   map[string][]byte
+	results  map[string][]byte
 }
 
 func NewInMemoryArtifactStore() *InMemoryArtifactStore {
 	return &InMemoryArtifactStore{
-		packs:   make(map[string][]byte),
-		results: make(map[string][]byte),
+		packs:    make(map[string][]byte),
+		packRefs: make(map[string]map[int]struct{}),
+		models:   make(map[string][]byte),
+		results:  make(map[string][]byte),
 	}
 }
 
@@ -34,13 +38,17 @@ func (store *InMemoryArtifactStore) GetQueryPack(location ArtifactLocation) ([]b
 	return data, nil
 }
 
-// SaveQueryPack saves the query pack using the session ID and returns the artifact location
+// SaveQueryPack saves the query pack under its content hash and returns the artifact location
 func (store *InMemoryArtifactStore) SaveQueryPack(sessionId int, data []byte) (ArtifactLocation, error) {
 	store.mu.Lock()
 	defer store.mu.Unlock()
 
-	key := fmt.Sprintf("%d-packs", sessionId)
-	store.packs[key] = data
+	key := queryPackKey(data)
+	if _, exists := store.packs[key]; !exists {
+		store.packs[key] = data
+		store.packRefs[key] = make(map[int]struct{})
+	}
+	store.packRefs[key][sessionId] = struct{}{}
 
 	location := ArtifactLocation{
 		Bucket: AF_BUCKETNAME_PACKS,
@@ -49,6 +57,44 @@ func (store *InMemoryArtifactStore) SaveQueryPack(sessionId int, data []byte) (A
 	return location, nil
 }
 
+// ReleaseQueryPack drops the session's reference and deletes unreferenced packs
+func (store *InMemoryArtifactStore) ReleaseQueryPack(sessionId int, location ArtifactLocation) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	refs, exists := store.packRefs[location.Key]
+	if !exists {
+		return fmt.Errorf("query pack not found: %s", location.Key)
+	}
+	delete(refs, sessionId)
+	if len(refs) == 0 {
+		delete(store.packRefs, location.Key)
+		delete(store.packs, location.Key)
+	}
+	return nil
+}
+
+// SaveModelPack stores the model pack under its name
+func (store *InMemoryArtifactStore) SaveModelPack(name string, data []byte) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.models[modelPackKey(name)] = data
+	return nil
+}
+
+// GetModelPack retrieves the named model pack
+func (store *InMemoryArtifactStore) GetModelPack(name string) ([]byte, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	data, exists := store.models[modelPackKey(name)]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrModelPackNotFound, name)
+	}
+	return data, nil
+}
+
 // GetResult retrieves the result from the specified location
 func (store *InMemoryArtifactStore) GetResult(location ArtifactLocation) ([]byte, error) {
 	store.mu.Lock()
@@ -75,6 +121,28 @@ func (store *InMemoryArtifactStore) GetResultSize(location ArtifactLocation) (in
 	return len(data), nil
 }
 
+// SaveEvaluatorLogSummary saves the summary next to the job's result
+func (store *InMemoryArtifactStore) SaveEvaluatorLogSummary(jobSpec common.JobSpec, data []byte) (ArtifactLocation, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	key := evaluatorLogSummaryKey(jobSpec)
+	store.results[key] = data
+	return ArtifactLocation{Bucket: AF_BUCKETNAME_RESULTS, Key: key}, nil
+}
+
+// GetEvaluatorLogSummary retrieves the summary from the specified location
+func (store *InMemoryArtifactStore) GetEvaluatorLogSummary(location ArtifactLocation) ([]byte, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	data, exists := store.results[location.Key]
+	if !exists {
+		return nil, fmt.Errorf("evaluator log summary not found: %s", location.Key)
+	}
+	return data, nil
+}
+
 // SaveResult saves the result using the JobSpec and returns the artifact location
 func (store *InMemoryArtifactStore) SaveResult(jobSpec common.JobSpec, data []byte) (ArtifactLocation, error) {
 	store.mu.Lock()
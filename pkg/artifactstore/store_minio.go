@@ -4,9 +4,12 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"log/slog"
 	"math"
+	"strings"
+	"sync"
 
 	"github.com/hohn/mrvacommander/pkg/common"
 
@@ -16,6 +19,11 @@ import (
 
 type MinIOArtifactStore struct {
 	client *minio.Client
+
+	// packLocks serialize saving and releasing a query pack, so a release
+	// does not delete a pack that a concurrent save found stored.  Packs
+	// share a lock by the hash of their key.
+	packLocks [64]sync.Mutex
 }
 
 func NewMinIOArtifactStore(endpoint, id, secret string, lookup minio.BucketLookupType) (*MinIOArtifactStore, error) {
@@ -39,11 +47,98 @@ func (store *MinIOArtifactStore) GetQueryPack(location ArtifactLocation) ([]byte
 	return store.getArtifact(location)
 }
 
-func (store *MinIOArtifactStore) SaveQueryPack(jobId int, data []byte) (ArtifactLocation, error) {
-	key := fmt.Sprintf("%d-packs", jobId)
+// SaveQueryPack stores the pack at most once per content hash.  Each session
+// using the pack holds a reference, an empty object under packRefsPrefix.
+func (store *MinIOArtifactStore) SaveQueryPack(sessionId int, data []byte) (ArtifactLocation, error) {
+	ctx := context.Background()
+	key := queryPackKey(data)
+
+	lock := store.packLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	_, err := store.client.PutObject(ctx, AF_BUCKETNAME_PACKS, packRefKey(key, sessionId),
+		bytes.NewReader(nil), 0, minio.PutObjectOptions{})
+	if err != nil {
+		return ArtifactLocation{}, fmt.Errorf("failed to record query pack reference: %w", err)
+	}
+
+	_, err = store.client.StatObject(ctx, AF_BUCKETNAME_PACKS, key, minio.StatObjectOptions{})
+	if err == nil {
+		slog.Debug("Query pack already stored", "key", key, "session_id", sessionId)
+		return ArtifactLocation{Bucket: AF_BUCKETNAME_PACKS, Key: key}, nil
+	}
+	if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+		return ArtifactLocation{}, err
+	}
 	return store.saveArtifact(AF_BUCKETNAME_PACKS, key, data, "application/gzip")
 }
 
+// ReleaseQueryPack removes the session's reference and deletes the pack when
+// no references remain.  This server is the only one saving and releasing
+// packs, so holding the pack's lock makes checking and deleting atomic.
+func (store *MinIOArtifactStore) ReleaseQueryPack(sessionId int, location ArtifactLocation) error {
+	lock := store.packLock(location.Key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Cancelling stops the listing when we leave the loop early
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err := store.client.RemoveObject(ctx, location.Bucket, packRefKey(location.Key, sessionId),
+		minio.RemoveObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to remove query pack reference: %w", err)
+	}
+
+	refs := store.client.ListObjects(ctx, location.Bucket, minio.ListObjectsOptions{
+		Prefix:  packRefsPrefix(location.Key),
+		MaxKeys: 1,
+	})
+	for ref := range refs {
+		if ref.Err != nil {
+			return ref.Err
+		}
+		// Still referenced
+		return nil
+	}
+
+	slog.Info("Deleting unreferenced query pack", "key", location.Key)
+	return store.client.RemoveObject(ctx, location.Bucket, location.Key, minio.RemoveObjectOptions{})
+}
+
+func (store *MinIOArtifactStore) packLock(packKey string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(packKey))
+	return &store.packLocks[h.Sum32()%uint32(len(store.packLocks))]
+}
+
+// packRefsPrefix is the prefix of all reference objects of a pack key.
+func packRefsPrefix(packKey string) string {
+	return "packrefs/" + strings.TrimPrefix(packKey, "packs/") + "/"
+}
+
+func packRefKey(packKey string, sessionId int) string {
+	return fmt.Sprintf("%s%d", packRefsPrefix(packKey), sessionId)
+}
+
+func (store *MinIOArtifactStore) SaveModelPack(name string, data []byte) error {
+	_, err := store.saveArtifact(AF_BUCKETNAME_PACKS, modelPackKey(name), data, "application/gzip")
+	return err
+}
+
+func (store *MinIOArtifactStore) GetModelPack(name string) ([]byte, error) {
+	data, err := store.getArtifact(ArtifactLocation{Bucket: AF_BUCKETNAME_PACKS, Key: modelPackKey(name)})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, fmt.Errorf("%w: %s", ErrModelPackNotFound, name)
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
 func (store *MinIOArtifactStore) GetResult(location ArtifactLocation) ([]byte, error) {
 	return store.getArtifact(location)
 }
@@ -68,6 +163,14 @@ func (store *MinIOArtifactStore) SaveResult(jobSpec common.JobSpec, data []byte)
 	return store.saveArtifact(AF_BUCKETNAME_RESULTS, key, data, "application/zip")
 }
 
+func (store *MinIOArtifactStore) SaveEvaluatorLogSummary(jobSpec common.JobSpec, data []byte) (ArtifactLocation, error) {
+	return store.saveArtifact(AF_BUCKETNAME_RESULTS, evaluatorLogSummaryKey(jobSpec), data, "text/plain")
+}
+
+func (store *MinIOArtifactStore) GetEvaluatorLogSummary(location ArtifactLocation) ([]byte, error) {
+	return store.getArtifact(location)
+}
+
 func (store *MinIOArtifactStore) getArtifact(location ArtifactLocation) ([]byte, error) {
 	bucket := location.Bucket
 	key := location.Key
@@ -0,0 +1,163 @@
+package codeql
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CLISet is the CodeQL CLI installations available to an agent, by version.
+//
+// CODEQL_CLI_PATH names the default installation.  CODEQL_CLI_PATHS may list
+// more, separated like PATH entries.
+type CLISet struct {
+	byVersion map[string]CodeqlCli
+	versions  []string // oldest first
+	preferred string   // version of CODEQL_CLI_PATH, if set
+}
+
+// LoadCLISet finds the versions of the installations named in the
+// environment.
+func LoadCLISet() (*CLISet, error) {
+	var paths []string
+	defaultPath := os.Getenv("CODEQL_CLI_PATH")
+	if defaultPath != "" {
+		paths = append(paths, defaultPath)
+	}
+	for _, path := range filepath.SplitList(os.Getenv("CODEQL_CLI_PATHS")) {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("neither CODEQL_CLI_PATH nor CODEQL_CLI_PATHS is set")
+	}
+
+	s := &CLISet{byVersion: map[string]CodeqlCli{}}
+	for _, path := range paths {
+		version, err := getCLIVersion(CodeqlCli{path})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get version of CLI %s: %v", path, err)
+		}
+		if existing, ok := s.byVersion[version]; ok {
+			if existing.Path != path {
+				slog.Warn("Ignoring duplicate CLI version", "version", version,
+					"path", path, "using", existing.Path)
+			}
+			continue
+		}
+		s.byVersion[version] = CodeqlCli{path}
+		s.versions = append(s.versions, version)
+		if path == defaultPath {
+			s.preferred = version
+		}
+	}
+	sort.Slice(s.versions, func(i, j int) bool {
+		return compareVersions(s.versions[i], s.versions[j]) < 0
+	})
+	return s, nil
+}
+
+// Versions lists the available versions, oldest first.
+func (s *CLISet) Versions() []string {
+	return append([]string(nil), s.versions...)
+}
+
+// Select picks the installation for an analysis.  An explicitly requested
+// version must be available.  Otherwise the CLI that created the database is
+// used if present, else the oldest newer one, which can upgrade the database.
+// Without either, or if the database's version is not a version number, the
+// default installation is used.
+func (s *CLISet) Select(requested string, dbCLIVersion string) (string, CodeqlCli, error) {
+	if requested != "" {
+		cli, ok := s.byVersion[requested]
+		if !ok {
+			return "", CodeqlCli{}, fmt.Errorf("CodeQL CLI %s is not available; have %s",
+				requested, strings.Join(s.versions, ", "))
+		}
+		return requested, cli, nil
+	}
+
+	if dbCLIVersion != "" && len(versionParts(dbCLIVersion)) == 0 {
+		slog.Warn("Ignoring unrecognized database CLI version", "database_cli_version", dbCLIVersion)
+		dbCLIVersion = ""
+	}
+	if dbCLIVersion != "" {
+		if cli, ok := s.byVersion[dbCLIVersion]; ok {
+			return dbCLIVersion, cli, nil
+		}
+		for _, version := range s.versions {
+			if compareVersions(version, dbCLIVersion) > 0 {
+				return version, s.byVersion[version], nil
+			}
+		}
+		slog.Warn("Database is newer than every available CLI",
+			"database_cli_version", dbCLIVersion, "available", s.versions)
+	}
+
+	version := s.preferred
+	if version == "" {
+		version = s.versions[len(s.versions)-1]
+	}
+	return version, s.byVersion[version], nil
+}
+
+// selectCLIForDatabase selects the CLI for the unzipped database below
+// database, using the version recorded in its metadata or by an upgrade.
+func (s *CLISet) selectCLIForDatabase(requested string, database string) (string, CodeqlCli, error) {
+	var dbCLIVersion string
+	if requested == "" {
+		dbMetadata, err := getDatabaseMetadata(database)
+		if err != nil {
+			return "", CodeqlCli{}, fmt.Errorf("failed to get database metadata: %v", err)
+		}
+		dbDir, err := findDBDir(database)
+		if err != nil {
+			return "", CodeqlCli{}, fmt.Errorf("failed to get database path: %v", err)
+		}
+		dbCLIVersion = databaseCLIVersion(dbDir, dbMetadata)
+	}
+	return s.Select(requested, dbCLIVersion)
+}
+
+// compareVersions orders dotted version numbers such as 2.17.4.  Suffixes
+// after a '-' or '+' are ignored.
+func compareVersions(a, b string) int {
+	as, bs := versionParts(a), versionParts(b)
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func versionParts(version string) []int {
+	version = strings.TrimPrefix(version, "v")
+	if i := strings.IndexAny(version, "-+"); i >= 0 {
+		version = version[:i]
+	}
+	var parts []int
+	for _, field := range strings.Split(version, ".") {
+		n, err := strconv.Atoi(field)
+		if err != nil {
+			break
+		}
+		parts = append(parts, n)
+	}
+	return parts
+}
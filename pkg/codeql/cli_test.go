@@ -0,0 +1,153 @@
+package codeql
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"2.17.4", "2.17.4", 0},
+		{"2.17.4", "2.17.5", -1},
+		{"2.18.0", "2.17.9", 1},
+		{"2.9.0", "2.10.0", -1},
+		{"2.17", "2.17.0", 0},
+		{"2.17.1", "2.17", 1},
+		{"v2.17.4", "2.17.4", 0},
+		{"2.17.4-rc1", "2.17.4", 0},
+		{"2.17.4+build.5", "2.17.3", 1},
+		{"unknown", "2.17.4", -1},
+		{"unknown", "", 0},
+	} {
+		if got := compareVersions(tc.a, tc.b); got != tc.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+		if got := compareVersions(tc.b, tc.a); got != -tc.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tc.b, tc.a, got, -tc.want)
+		}
+	}
+}
+
+// testCLISet has CLIs at /cli/<version>, with preferred as the default.
+func testCLISet(preferred string, versions ...string) *CLISet {
+	s := &CLISet{byVersion: map[string]CodeqlCli{}, preferred: preferred}
+	for _, v := range versions {
+		s.byVersion[v] = CodeqlCli{Path: "/cli/" + v}
+		s.versions = append(s.versions, v)
+	}
+	return s
+}
+
+func TestCLISetSelect(t *testing.T) {
+	clis := testCLISet("2.17.4", "2.15.0", "2.17.4", "2.18.0")
+
+	for _, tc := range []struct {
+		name      string
+		clis      *CLISet
+		requested string
+		dbVersion string
+		want      string
+		wantErr   string
+	}{
+		{name: "requested", clis: clis, requested: "2.15.0", dbVersion: "2.18.0", want: "2.15.0"},
+		{name: "requested missing", clis: clis, requested: "2.16.0", wantErr: "2.16.0 is not available"},
+		{name: "requested pre-release", clis: clis, requested: "2.17.4-rc1", wantErr: "not available"},
+		{name: "database version", clis: clis, dbVersion: "2.15.0", want: "2.15.0"},
+		{name: "oldest newer", clis: clis, dbVersion: "2.16.3", want: "2.17.4"},
+		{name: "oldest newer than pre-release", clis: clis, dbVersion: "2.17.4-rc1", want: "2.18.0"},
+		{name: "older than all", clis: clis, dbVersion: "2.10.0", want: "2.15.0"},
+		{name: "newer than all", clis: clis, dbVersion: "2.19.0", want: "2.17.4"},
+		{name: "unknown database version", clis: clis, dbVersion: "unknown", want: "2.17.4"},
+		{name: "no database version", clis: clis, want: "2.17.4"},
+		{name: "no default", clis: testCLISet("", "2.15.0", "2.18.0"), dbVersion: "2.19.0", want: "2.18.0"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			version, cli, err := tc.clis.Select(tc.requested, tc.dbVersion)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("Select() error = %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Select() error = %v", err)
+			}
+			if version != tc.want || cli.Path != "/cli/"+tc.want {
+				t.Errorf("Select() = %s at %s, want %s", version, cli.Path, tc.want)
+			}
+		})
+	}
+}
+
+// writeTestDatabase writes a database below dir whose metadata records
+// cliVersion, if any, and which was upgraded for upgradedTo, if set.
+func writeTestDatabase(t *testing.T, dir, cliVersion, upgradedTo string) string {
+	t.Helper()
+	dbDir := filepath.Join(dir, "codeql_db")
+	if err := os.MkdirAll(dbDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	metadata := "sourceLocationPrefix: /src\n"
+	if cliVersion != "" {
+		metadata += "creationMetadata:\n  cliVersion: " + cliVersion + "\n"
+	}
+	files := map[string]string{"codeql-database.yml": metadata, "src.zip": ""}
+	if upgradedTo != "" {
+		files[upgradedMarkerName] = upgradedTo + "\n"
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dbDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestSelectCLIForDatabase(t *testing.T) {
+	clis := testCLISet("2.17.4", "2.15.0", "2.17.4", "2.18.0")
+
+	for _, tc := range []struct {
+		name       string
+		requested  string
+		cliVersion string
+		upgradedTo string
+		missing    bool
+		want       string
+		wantErr    string
+	}{
+		{name: "created by available CLI", cliVersion: "2.15.0", want: "2.15.0"},
+		{name: "created by other CLI", cliVersion: "2.16.1", want: "2.17.4"},
+		{name: "upgraded", cliVersion: "2.15.0", upgradedTo: "2.18.0", want: "2.18.0"},
+		{name: "no creation metadata", want: "2.17.4"},
+		{name: "requested", requested: "2.15.0", cliVersion: "2.18.0", want: "2.15.0"},
+		{name: "requested without metadata", requested: "2.18.0", missing: true, want: "2.18.0"},
+		{name: "requested missing", requested: "2.16.0", cliVersion: "2.15.0", wantErr: "not available"},
+		{name: "no metadata", missing: true, wantErr: "failed to get database metadata"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			database := t.TempDir()
+			if !tc.missing {
+				writeTestDatabase(t, database, tc.cliVersion, tc.upgradedTo)
+			}
+
+			version, _, err := clis.selectCLIForDatabase(tc.requested, database)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("selectCLIForDatabase() error = %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("selectCLIForDatabase() error = %v", err)
+			}
+			if version != tc.want {
+				t.Errorf("selectCLIForDatabase() = %s, want %s", version, tc.want)
+			}
+		})
+	}
+}
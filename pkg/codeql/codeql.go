@@ -9,13 +9,15 @@ import (
 	"io"
 	"log"
 	"log/slog"
+	"github.com/hohn/mrvacommander/pkg/common"
 	"github.com/hohn/mrvacommander/pkg/queue"
-	"github.com/hohn/mrvacommander/utils"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"syscall"
 
 	"gopkg.in/yaml.v3"
@@ -86,25 +88,95 @@ func addFileToZip(zipWriter *zip.Writer, filePath, zipPath string) error {
 	return nil
 }
 
-func RunQuery(database string, language queue.QueryLanguage,
-	queryPackPath string, tempDir string) (*RunQueryResult, error) {
-	path, err := getCodeQLCLIPath()
+// RunQuery runs the query pack against the unzipped database below the
+// directory database, writing its outputs under tempDir.  The CLI is
+// job.CLIVersion if set, else chosen by CLISet.Select.  It uses
+// DefaultResources.
+func RunQuery(database string, job queue.AnalyzeJob,
+	packs AnalysisPacks, tempDir string) (*RunQueryResult, error) {
+	return CLIRunner{Resources: DefaultResources}.RunQuery(database, job, packs, tempDir)
+}
 
-	if err != nil {
-		return nil, fmt.Errorf("failed to get codeql cli path: %v", err)
+// additionalPacks is the --additional-packs search path of the analysis.
+func (p AnalysisPacks) additionalPacks() string {
+	paths := []string{p.QueryPack}
+	for _, mp := range p.ModelPacks {
+		paths = append(paths, mp.Path)
 	}
+	return strings.Join(paths, string(os.PathListSeparator))
+}
 
-	codeql := CodeqlCli{path}
+// evaluationOptions are the per-job settings of an evaluation.
+type evaluationOptions struct {
+	threatModels []string
+	// evaluatorLog is the path of the structured evaluator log to write;
+	// empty for none.
+	evaluatorLog string
+}
+
+// evaluationArgs are the run-queries options applying the model packs,
+// threat models and evaluator log.
+func (p AnalysisPacks) evaluationArgs(opts evaluationOptions) []string {
+	var args []string
+	for _, mp := range p.ModelPacks {
+		args = append(args, "--model-packs="+mp.Name)
+	}
+	for _, tm := range opts.threatModels {
+		args = append(args, "--threat-model="+tm)
+	}
+	if opts.evaluatorLog != "" {
+		args = append(args, "--evaluator-log="+opts.evaluatorLog)
+	}
+	return args
+}
+
+// precompileQueryPack compiles every query of the extracted pack, leaving the
+// compiled form next to the sources where database run-queries and the query
+// server pick it up.
+func precompileQueryPack(codeql CodeqlCli, res Resources, queryPackPath string) error {
+	args := []string{"query", "compile", "--precompile", "--additional-packs", queryPackPath}
+	args = append(args, res.args()...)
+	args = append(args, "--", queryPackPath)
+	cmd := exec.Command(codeql.Path, args...)
+	err := runCLI("compile queries", cmd)
+	var ae *AnalysisError
+	if errors.As(err, &ae) {
+		ae.relativeTo(queryPackPath)
+	}
+	return err
+}
+
+// queryEvaluator evaluates the queries of a pack against a database, leaving
+// one BQRS file per query at <dbDir>/results/<RelativeBqrsFilePath>.
+type queryEvaluator interface {
+	evaluate(dbDir string, packs AnalysisPacks, opts evaluationOptions, pack *ResolvedPack) error
+}
+
+// cliEvaluator evaluates with a fresh database run-queries invocation.
+type cliEvaluator struct {
+	codeql    CodeqlCli
+	resources Resources
+}
+
+func (e cliEvaluator) evaluate(dbDir string, packs AnalysisPacks, opts evaluationOptions, pack *ResolvedPack) error {
+	args := []string{"database", "run-queries", "--additional-packs", packs.additionalPacks()}
+	args = append(args, e.resources.args()...)
+	args = append(args, packs.evaluationArgs(opts)...)
+	args = append(args, "--", dbDir, packs.QueryPack)
+	cmd := exec.Command(e.codeql.Path, args...)
+	return runCLI("run queries", cmd)
+}
+
+func runQuery(codeql CodeqlCli, evaluator queryEvaluator, database string, job queue.AnalyzeJob,
+	packs AnalysisPacks, tempDir string) (*RunQueryResult, error) {
+	queryPackPath := packs.QueryPack
 
 	resultsDir := filepath.Join(tempDir, "results")
-	if err = os.Mkdir(resultsDir, 0755); err != nil {
+	if err := os.Mkdir(resultsDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create results directory: %v", err)
 	}
 
-	databasePath := filepath.Join(tempDir, "db")
-	if utils.UnzipFile(database, databasePath) != nil {
-		return nil, fmt.Errorf("failed to unzip database: %v", err)
-	}
+	databasePath := database
 
 	dbMetadata, err := getDatabaseMetadata(databasePath)
 	if err != nil {
@@ -126,20 +198,78 @@ func RunQuery(database string, language queue.QueryLanguage,
 		return nil, fmt.Errorf("failed to get database path: %v", err)
 	}
 
-	cmd := exec.Command(codeql.Path, "database", "run-queries",
-		"--ram=2048", "--additional-packs", queryPackPath, "--", dbDir, queryPackPath)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return nil, fmt.Errorf("failed to run queries: %v\nOutput: %s", err, output)
+	// The database may be a cached copy used by an earlier job; drop its
+	// results so they cannot be mistaken for this run's.
+	if err := os.RemoveAll(filepath.Join(dbDir, "results")); err != nil {
+		return nil, fmt.Errorf("failed to clear previous results: %v", err)
 	}
 
-	queryPackRunResults, err := getQueryPackRunResults(codeql, dbDir, queryPackPath)
+	cliVersion, err := getCLIVersion(codeql)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get query pack run results: %v", err)
+		// Only result reuse and upgrades depend on the version; the analysis
+		// is valid.
+		slog.Warn("Failed to get CodeQL CLI version", "err", err)
 	}
 
-	sourceLocationPrefix, err := getSourceLocationPrefix(codeql, dbDir)
+	// Bring an old database up to the CLI's dbscheme.  A cached database
+	// stays upgraded for later jobs.
+	var databaseUpgraded bool
+	if cliVersion != "" {
+		needsUpgrade, err := databaseNeedsUpgrade(codeql, dbDir, dbMetadata, cliVersion)
+		if err != nil {
+			slog.Warn("Failed to check whether the database needs an upgrade", "err", err)
+		} else if needsUpgrade {
+			slog.Info("Upgrading database", "owner", job.Spec.Owner, "repo", job.Spec.Repo,
+				"cli_version", cliVersion)
+			if err := upgradeDatabase(codeql, dbDir, packs, cliVersion); err != nil {
+				return nil, err
+			}
+			databaseUpgraded = true
+		}
+	}
+
+	pack, err := resolveQueryPack(codeql, queryPackPath, job.QueryPackHash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve query pack: %v", err)
+	}
+
+	opts := evaluationOptions{threatModels: job.ThreatModels}
+	if job.EvaluatorLog {
+		opts.evaluatorLog = filepath.Join(tempDir, "evaluator-log.jsonl")
+	}
+	if err := evaluator.evaluate(dbDir, packs, opts, pack); err != nil {
+		var ae *AnalysisError
+		if errors.As(err, &ae) {
+			ae.relativeTo(queryPackPath)
+		}
+		return nil, err
+	}
+
+	// The log itself is large; keep its summaries
+	var evaluatorLogSummaryPath string
+	var slowPredicates []common.PredicateTiming
+	if opts.evaluatorLog != "" {
+		evaluatorLogSummaryPath, slowPredicates, err = summarizeEvaluatorLog(codeql, opts.evaluatorLog, tempDir)
+		if err != nil {
+			// The analysis itself succeeded
+			slog.Warn("Failed to summarize evaluator log", "err", err)
+		}
+	}
+
+	queryPackRunResults, err := getQueryPackRunResults(codeql, dbDir, pack)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get source location prefix: %v", err)
+		return nil, fmt.Errorf("failed to get query pack run results: %v", err)
+	}
+
+	// Recent databases record the prefix; older ones need the CLI
+	var sourceLocationPrefix string
+	if dbMetadata.SourceLocationPrefix != nil {
+		sourceLocationPrefix = *dbMetadata.SourceLocationPrefix
+	} else {
+		sourceLocationPrefix, err = getSourceLocationPrefix(codeql, dbDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get source location prefix: %v", err)
+		}
 	}
 
 	shouldGenerateSarif := queryPackSupportsSarif(queryPackRunResults)
@@ -152,13 +282,24 @@ func RunQuery(database string, language queue.QueryLanguage,
 
 	var resultCount int
 	var sarifFilePath string
+	var queryResults []common.QueryResultCount
 
 	if shouldGenerateSarif {
-		sarif, err := generateSarif(codeql, language, dbDir, queryPackPath, databaseSHA, resultsDir)
+		sc := SarifContext{
+			SessionID:        job.Spec.SessionID,
+			Owner:            job.Spec.Owner,
+			Repo:             job.Spec.Repo,
+			DatabaseSHA:      databaseSHA,
+			QueryPackName:    queryPackRunResults.QueryPack.Name,
+			QueryPackVersion: queryPackRunResults.QueryPack.Version,
+			QueryPackHash:    job.QueryPackHash,
+		}
+		sarif, err := generateSarif(codeql, sc, dbDir, queryPackPath, resultsDir)
 		if err != nil {
-			return nil, fmt.Errorf("failed to generate SARIF: %v", err)
+			return nil, fmt.Errorf("failed to generate SARIF: %w", err)
 		}
 		resultCount = getSarifResultCount(sarif)
+		queryResults = getSarifQueryResultCounts(sarif, queryPackRunResults)
 		slog.Debug("Generated SARIF", "resultCount", resultCount)
 		sarifFilePath = filepath.Join(resultsDir, "results.sarif")
 		if err := os.WriteFile(sarifFilePath, sarif, 0644); err != nil {
@@ -166,6 +307,7 @@ func RunQuery(database string, language queue.QueryLanguage,
 		}
 	} else {
 		resultCount = queryPackRunResults.TotalResultsCount
+		queryResults = getBqrsQueryResultCounts(queryPackRunResults)
 		slog.Debug("Did not generate SARIF", "resultCount", resultCount)
 	}
 
@@ -176,11 +318,16 @@ func RunQuery(database string, language queue.QueryLanguage,
 	}
 
 	return &RunQueryResult{
+		CLIVersion:           cliVersion,
+		DatabaseUpgraded:     databaseUpgraded,
+		EvaluatorLogSummary:  evaluatorLogSummaryPath,
+		SlowPredicates:       slowPredicates,
 		ResultCount:          resultCount,
 		DatabaseSHA:          databaseSHA,
 		SourceLocationPrefix: sourceLocationPrefix,
 		BqrsFilePaths:        bqrsFilePaths,
 		SarifFilePath:        sarifFilePath,
+		QueryResults:         queryResults,
 	}, nil
 }
 
@@ -312,6 +459,28 @@ func runCommand(command []string) (CodeQLCommandOutput, error) {
 	return CodeQLCommandOutput{ExitCode: 0, Stdout: string(stdout)}, nil
 }
 
+var (
+	cliVersionsMutex sync.Mutex
+	cliVersions      = map[string]string{}
+)
+
+// getCLIVersion returns the version of the CLI, running it only once per path.
+func getCLIVersion(codeql CodeqlCli) (string, error) {
+	cliVersionsMutex.Lock()
+	defer cliVersionsMutex.Unlock()
+
+	if version, ok := cliVersions[codeql.Path]; ok {
+		return version, nil
+	}
+	output, err := runCommand([]string{codeql.Path, "version", "--format=terse"})
+	if err != nil {
+		return "", fmt.Errorf("unable to run codeql version. Error: %v", err)
+	}
+	version := strings.TrimSpace(output.Stdout)
+	cliVersions[codeql.Path] = version
+	return version, nil
+}
+
 func validateQueryMetadataObject(data []byte) (QueryMetadata, error) {
 	var queryMetadata QueryMetadata
 	if err := json.Unmarshal(data, &queryMetadata); err != nil {
@@ -350,23 +519,115 @@ func getQueryMetadata(codeql CodeqlCli, query string) (QueryMetadata, error) {
 	return validateQueryMetadataObject([]byte(queryMetadataOutput.Stdout))
 }
 
-func getQueryPackRunResults(codeql CodeqlCli, databasePath, queryPackPath string) (*QueryPackRunResults, error) {
-	resultsBasePath := filepath.Join(databasePath, "results")
+// getQueryPackQueries lists the queries that run-queries evaluates for the
+// pack, as absolute paths.
+func getQueryPackQueries(codeql CodeqlCli, queryPackPath string) ([]string, error) {
+	output, err := runCommand([]string{codeql.Path, "resolve", "queries", "--format=bylanguage", "--", queryPackPath})
+	if err != nil {
+		return nil, fmt.Errorf("unable to run codeql resolve queries. Error: %v", err)
+	}
 
-	queryPaths := []string{} // Replace with actual query paths resolution logic
+	var resolved ResolvedQueries
+	if err := json.Unmarshal([]byte(output.Stdout), &resolved); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal resolved queries: %v", err)
+	}
 
-	var queries []Query
-	for _, queryPath := range queryPaths {
-		relativeBqrsFilePath := filepath.Join(queryPackPath, queryPath)
-		bqrsFilePath := filepath.Join(resultsBasePath, relativeBqrsFilePath)
+	var queryPaths []string
+	for _, queries := range resolved.ByLanguage {
+		for queryPath := range queries {
+			queryPaths = append(queryPaths, queryPath)
+		}
+	}
+	if len(queryPaths) == 0 {
+		return nil, fmt.Errorf("no queries found in query pack %s", queryPackPath)
+	}
+	sort.Strings(queryPaths)
+	return queryPaths, nil
+}
 
-		if _, err := os.Stat(bqrsFilePath); os.IsNotExist(err) {
-			return nil, fmt.Errorf("could not find BQRS file for query %s at %s", queryPath, bqrsFilePath)
+// getQueryPackFile reads the pack's qlpack.yml or codeql-pack.yml.
+func getQueryPackFile(queryPackPath string) (QueryPackFile, error) {
+	for _, name := range []string{"qlpack.yml", "codeql-pack.yml"} {
+		data, err := os.ReadFile(filepath.Join(queryPackPath, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return QueryPackFile{}, fmt.Errorf("failed to read %s: %v", name, err)
+		}
+		var pack QueryPackFile
+		if err := yaml.Unmarshal(data, &pack); err != nil {
+			return QueryPackFile{}, fmt.Errorf("failed to unmarshal %s: %v", name, err)
+		}
+		if pack.Name == "" {
+			return QueryPackFile{}, fmt.Errorf("%s has no pack name", name)
 		}
+		return pack, nil
+	}
+	return QueryPackFile{}, fmt.Errorf("no qlpack.yml or codeql-pack.yml in %s", queryPackPath)
+}
 
-		bqrsInfo, err := getBqrsInfo(codeql, bqrsFilePath)
+// getRelativeBqrsFilePath returns where run-queries writes the BQRS file of
+// a query, relative to the database's results directory:
+// <pack name>/<query path within the pack>.bqrs
+func getRelativeBqrsFilePath(queryPackPath, queryPackName, queryPath string) (string, error) {
+	packDir, err := filepath.EvalSymlinks(queryPackPath)
+	if err != nil {
+		return "", err
+	}
+	query, err := filepath.EvalSymlinks(queryPath)
+	if err != nil {
+		return "", err
+	}
+	relativeQueryPath, err := filepath.Rel(packDir, query)
+	if err != nil || strings.HasPrefix(relativeQueryPath, "..") {
+		return "", fmt.Errorf("query %s is not inside query pack %s", queryPath, queryPackPath)
+	}
+	return filepath.Join(queryPackName, strings.TrimSuffix(relativeQueryPath, ".ql")+".bqrs"), nil
+}
+
+// resolvedPacks caches resolved query packs by content hash, so a session's
+// pack is resolved once per agent rather than once per repository.
+var (
+	resolvedPacksMutex sync.Mutex
+	resolvedPacks      = map[string]*ResolvedPack{}
+)
+
+const maxResolvedPacks = 256
+
+// resolveQueryPack lists the pack's queries with their metadata.  Paths in
+// the result are relative to the pack; packHash identifies the pack's
+// content and may be empty to bypass the cache.
+func resolveQueryPack(codeql CodeqlCli, queryPackPath, packHash string) (*ResolvedPack, error) {
+	if packHash != "" {
+		resolvedPacksMutex.Lock()
+		pack, ok := resolvedPacks[packHash]
+		resolvedPacksMutex.Unlock()
+		if ok {
+			return pack, nil
+		}
+	}
+
+	queryPaths, err := getQueryPackQueries(codeql, queryPackPath)
+	if err != nil {
+		return nil, err
+	}
+
+	queryPack, err := getQueryPackFile(queryPackPath)
+	if err != nil {
+		return nil, err
+	}
+
+	packDir, err := filepath.EvalSymlinks(queryPackPath)
+	if err != nil {
+		return nil, err
+	}
+
+	pack := &ResolvedPack{QueryPack: queryPack}
+	for _, queryPath := range queryPaths {
+		relativeBqrsFilePath, err := getRelativeBqrsFilePath(queryPackPath, queryPack.Name, queryPath)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get BQRS info: %v", err)
+			return nil, fmt.Errorf("failed to locate BQRS file: %v", err)
 		}
 
 		queryMetadata, err := getQueryMetadata(codeql, queryPath)
@@ -374,10 +635,53 @@ func getQueryPackRunResults(codeql CodeqlCli, databasePath, queryPackPath string
 			return nil, fmt.Errorf("failed to get query metadata: %v", err)
 		}
 
-		queries = append(queries, Query{
-			QueryPath:            queryPath,
-			QueryMetadata:        queryMetadata,
+		query, err := filepath.EvalSymlinks(queryPath)
+		if err != nil {
+			return nil, err
+		}
+		relativeQueryPath, err := filepath.Rel(packDir, query)
+		if err != nil {
+			return nil, err
+		}
+
+		pack.Queries = append(pack.Queries, ResolvedQuery{
+			RelativeQueryPath:    relativeQueryPath,
 			RelativeBqrsFilePath: relativeBqrsFilePath,
+			QueryMetadata:        queryMetadata,
+		})
+	}
+
+	if packHash != "" {
+		resolvedPacksMutex.Lock()
+		if len(resolvedPacks) >= maxResolvedPacks {
+			resolvedPacks = map[string]*ResolvedPack{}
+		}
+		resolvedPacks[packHash] = pack
+		resolvedPacksMutex.Unlock()
+	}
+	return pack, nil
+}
+
+func getQueryPackRunResults(codeql CodeqlCli, databasePath string, pack *ResolvedPack) (*QueryPackRunResults, error) {
+	resultsBasePath := filepath.Join(databasePath, "results")
+
+	var queries []Query
+	for _, rq := range pack.Queries {
+		bqrsFilePath := filepath.Join(resultsBasePath, rq.RelativeBqrsFilePath)
+
+		if _, err := os.Stat(bqrsFilePath); os.IsNotExist(err) {
+			return nil, fmt.Errorf("could not find BQRS file for query %s at %s", rq.RelativeQueryPath, bqrsFilePath)
+		}
+
+		bqrsInfo, err := getBqrsInfo(codeql, bqrsFilePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get BQRS info: %v", err)
+		}
+
+		queries = append(queries, Query{
+			QueryPath:            rq.RelativeQueryPath,
+			QueryMetadata:        rq.QueryMetadata,
+			RelativeBqrsFilePath: rq.RelativeBqrsFilePath,
 			BqrsInfo:             bqrsInfo,
 		})
 	}
@@ -395,6 +699,7 @@ func getQueryPackRunResults(codeql CodeqlCli, databasePath, queryPackPath string
 		Queries:           queries,
 		TotalResultsCount: totalResultsCount,
 		ResultsBasePath:   resultsBasePath,
+		QueryPack:         pack.QueryPack,
 	}, nil
 }
 
@@ -455,6 +760,10 @@ func querySupportsSarif(queryMetadata QueryMetadata, bqrsInfo BQRSInfo) bool {
 }
 
 func getSarifOutputType(queryMetadata QueryMetadata, compatibleQueryKinds []string) string {
+	// Queries without @kind, like most table queries, have no SARIF form
+	if queryMetadata.Kind == nil {
+		return ""
+	}
 	if (*queryMetadata.Kind == "path-problem" || *queryMetadata.Kind == "path-alert") && contains(compatibleQueryKinds, "PathProblem") {
 		return "path-problem"
 	}
@@ -464,11 +773,11 @@ func getSarifOutputType(queryMetadata QueryMetadata, compatibleQueryKinds []stri
 	return ""
 }
 
-func generateSarif(codeql CodeqlCli, language queue.QueryLanguage, databasePath, queryPackPath, databaseSHA string, resultsDir string) ([]byte, error) {
+func generateSarif(codeql CodeqlCli, sc SarifContext, databasePath, queryPackPath string, resultsDir string) ([]byte, error) {
 	sarifFile := filepath.Join(resultsDir, "results.sarif")
 	cmd := exec.Command(codeql.Path, "database", "interpret-results", "--format=sarif-latest", "--output="+sarifFile, "--sarif-add-snippets", "--no-group-results", databasePath, queryPackPath)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return nil, fmt.Errorf("failed to generate SARIF: %v\nOutput: %s", err, output)
+	if err := runCLI("interpret results", cmd); err != nil {
+		return nil, err
 	}
 
 	sarifData, err := os.ReadFile(sarifFile)
@@ -476,57 +785,13 @@ func generateSarif(codeql CodeqlCli, language queue.QueryLanguage, databasePath,
 		return nil, fmt.Errorf("failed to read SARIF file: %v", err)
 	}
 
-	// Modify the sarif: start by extracting a fully dynamic structure.
-	// Previous attempts with a fully typechecked SARIF input have failed;
-	// there are simply too many optional fields that may vanish or appear at
-	// any time.
-
-	// Read json into a fully dynamic Go structure, check for the presence of an
-	// array 'Runs' in the top-level object, iterate over 'Runs' and for every
-	// entry append to the field 'VersionControlProvenance'
-
-	// Decode JSON into a map for a fully dynamic structure
-	var data map[string]interface{}
-	if err := json.Unmarshal([]byte(sarifData), &data); err != nil {
-		slog.Error("Error decoding SARIF", "err", err)
-		return nil, err
-	}
-
-	// Check if the "Runs" array exists
-	if runs, ok := data["Runs"].([]interface{}); ok {
-		for _, run := range runs {
-			if runMap, ok := run.(map[string]interface{}); ok {
-				// Check and append to the "VersionControlProvenance" field
-				if vcp, ok := runMap["VersionControlProvenance"].([]interface{}); ok {
-					// Array exists, add an entry
-					runMap["VersionControlProvenance"] = append(vcp,
-						map[string]interface{}{
-							"repositoryUri": fmt.Sprintf("%s/%s",
-								os.Getenv("GITHUB_SERVER_URL"), language),
-							"revisionId": databaseSHA,
-						})
-				} else {
-					// No array, provide one and the entry
-					runMap["VersionControlProvenance"] = []map[string]interface{}{
-						{
-							"repositoryUri": fmt.Sprintf("%s/%s",
-								os.Getenv("GITHUB_SERVER_URL"), language),
-							"revisionId": databaseSHA,
-						},
-					}
-				}
-			}
-		}
-	}
-
-	// Encode the modified structure back to JSON
-	modifiedJSON, err := json.MarshalIndent(data, "", "  ")
+	modifiedSarif, err := postProcessSarif(sarifData, sc)
 	if err != nil {
-		slog.Error("Unable to re-encode SARIF to JSON", "err", err)
+		slog.Error("Unable to post-process SARIF", "err", err)
 		return nil, err
 	}
 
-	return modifiedJSON, nil
+	return modifiedSarif, nil
 }
 
 // getSarifResultCount returns the number of results in the SARIF file.
@@ -543,6 +808,77 @@ func getSarifResultCount(sarif []byte) int {
 	return count
 }
 
+// queryID identifies a query in result counts: its @id, or its path if it
+// has none.
+func queryID(query Query) string {
+	if query.QueryMetadata.ID != nil && *query.QueryMetadata.ID != "" {
+		return *query.QueryMetadata.ID
+	}
+	return query.RelativeBqrsFilePath
+}
+
+// getBqrsQueryResultCounts returns the BQRS row count of every query.
+func getBqrsQueryResultCounts(queryPackRunResults *QueryPackRunResults) []common.QueryResultCount {
+	var counts []common.QueryResultCount
+	for _, query := range queryPackRunResults.Queries {
+		// Errors were already reported while computing the total
+		count, _ := getBqrsResultCount(query.BqrsInfo)
+		counts = append(counts, common.QueryResultCount{
+			QueryID:     queryID(query),
+			ResultCount: count,
+		})
+	}
+	return counts
+}
+
+// getSarifQueryResultCounts counts SARIF results by rule and level.  Queries
+// of the pack without results are included with a count of zero.
+func getSarifQueryResultCounts(sarif []byte, queryPackRunResults *QueryPackRunResults) []common.QueryResultCount {
+	var sarifData SarifResults
+	if err := json.Unmarshal(sarif, &sarifData); err != nil {
+		slog.Warn("failed to unmarshal SARIF for per-query counts", "err", err)
+		return nil
+	}
+
+	byRule := map[string]*common.QueryResultCount{}
+	var rules []string
+	entry := func(ruleID string) *common.QueryResultCount {
+		if c, ok := byRule[ruleID]; ok {
+			return c
+		}
+		c := &common.QueryResultCount{QueryID: ruleID, Levels: map[string]int{}}
+		byRule[ruleID] = c
+		rules = append(rules, ruleID)
+		return c
+	}
+
+	for _, query := range queryPackRunResults.Queries {
+		entry(queryID(query))
+	}
+	for _, run := range sarifData.Runs {
+		for _, result := range run.Results {
+			ruleID := result.RuleID
+			if ruleID == "" && result.Rule != nil {
+				ruleID = result.Rule.ID
+			}
+			level := result.Level
+			if level == "" {
+				// The SARIF default level
+				level = "warning"
+			}
+			c := entry(ruleID)
+			c.ResultCount++
+			c.Levels[level]++
+		}
+	}
+
+	counts := make([]common.QueryResultCount, 0, len(rules))
+	for _, ruleID := range rules {
+		counts = append(counts, *byRule[ruleID])
+	}
+	return counts
+}
+
 // Known result set names
 var KnownResultSetNames = []string{"#select", "problems"}
 
@@ -0,0 +1,180 @@
+package codeql
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+)
+
+// Exit codes of the CodeQL CLI with a known meaning.
+const (
+	exitCodeCanceled    = 98
+	exitCodeOutOfMemory = 99
+)
+
+// maxDiagnosticMessage bounds the message kept from CLI output.
+const maxDiagnosticMessage = 500
+
+// The database and timeout patterns only apply to error lines, since other
+// output names files and predicates such as TimeoutConfig.qll.
+var (
+	// e.g. "ERROR: could not resolve type Foo (/tmp/pack/Foo.ql:12,5-8)"
+	compilationErrorPattern = regexp.MustCompile(`ERROR: (.+) \((\S+?\.qll?):(\d+),(\d+)-\d+\)`)
+	outOfMemoryPattern      = regexp.MustCompile(`(?i)OutOfMemoryError|out of memory|Java heap space`)
+	dbschemePattern         = regexp.MustCompile(`(?i)dbscheme|cannot be upgraded|not compatible with this (version|CLI)`)
+	corruptPattern          = regexp.MustCompile(`(?i)corrupt|ZipException|not a (valid|recognized) .*database|could not read dataset`)
+	timeoutPattern          = regexp.MustCompile(`(?i)timed out|timeout`)
+	errorLinePattern        = regexp.MustCompile(`(?i)^(ERROR:|A fatal error occurred:)`)
+)
+
+// AnalysisError is a failed CodeQL step, with its cause classified from the
+// CLI's output and exit code.
+type AnalysisError struct {
+	Step       string
+	Diagnostic common.Diagnostic
+	Output     string
+}
+
+func (e *AnalysisError) Error() string {
+	if e.Output == "" {
+		return fmt.Sprintf("failed to %s: %s", e.Step, e.Diagnostic.Summary())
+	}
+	return fmt.Sprintf("failed to %s: %s\nOutput: %s", e.Step, e.Diagnostic.Summary(), e.Output)
+}
+
+// relativeTo makes a compilation error's file relative to the query pack.
+func (e *AnalysisError) relativeTo(packDir string) {
+	if e.Diagnostic.File == "" || !filepath.IsAbs(e.Diagnostic.File) {
+		return
+	}
+	if rel, err := filepath.Rel(packDir, e.Diagnostic.File); err == nil && !strings.HasPrefix(rel, "..") {
+		e.Diagnostic.File = rel
+	}
+}
+
+// DiagnosticFor describes err for the job result.  Errors of other causes
+// than a CodeQL step, such as a failed download, are of unknown kind.
+func DiagnosticFor(err error) common.Diagnostic {
+	var ae *AnalysisError
+	if errors.As(err, &ae) {
+		return ae.Diagnostic
+	}
+	return common.Diagnostic{Kind: common.DiagnosticUnknown, Message: err.Error()}
+}
+
+// runCLI runs a CodeQL command, returning an *AnalysisError if it fails.
+func runCLI(step string, cmd *exec.Cmd) error {
+	output, err := cmd.CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return fmt.Errorf("failed to %s: %w", step, err)
+	}
+	return &AnalysisError{
+		Step:       step,
+		Diagnostic: classifyOutput(exitErr.ExitCode(), string(output)),
+		Output:     string(output),
+	}
+}
+
+// classifyOutput determines the cause of a failure from the CLI's combined
+// output and exit code.
+func classifyOutput(exitCode int, output string) common.Diagnostic {
+	d := common.Diagnostic{Kind: common.DiagnosticUnknown, ExitCode: exitCode}
+
+	if m := compilationErrorPattern.FindStringSubmatch(output); m != nil {
+		d.Kind = common.DiagnosticCompilationError
+		d.Message = m[1]
+		d.File = m[2]
+		d.Line, _ = strconv.Atoi(m[3])
+		d.Column, _ = strconv.Atoi(m[4])
+		return d
+	}
+
+	d.Message = errorMessage(output)
+	errorOutput := errorLines(output)
+	switch {
+	case exitCode == exitCodeOutOfMemory || outOfMemoryPattern.MatchString(output):
+		d.Kind = common.DiagnosticOutOfMemory
+	case corruptPattern.MatchString(errorOutput):
+		d.Kind = common.DiagnosticDatabaseCorrupt
+	case exitCode == exitCodeCanceled || timeoutPattern.MatchString(errorOutput):
+		d.Kind = common.DiagnosticTimeout
+	case dbschemePattern.MatchString(errorOutput):
+		d.Kind = common.DiagnosticUnsupportedDBScheme
+	}
+	return d
+}
+
+// errorLines returns the error lines of output, one per line.
+func errorLines(output string) string {
+	var lines []string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if errorLinePattern.MatchString(line) {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// errorMessage picks the line of output that best describes the failure:
+// the first error line, or else the last line.
+func errorMessage(output string) string {
+	var last string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if errorLinePattern.MatchString(line) {
+			return truncateMessage(line)
+		}
+		last = line
+	}
+	return truncateMessage(last)
+}
+
+func truncateMessage(message string) string {
+	if len(message) > maxDiagnosticMessage {
+		return message[:maxDiagnosticMessage] + "..."
+	}
+	return message
+}
+
+// queryServerError classifies a failed evaluation/runQuery by its result
+// type, taking the location of compilation errors from the message.
+func queryServerError(query string, result runQueryResult) *AnalysisError {
+	message := ""
+	if result.Message != nil {
+		message = *result.Message
+	}
+	d := classifyOutput(0, message)
+	d.ExitCode = 0
+	switch result.ResultType {
+	case queryResultCompilationError:
+		d.Kind = common.DiagnosticCompilationError
+		if d.File == "" {
+			d.File = query
+		}
+	case queryResultOOM:
+		d.Kind = common.DiagnosticOutOfMemory
+	case queryResultCancellation:
+		d.Kind = common.DiagnosticTimeout
+	case queryResultDBSchemeMismatch, queryResultDBSchemeNoUpgrade:
+		d.Kind = common.DiagnosticUnsupportedDBScheme
+	}
+	return &AnalysisError{
+		Step:       "run query " + query,
+		Diagnostic: d,
+		Output:     message,
+	}
+}
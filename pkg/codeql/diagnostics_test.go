@@ -0,0 +1,93 @@
+package codeql
+
+import (
+	"testing"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+)
+
+func TestClassifyOutput(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		exitCode int
+		output   string
+		want     common.DiagnosticKind
+	}{
+		{
+			name:     "compilation error",
+			exitCode: 2,
+			output:   "Compiling query plan for /tmp/pack/Foo.ql.\nERROR: could not resolve type Bar (/tmp/pack/Foo.ql:12,5-8)\n",
+			want:     common.DiagnosticCompilationError,
+		},
+		{
+			name:     "out of memory exit code",
+			exitCode: exitCodeOutOfMemory,
+			output:   "Evaluating queries.\n",
+			want:     common.DiagnosticOutOfMemory,
+		},
+		{
+			name:     "unsupported dbscheme",
+			exitCode: 2,
+			output:   "A fatal error occurred: The database dbscheme is not compatible with this CLI.\n",
+			want:     common.DiagnosticUnsupportedDBScheme,
+		},
+		{
+			name:     "corrupt database",
+			exitCode: 2,
+			output:   "ERROR: could not read dataset /db/db-javascript (java.util.zip.ZipException)\n",
+			want:     common.DiagnosticDatabaseCorrupt,
+		},
+		{
+			name:     "corrupt database naming its dbscheme",
+			exitCode: 2,
+			output:   "A fatal error occurred: /db/semmlecode.javascript.dbscheme is corrupt\n",
+			want:     common.DiagnosticDatabaseCorrupt,
+		},
+		{
+			name:     "timeout",
+			exitCode: 2,
+			output:   "ERROR: Query evaluation timed out after 600s\n",
+			want:     common.DiagnosticTimeout,
+		},
+		{
+			name:     "canceled exit code",
+			exitCode: exitCodeCanceled,
+			output:   "Evaluating queries.\n",
+			want:     common.DiagnosticTimeout,
+		},
+		{
+			name:     "timeout library in progress output",
+			exitCode: 2,
+			output:   "Compiling /tmp/pack/lib/TimeoutConfig.qll.\nA fatal error occurred: the evaluator crashed\n",
+			want:     common.DiagnosticUnknown,
+		},
+		{
+			name:     "dbscheme in progress output",
+			exitCode: 2,
+			output:   "Loaded /db/semmlecode.javascript.dbscheme.\nERROR: the evaluator crashed\n",
+			want:     common.DiagnosticUnknown,
+		},
+		{
+			name:     "corrupt in a predicate name",
+			exitCode: 2,
+			output:   "Evaluated isCorruptInput in 12ms.\nERROR: the evaluator crashed\n",
+			want:     common.DiagnosticUnknown,
+		},
+		{
+			name:     "no error line",
+			exitCode: 1,
+			output:   "Running queries with a timeout of 600s.\n",
+			want:     common.DiagnosticUnknown,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := classifyOutput(tc.exitCode, tc.output)
+			if d.Kind != tc.want {
+				t.Errorf("classifyOutput(%d, %q).Kind = %s, want %s", tc.exitCode, tc.output, d.Kind, tc.want)
+			}
+			if d.ExitCode != tc.exitCode {
+				t.Errorf("classifyOutput(%d, %q).ExitCode = %d", tc.exitCode, tc.output, d.ExitCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package codeql
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+)
+
+// maxSlowPredicates bounds the predicate timings kept per analysis.
+const maxSlowPredicates = 20
+
+// predicateSummary is one event of `generate log-summary --format=predicates`.
+type predicateSummary struct {
+	PredicateName    string `json:"predicateName"`
+	Millis           int64  `json:"millis"`
+	ResultSize       int64  `json:"resultSize"`
+	QueryCausingWork string `json:"queryCausingWork"`
+}
+
+// summarizeEvaluatorLog writes the human-readable summary of the evaluator
+// log to tempDir and returns its path with the slowest predicates.
+func summarizeEvaluatorLog(codeql CodeqlCli, logPath string, tempDir string) (string, []common.PredicateTiming, error) {
+	summaryPath := filepath.Join(tempDir, "evaluator-log-summary.txt")
+	cmd := exec.Command(codeql.Path, "generate", "log-summary", "--format=text", "--", logPath, summaryPath)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return "", nil, fmt.Errorf("failed to summarize evaluator log: %v\nOutput: %s", err, output)
+	}
+
+	predicatesPath := filepath.Join(tempDir, "evaluator-log-predicates.jsonl")
+	cmd = exec.Command(codeql.Path, "generate", "log-summary", "--format=predicates", "--minify-output",
+		"--", logPath, predicatesPath)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return "", nil, fmt.Errorf("failed to summarize evaluator log predicates: %v\nOutput: %s", err, output)
+	}
+
+	f, err := os.Open(predicatesPath)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+
+	slow, err := slowestPredicates(f, maxSlowPredicates)
+	if err != nil {
+		return "", nil, err
+	}
+	return summaryPath, slow, nil
+}
+
+// slowestPredicates reads a stream of predicate summaries and returns the n
+// predicates with the longest total evaluation time.  A predicate evaluated
+// several times, e.g. in recursive strata, is counted once with the sum.
+func slowestPredicates(r io.Reader, n int) ([]common.PredicateTiming, error) {
+	byName := map[string]*common.PredicateTiming{}
+	dec := json.NewDecoder(r)
+	for {
+		var event predicateSummary
+		err := dec.Decode(&event)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode predicate summary: %v", err)
+		}
+		if event.PredicateName == "" {
+			continue
+		}
+
+		timing, ok := byName[event.PredicateName]
+		if !ok {
+			timing = &common.PredicateTiming{
+				PredicateName: event.PredicateName,
+				Query:         event.QueryCausingWork,
+			}
+			byName[event.PredicateName] = timing
+		}
+		timing.Millis += event.Millis
+		if event.ResultSize > timing.ResultSize {
+			timing.ResultSize = event.ResultSize
+		}
+	}
+
+	timings := make([]common.PredicateTiming, 0, len(byName))
+	for _, timing := range byName {
+		timings = append(timings, *timing)
+	}
+	sort.Slice(timings, func(i, j int) bool {
+		if timings[i].Millis != timings[j].Millis {
+			return timings[i].Millis > timings[j].Millis
+		}
+		return timings[i].PredicateName < timings[j].PredicateName
+	})
+	if len(timings) > n {
+		timings = timings[:n]
+	}
+	return timings, nil
+}
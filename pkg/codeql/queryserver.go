@@ -0,0 +1,499 @@
+package codeql
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hohn/mrvacommander/pkg/queue"
+)
+
+// QueryServer is a long-running `codeql execute query-server2` process.  It
+// keeps the JVM and its compilation cache warm, so a session's queries are
+// compiled once and then evaluated against many databases.
+//
+// The server speaks JSON-RPC 2.0 over stdin/stdout with LSP-style
+// Content-Length framing.
+type QueryServer struct {
+	stdin  io.WriteCloser
+	writeM sync.Mutex
+
+	// kill stops the process and wait awaits its exit.
+	kill func()
+	wait func() error
+
+	mutex   sync.Mutex
+	nextID  int
+	pending map[int]chan rpcResponse
+	err     error // set once the server has exited
+	done    chan struct{}
+
+	version string // CLI version, set by QueryServerRunner
+}
+
+type rpcRequest struct {
+	JSONRPC string      `json:"jsonrpc"`
+	ID      int         `json:"id"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+// rpcParams wraps the parameters of every query server request, which
+// reports the request's progress under progressId.
+type rpcParams struct {
+	Body       interface{} `json:"body"`
+	ProgressID int         `json:"progressId"`
+}
+
+type rpcResponse struct {
+	ID     *int            `json:"id"`
+	Method string          `json:"method"`
+	Result json.RawMessage `json:"result"`
+	Error  *rpcError       `json:"error"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("query server error %d: %s", e.Code, e.Message)
+}
+
+// Query server result types of evaluation/runQuery
+const (
+	queryResultSuccess           = 0
+	queryResultOtherError        = 1
+	queryResultCompilationError  = 2
+	queryResultOOM               = 3
+	queryResultCancellation      = 4
+	queryResultDBSchemeMismatch  = 5
+	queryResultDBSchemeNoUpgrade = 6
+)
+
+type registerDatabasesParams struct {
+	Databases []string `json:"databases"`
+}
+
+type runQueryParams struct {
+	DB                      string            `json:"db"`
+	QueryPath               string            `json:"queryPath"`
+	OutputPath              string            `json:"outputPath"`
+	AdditionalPacks         []string          `json:"additionalPacks"`
+	ExtensionPacks          []string          `json:"extensionPacks,omitempty"`
+	ExternalInputs          map[string]string `json:"externalInputs"`
+	SingletonExternalInputs map[string]string `json:"singletonExternalInputs"`
+	Target                  runQueryTarget    `json:"target"`
+}
+
+type runQueryTarget struct {
+	Query struct{} `json:"query"`
+}
+
+type runQueryResult struct {
+	ResultType     int     `json:"resultType"`
+	Message        *string `json:"message"`
+	EvaluationTime float64 `json:"evaluationTime"`
+}
+
+// StartQueryServer starts a query server using the CLI at codeql.Path.
+func StartQueryServer(codeql CodeqlCli, res Resources) (*QueryServer, error) {
+	args := append([]string{"execute", "query-server2"}, res.args()...)
+	cmd := exec.Command(codeql.Path, args...)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start query server: %v", err)
+	}
+	slog.Info("Started CodeQL query server", "pid", cmd.Process.Pid)
+
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			slog.Debug("Query server", "pid", cmd.Process.Pid, "log", scanner.Text())
+		}
+	}()
+	kill := func() { cmd.Process.Kill() }
+	return newQueryServer(stdin, stdout, kill, cmd.Wait), nil
+}
+
+// newQueryServer speaks to a query server over stdin and stdout.
+func newQueryServer(stdin io.WriteCloser, stdout io.Reader, kill func(), wait func() error) *QueryServer {
+	qs := &QueryServer{
+		stdin:   stdin,
+		kill:    kill,
+		wait:    wait,
+		pending: map[int]chan rpcResponse{},
+		done:    make(chan struct{}),
+	}
+	go qs.readResponses(bufio.NewReader(stdout))
+	return qs
+}
+
+// readResponses dispatches responses to waiting calls until the server exits.
+func (qs *QueryServer) readResponses(r *bufio.Reader) {
+	var err error
+	for {
+		var body []byte
+		body, err = readMessage(r)
+		if err != nil {
+			break
+		}
+
+		var resp rpcResponse
+		if err = json.Unmarshal(body, &resp); err != nil {
+			break
+		}
+		if resp.ID == nil || resp.Method != "" {
+			// Notifications, e.g. ql/progressUpdated
+			slog.Debug("Query server notification", "method", resp.Method)
+			continue
+		}
+
+		qs.mutex.Lock()
+		ch, ok := qs.pending[*resp.ID]
+		delete(qs.pending, *resp.ID)
+		qs.mutex.Unlock()
+		if ok {
+			ch <- resp
+		}
+	}
+
+	if !errors.Is(err, io.EOF) {
+		// The protocol is broken; don't wait for the server to notice
+		qs.kill()
+	}
+	waitErr := qs.wait()
+	if errors.Is(err, io.EOF) && waitErr != nil {
+		err = waitErr
+	}
+
+	qs.mutex.Lock()
+	qs.err = fmt.Errorf("query server exited: %v", err)
+	for id, ch := range qs.pending {
+		close(ch)
+		delete(qs.pending, id)
+	}
+	qs.mutex.Unlock()
+	close(qs.done)
+}
+
+// readMessage reads one Content-Length framed message.
+func readMessage(r *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+			length, err = strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return nil, fmt.Errorf("invalid Content-Length %q", value)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, errors.New("message without Content-Length")
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// call sends a request and waits for its response, decoded into result.
+// Its progress is reported under the request's ID.
+func (qs *QueryServer) call(method string, params interface{}, result interface{}) error {
+	ch := make(chan rpcResponse, 1)
+
+	qs.mutex.Lock()
+	if qs.err != nil {
+		qs.mutex.Unlock()
+		return qs.err
+	}
+	qs.nextID++
+	id := qs.nextID
+	qs.pending[id] = ch
+	qs.mutex.Unlock()
+
+	body, err := json.Marshal(rpcRequest{
+		JSONRPC: "2.0",
+		ID:      id,
+		Method:  method,
+		Params:  rpcParams{Body: params, ProgressID: id},
+	})
+	if err != nil {
+		return err
+	}
+
+	qs.writeM.Lock()
+	_, err = fmt.Fprintf(qs.stdin, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	qs.writeM.Unlock()
+	if err != nil {
+		qs.mutex.Lock()
+		delete(qs.pending, id)
+		qs.mutex.Unlock()
+		return fmt.Errorf("failed to send %s to query server: %v", method, err)
+	}
+
+	resp, ok := <-ch
+	if !ok {
+		qs.mutex.Lock()
+		defer qs.mutex.Unlock()
+		return qs.err
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if result != nil {
+		return json.Unmarshal(resp.Result, result)
+	}
+	return nil
+}
+
+// Alive reports whether the server process is still running.
+func (qs *QueryServer) Alive() bool {
+	select {
+	case <-qs.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// Close stops the server process.
+func (qs *QueryServer) Close() {
+	qs.stdin.Close()
+	qs.kill()
+	<-qs.done
+}
+
+// evaluate runs each query of the pack in turn, writing BQRS files where
+// database run-queries would.  Threat models and evaluator logs are not
+// supported; QueryServerRunner evaluates such analyses with the CLI.
+func (qs *QueryServer) evaluate(dbDir string, packs AnalysisPacks, opts evaluationOptions, pack *ResolvedPack) error {
+	if len(opts.threatModels) > 0 || opts.evaluatorLog != "" {
+		return errors.New("query server cannot select threat models or write evaluator logs")
+	}
+	additionalPacks := []string{packs.QueryPack}
+	var extensionPacks []string
+	for _, mp := range packs.ModelPacks {
+		additionalPacks = append(additionalPacks, mp.Path)
+		extensionPacks = append(extensionPacks, mp.Name)
+	}
+
+	dbs := registerDatabasesParams{Databases: []string{dbDir}}
+	if err := qs.call("evaluation/registerDatabases", dbs, nil); err != nil {
+		return fmt.Errorf("failed to register database: %v", err)
+	}
+	defer func() {
+		if err := qs.call("evaluation/deregisterDatabases", dbs, nil); err != nil {
+			slog.Warn("Failed to deregister database", "db", dbDir, "error", err)
+		}
+	}()
+
+	for _, query := range pack.Queries {
+		outputPath := filepath.Join(dbDir, "results", query.RelativeBqrsFilePath)
+		if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+			return err
+		}
+
+		var result runQueryResult
+		err := qs.call("evaluation/runQuery", runQueryParams{
+			DB:                      dbDir,
+			QueryPath:               filepath.Join(packs.QueryPack, query.RelativeQueryPath),
+			OutputPath:              outputPath,
+			AdditionalPacks:         additionalPacks,
+			ExtensionPacks:          extensionPacks,
+			ExternalInputs:          map[string]string{},
+			SingletonExternalInputs: map[string]string{},
+		}, &result)
+		if err != nil {
+			return fmt.Errorf("failed to run query %s: %v", query.RelativeQueryPath, err)
+		}
+		if result.ResultType != queryResultSuccess {
+			return queryServerError(query.RelativeQueryPath, result)
+		}
+		slog.Debug("Evaluated query", "query", query.RelativeQueryPath,
+			"evaluation_ms", result.EvaluationTime)
+	}
+	return nil
+}
+
+// QueryServerRunner runs analyses on a pool of query servers, one per
+// concurrent analysis.  Servers are started on first use for the CLI version
+// a job needs, and replaced if they exit or another version needs the slot.
+type QueryServerRunner struct {
+	clis      *CLISet
+	resources Resources
+	size      int
+
+	mutex   sync.Mutex
+	freed   *sync.Cond // signalled when a server is released
+	idle    map[string][]*QueryServer
+	running int
+}
+
+// NewQueryServerRunner returns a runner with up to size query servers using
+// the CLIs named in the environment; see CLISet.  Each server, and each
+// analysis run with the CLI instead, is bounded by res.
+func NewQueryServerRunner(size int, res Resources) (*QueryServerRunner, error) {
+	clis, err := LoadCLISet()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find codeql cli: %v", err)
+	}
+	if size <= 0 {
+		size = 1
+	}
+	r := &QueryServerRunner{
+		clis:      clis,
+		resources: res,
+		size:      size,
+		idle:      map[string][]*QueryServer{},
+	}
+	r.freed = sync.NewCond(&r.mutex)
+	return r, nil
+}
+
+// acquire returns an idle server of the CLI version, starting one if the
+// pool has room or an idle server of another version can be stopped.
+func (r *QueryServerRunner) acquire(version string, codeql CodeqlCli) (*QueryServer, error) {
+	r.mutex.Lock()
+	var stale *QueryServer
+	for {
+		if qs := r.popIdleLocked(version); qs != nil {
+			if qs.Alive() {
+				r.mutex.Unlock()
+				return qs, nil
+			}
+			r.running--
+			continue
+		}
+		if r.running < r.size {
+			r.running++
+			break
+		}
+		if stale = r.popIdleLocked(""); stale != nil {
+			// Reuse the slot of a server for another version
+			break
+		}
+		r.freed.Wait()
+	}
+	r.mutex.Unlock()
+
+	if stale != nil {
+		stale.Close()
+	}
+	qs, err := StartQueryServer(codeql, r.resources)
+	if err != nil {
+		r.mutex.Lock()
+		r.running--
+		r.freed.Signal()
+		r.mutex.Unlock()
+		return nil, err
+	}
+	qs.version = version
+	return qs, nil
+}
+
+// popIdleLocked takes an idle server of the version, or of any version if
+// version is empty.
+func (r *QueryServerRunner) popIdleLocked(version string) *QueryServer {
+	for v, servers := range r.idle {
+		if version != "" && v != version || len(servers) == 0 {
+			continue
+		}
+		qs := servers[len(servers)-1]
+		r.idle[v] = servers[:len(servers)-1]
+		return qs
+	}
+	return nil
+}
+
+func (r *QueryServerRunner) release(qs *QueryServer) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if qs.Alive() {
+		r.idle[qs.version] = append(r.idle[qs.version], qs)
+	} else {
+		r.running--
+	}
+	r.freed.Signal()
+}
+
+func (r *QueryServerRunner) SelectCLI(job queue.AnalyzeJob, database string) (string, error) {
+	version, _, err := r.clis.selectCLIForDatabase(job.CLIVersion, database)
+	return version, err
+}
+
+func (r *QueryServerRunner) PrecompileQueryPack(cliVersion string, queryPackPath string) error {
+	_, codeql, err := r.clis.Select(cliVersion, "")
+	if err != nil {
+		return err
+	}
+	return precompileQueryPack(codeql, r.resources, queryPackPath)
+}
+
+func (r *QueryServerRunner) RunQuery(database string, job queue.AnalyzeJob,
+	packs AnalysisPacks, tempDir string) (*RunQueryResult, error) {
+	version, codeql, err := r.clis.selectCLIForDatabase(job.CLIVersion, database)
+	if err != nil {
+		return nil, err
+	}
+	if len(job.ThreatModels) > 0 || job.EvaluatorLog {
+		return runQuery(codeql, cliEvaluator{codeql, r.resources}, database, job, packs, tempDir)
+	}
+
+	qs, err := r.acquire(version, codeql)
+	if err != nil {
+		return nil, err
+	}
+	defer r.release(qs)
+
+	return runQuery(codeql, qs, database, job, packs, tempDir)
+}
+
+// Close stops the idle servers.  Analyses must have finished.
+func (r *QueryServerRunner) Close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for version, servers := range r.idle {
+		for _, qs := range servers {
+			qs.Close()
+			r.running--
+		}
+		delete(r.idle, version)
+	}
+}
@@ -0,0 +1,227 @@
+package codeql
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestReadMessage(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		input   string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:  "one message",
+			input: "Content-Length: 7\r\n\r\n{\"a\":1}",
+			want:  []string{`{"a":1}`},
+		},
+		{
+			name:  "other headers and case",
+			input: "content-length:  2\r\nContent-Type: application/vscode-jsonrpc\r\n\r\n{}",
+			want:  []string{`{}`},
+		},
+		{
+			name:  "messages back to back",
+			input: "Content-Length: 2\r\n\r\n{}Content-Length: 4\r\n\r\nnull",
+			want:  []string{`{}`, `null`},
+		},
+		{
+			name:  "body containing newlines",
+			input: "Content-Length: 5\r\n\r\n{\r\n}\n",
+			want:  []string{"{\r\n}\n"},
+		},
+		{
+			name:    "missing length",
+			input:   "Content-Type: application/json\r\n\r\n{}",
+			wantErr: true,
+		},
+		{
+			name:    "invalid length",
+			input:   "Content-Length: many\r\n\r\n{}",
+			wantErr: true,
+		},
+		{
+			name:    "truncated body",
+			input:   "Content-Length: 10\r\n\r\n{}",
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tc.input))
+			for _, want := range tc.want {
+				body, err := readMessage(r)
+				if err != nil {
+					t.Fatalf("readMessage() error = %v", err)
+				}
+				if string(body) != want {
+					t.Errorf("readMessage() = %q, want %q", body, want)
+				}
+			}
+			_, err := readMessage(r)
+			if tc.wantErr && (err == nil || errors.Is(err, io.EOF)) {
+				t.Errorf("readMessage() error = %v, want a framing error", err)
+			}
+			if !tc.wantErr && !errors.Is(err, io.EOF) {
+				t.Errorf("readMessage() after last message error = %v, want EOF", err)
+			}
+		})
+	}
+}
+
+// fakeQueryServer answers requests over in-memory pipes, the first batch of
+// them in reverse order and after a progress notification.
+type fakeQueryServer struct {
+	requests  *bufio.Reader
+	responses io.WriteCloser
+	closeOnce sync.Once
+}
+
+type fakeRequest struct {
+	JSONRPC string `json:"jsonrpc"`
+	ID      int    `json:"id"`
+	Method  string `json:"method"`
+	Params  struct {
+		Body       registerDatabasesParams `json:"body"`
+		ProgressID *int                    `json:"progressId"`
+	} `json:"params"`
+}
+
+func startFakeQueryServer(t *testing.T) (*QueryServer, *fakeQueryServer) {
+	t.Helper()
+	reqR, reqW := io.Pipe()
+	respR, respW := io.Pipe()
+	fake := &fakeQueryServer{requests: bufio.NewReader(reqR), responses: respW}
+	kill := func() {
+		reqR.Close()
+		fake.close()
+	}
+	qs := newQueryServer(reqW, respR, kill, func() error { return nil })
+	t.Cleanup(qs.Close)
+	return qs, fake
+}
+
+func (f *fakeQueryServer) close() {
+	f.closeOnce.Do(func() { f.responses.Close() })
+}
+
+func (f *fakeQueryServer) read(t *testing.T) fakeRequest {
+	body, err := readMessage(f.requests)
+	if err != nil {
+		t.Errorf("reading request: %v", err)
+		return fakeRequest{}
+	}
+	var req fakeRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Errorf("decoding request %s: %v", body, err)
+	}
+	return req
+}
+
+func (f *fakeQueryServer) write(t *testing.T, message interface{}) {
+	body, err := json.Marshal(message)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := fmt.Fprintf(f.responses, "Content-Length: %d\r\n\r\n%s", len(body), body); err != nil {
+		t.Errorf("writing response: %v", err)
+	}
+}
+
+func TestQueryServerCall(t *testing.T) {
+	qs, fake := startFakeQueryServer(t)
+
+	// Each call gets the response to its own request
+	databases := []string{"/db/a", "/db/b", "/db/c"}
+	results := make([]registerDatabasesParams, len(databases))
+	errs := make([]error, len(databases))
+	var wg sync.WaitGroup
+	for i, db := range databases {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			params := registerDatabasesParams{Databases: []string{db}}
+			errs[i] = qs.call("evaluation/registerDatabases", params, &results[i])
+		}()
+	}
+
+	var requests []fakeRequest
+	for range databases {
+		req := fake.read(t)
+		if req.JSONRPC != "2.0" || req.Method != "evaluation/registerDatabases" {
+			t.Errorf("request = %+v", req)
+		}
+		if req.Params.ProgressID == nil || *req.Params.ProgressID != req.ID {
+			t.Errorf("request %d progressId = %v, want the request ID", req.ID, req.Params.ProgressID)
+		}
+		requests = append(requests, req)
+	}
+	fake.write(t, map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  "ql/progressUpdated",
+		"params":  map[string]interface{}{"step": 1, "maxStep": 2},
+	})
+	for i := len(requests) - 1; i >= 0; i-- {
+		// Echo the parameters, to tell which request a response answers
+		fake.write(t, map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      requests[i].ID,
+			"result":  requests[i].Params.Body,
+		})
+	}
+	wg.Wait()
+
+	for i, db := range databases {
+		if errs[i] != nil {
+			t.Errorf("call for %s error = %v", db, errs[i])
+		} else if len(results[i].Databases) != 1 || results[i].Databases[0] != db {
+			t.Errorf("call for %s result = %+v", db, results[i])
+		}
+	}
+
+	// Errors are returned to their call
+	go func() {
+		req := fake.read(t)
+		fake.write(t, map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      req.ID,
+			"error":   map[string]interface{}{"code": -32601, "message": "unknown method"},
+		})
+	}()
+	var rpcErr *rpcError
+	err := qs.call("evaluation/unknown", struct{}{}, nil)
+	if !errors.As(err, &rpcErr) || rpcErr.Code != -32601 {
+		t.Errorf("call error = %v, want the server's error", err)
+	}
+}
+
+func TestQueryServerExit(t *testing.T) {
+	qs, fake := startFakeQueryServer(t)
+
+	// A pending call fails once the server exits
+	done := make(chan error)
+	go func() {
+		done <- qs.call("evaluation/registerDatabases", registerDatabasesParams{}, nil)
+	}()
+	fake.read(t)
+	fake.close()
+	if err := <-done; err == nil {
+		t.Error("pending call succeeded after the server exited")
+	}
+
+	<-qs.done
+	if qs.Alive() {
+		t.Error("Alive() = true after the server exited")
+	}
+	if err := qs.call("evaluation/registerDatabases", registerDatabasesParams{}, nil); err == nil {
+		t.Error("call succeeded after the server exited")
+	}
+}
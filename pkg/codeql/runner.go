@@ -0,0 +1,166 @@
+package codeql
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/hohn/mrvacommander/pkg/queue"
+)
+
+// CLIRunner runs analyses with the CodeQL CLIs named in the environment; see
+// CLISet.
+type CLIRunner struct {
+	Resources Resources
+}
+
+func (r CLIRunner) RunQuery(database string, job queue.AnalyzeJob,
+	packs AnalysisPacks, tempDir string) (*RunQueryResult, error) {
+	clis, err := LoadCLISet()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find codeql cli: %v", err)
+	}
+	_, codeql, err := clis.selectCLIForDatabase(job.CLIVersion, database)
+	if err != nil {
+		return nil, err
+	}
+
+	return runQuery(codeql, cliEvaluator{codeql, r.Resources}, database, job, packs, tempDir)
+}
+
+func (CLIRunner) SelectCLI(job queue.AnalyzeJob, database string) (string, error) {
+	clis, err := LoadCLISet()
+	if err != nil {
+		return "", fmt.Errorf("failed to find codeql cli: %v", err)
+	}
+	version, _, err := clis.selectCLIForDatabase(job.CLIVersion, database)
+	return version, err
+}
+
+func (r CLIRunner) PrecompileQueryPack(cliVersion string, queryPackPath string) error {
+	clis, err := LoadCLISet()
+	if err != nil {
+		return fmt.Errorf("failed to find codeql cli: %v", err)
+	}
+	_, codeql, err := clis.Select(cliVersion, "")
+	if err != nil {
+		return err
+	}
+	return precompileQueryPack(codeql, r.Resources, queryPackPath)
+}
+
+// FakeRunner is a deterministic stand-in for the CodeQL CLI.  Every analysis
+// yields ResultCount results of the query FakeQueryID, as SARIF and as a
+// placeholder BQRS file.  Jobs asking for an evaluator log also get a summary
+// listing FakePredicateName.
+type FakeRunner struct {
+	ResultCount int
+}
+
+const (
+	FakeQueryID         = "fake/query"
+	FakeCLIVersion      = "0.0.0-fake"
+	FakePredicateName   = "fake#slow"
+	FakePredicateMillis = 1000
+)
+
+// SelectCLI accepts only FakeCLIVersion.
+func (FakeRunner) SelectCLI(job queue.AnalyzeJob, database string) (string, error) {
+	if job.CLIVersion != "" && job.CLIVersion != FakeCLIVersion {
+		return "", fmt.Errorf("CodeQL CLI %s is not available; have %s", job.CLIVersion, FakeCLIVersion)
+	}
+	return FakeCLIVersion, nil
+}
+
+// PrecompileQueryPack only checks that the pack was extracted.
+func (FakeRunner) PrecompileQueryPack(cliVersion string, queryPackPath string) error {
+	_, err := os.Stat(queryPackPath)
+	return err
+}
+
+func (f FakeRunner) RunQuery(database string, job queue.AnalyzeJob,
+	packs AnalysisPacks, tempDir string) (*RunQueryResult, error) {
+	if _, err := os.Stat(database); err != nil {
+		return nil, fmt.Errorf("failed to find database: %v", err)
+	}
+	if _, err := os.Stat(packs.QueryPack); err != nil {
+		return nil, fmt.Errorf("failed to find query pack: %v", err)
+	}
+	for _, mp := range packs.ModelPacks {
+		if _, err := os.Stat(mp.Path); err != nil {
+			return nil, fmt.Errorf("failed to find model pack %s: %v", mp.Name, err)
+		}
+	}
+
+	resultsDir := filepath.Join(tempDir, "results")
+	if err := os.Mkdir(resultsDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create results directory: %v", err)
+	}
+
+	results := make([]map[string]interface{}, f.ResultCount)
+	for i := range results {
+		results[i] = map[string]interface{}{
+			"ruleId":  FakeQueryID,
+			"level":   "warning",
+			"message": map[string]string{"text": fmt.Sprintf("Fake result %d", i+1)},
+		}
+	}
+	sarif, err := json.Marshal(map[string]interface{}{
+		"version": "2.1.0",
+		"runs": []map[string]interface{}{{
+			"tool":    map[string]interface{}{"driver": map[string]string{"name": "CodeQL"}},
+			"results": results,
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	sarif, err = postProcessSarif(sarif, SarifContext{
+		SessionID:     job.Spec.SessionID,
+		Owner:         job.Spec.Owner,
+		Repo:          job.Spec.Repo,
+		QueryPackName: "fake/pack",
+		QueryPackHash: job.QueryPackHash,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sarifFilePath := filepath.Join(resultsDir, "results.sarif")
+	if err := os.WriteFile(sarifFilePath, sarif, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write SARIF file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(resultsDir, "results.bqrs"), []byte("fake bqrs"), 0644); err != nil {
+		return nil, fmt.Errorf("failed to write BQRS file: %v", err)
+	}
+
+	var summaryPath string
+	var slowPredicates []common.PredicateTiming
+	if job.EvaluatorLog {
+		summaryPath = filepath.Join(tempDir, "evaluator-log-summary.txt")
+		if err := os.WriteFile(summaryPath, []byte("Fake evaluator log summary\n"), 0644); err != nil {
+			return nil, fmt.Errorf("failed to write evaluator log summary: %v", err)
+		}
+		slowPredicates = []common.PredicateTiming{{
+			PredicateName: FakePredicateName,
+			Millis:        FakePredicateMillis,
+			Query:         FakeQueryID,
+		}}
+	}
+
+	return &RunQueryResult{
+		CLIVersion:    FakeCLIVersion,
+		ResultCount:   f.ResultCount,
+		BqrsFilePaths: BqrsFilePaths{BasePath: resultsDir, RelativeFilePaths: []string{"results.bqrs"}},
+		SarifFilePath: sarifFilePath,
+		QueryResults: []common.QueryResultCount{{
+			QueryID:     FakeQueryID,
+			ResultCount: f.ResultCount,
+			Levels:      map[string]int{"warning": f.ResultCount},
+		}},
+		EvaluatorLogSummary: summaryPath,
+		SlowPredicates:      slowPredicates,
+	}, nil
+}
@@ -0,0 +1,147 @@
+package codeql
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// SARIF post-processing.
+//
+// Only the run properties written here are typed.  Everything else in the
+// log is kept as raw JSON, since the CLI's output has too many optional
+// fields to round-trip through a complete static type.
+
+// SarifContext describes the analysis that produced a SARIF log.
+type SarifContext struct {
+	SessionID        int
+	Owner            string
+	Repo             string
+	DatabaseSHA      string
+	QueryPackName    string
+	QueryPackVersion string
+	QueryPackHash    string
+}
+
+type VersionControlDetails struct {
+	RepositoryURI string `json:"repositoryUri"`
+	RevisionID    string `json:"revisionId,omitempty"`
+}
+
+type SarifMessage struct {
+	Text string `json:"text"`
+}
+
+type RunAutomationDetails struct {
+	ID          string        `json:"id"`
+	Description *SarifMessage `json:"description,omitempty"`
+}
+
+// QueryPackProperties is stored in the run's property bag under
+// sarifPropertiesKey.
+type QueryPackProperties struct {
+	SessionID int                `json:"sessionId"`
+	QueryPack QueryPackReference `json:"queryPack"`
+}
+
+type QueryPackReference struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	SHA256  string `json:"sha256,omitempty"`
+}
+
+const sarifPropertiesKey = "mrva"
+
+// repositoryURL returns the browsable URL of the analysed repository.
+func repositoryURL(owner, repo string) string {
+	server := os.Getenv("GITHUB_SERVER_URL")
+	if server == "" {
+		server = "https://github.com"
+	}
+	return fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(server, "/"), owner, repo)
+}
+
+// postProcessSarif sets the provenance, automation details and query pack
+// metadata of every run in the SARIF log.  A result reused by a later
+// session keeps those of the session that ran it.
+func postProcessSarif(sarif []byte, sc SarifContext) ([]byte, error) {
+	var sarifLog map[string]json.RawMessage
+	if err := json.Unmarshal(sarif, &sarifLog); err != nil {
+		return nil, fmt.Errorf("failed to decode SARIF: %v", err)
+	}
+
+	var runs []map[string]json.RawMessage
+	if raw, ok := sarifLog["runs"]; ok {
+		if err := json.Unmarshal(raw, &runs); err != nil {
+			return nil, fmt.Errorf("failed to decode SARIF runs: %v", err)
+		}
+	}
+
+	provenance := VersionControlDetails{
+		RepositoryURI: repositoryURL(sc.Owner, sc.Repo),
+		RevisionID:    sc.DatabaseSHA,
+	}
+	automation := RunAutomationDetails{
+		// category/run-id: one category per session, one run per repository
+		ID: fmt.Sprintf("mrva/session-%d/%s/%s", sc.SessionID, sc.Owner, sc.Repo),
+		Description: &SarifMessage{
+			Text: fmt.Sprintf("Variant analysis %d of %s/%s", sc.SessionID, sc.Owner, sc.Repo),
+		},
+	}
+	packProperties := QueryPackProperties{
+		SessionID: sc.SessionID,
+		QueryPack: QueryPackReference{
+			Name:    sc.QueryPackName,
+			Version: sc.QueryPackVersion,
+			SHA256:  sc.QueryPackHash,
+		},
+	}
+
+	for _, run := range runs {
+		var vcp []json.RawMessage
+		if raw, ok := run["versionControlProvenance"]; ok {
+			if err := json.Unmarshal(raw, &vcp); err != nil {
+				return nil, fmt.Errorf("failed to decode versionControlProvenance: %v", err)
+			}
+		}
+		entry, err := json.Marshal(provenance)
+		if err != nil {
+			return nil, err
+		}
+		run["versionControlProvenance"], err = json.Marshal(append(vcp, entry))
+		if err != nil {
+			return nil, err
+		}
+
+		run["automationDetails"], err = json.Marshal(automation)
+		if err != nil {
+			return nil, err
+		}
+
+		properties := map[string]json.RawMessage{}
+		if raw, ok := run["properties"]; ok {
+			if err := json.Unmarshal(raw, &properties); err != nil {
+				return nil, fmt.Errorf("failed to decode run properties: %v", err)
+			}
+		}
+		properties[sarifPropertiesKey], err = json.Marshal(packProperties)
+		if err != nil {
+			return nil, err
+		}
+		run["properties"], err = json.Marshal(properties)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if runs != nil {
+		raw, err := json.Marshal(runs)
+		if err != nil {
+			return nil, err
+		}
+		sarifLog["runs"] = raw
+	}
+
+	return json.MarshalIndent(sarifLog, "", "  ")
+}
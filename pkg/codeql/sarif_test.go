@@ -0,0 +1,138 @@
+package codeql
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPostProcessSarif(t *testing.T) {
+	t.Setenv("GITHUB_SERVER_URL", "https://ghe.example.com/")
+	sc := SarifContext{
+		SessionID:        7,
+		Owner:            "octo",
+		Repo:             "hello",
+		DatabaseSHA:      "abc123",
+		QueryPackName:    "octo/queries",
+		QueryPackVersion: "1.2.3",
+		QueryPackHash:    "feed",
+	}
+
+	// The details every run gets
+	const (
+		provenance = `{"repositoryUri": "https://ghe.example.com/octo/hello", "revisionId": "abc123"}`
+		automation = `"automationDetails": {
+			"id": "mrva/session-7/octo/hello",
+			"description": {"text": "Variant analysis 7 of octo/hello"}
+		}`
+		mrva = `"mrva": {"sessionId": 7, "queryPack": {"name": "octo/queries", "version": "1.2.3", "sha256": "feed"}}`
+	)
+	run := func(fields ...string) string {
+		return "{" + strings.Join(fields, ",") + "}"
+	}
+
+	for _, tc := range []struct {
+		name    string
+		sarif   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "one run",
+			sarif: `{"version": "2.1.0", "runs": [{"results": []}]}`,
+			want: `{"version": "2.1.0", "runs": [` + run(
+				`"results": []`,
+				`"versionControlProvenance": [`+provenance+`]`,
+				automation,
+				`"properties": {`+mrva+`}`,
+			) + `]}`,
+		},
+		{
+			name:  "multiple runs",
+			sarif: `{"runs": [{"results": [{"ruleId": "a"}]}, {"results": [{"ruleId": "b"}]}]}`,
+			want: `{"runs": [` + run(
+				`"results": [{"ruleId": "a"}]`,
+				`"versionControlProvenance": [`+provenance+`]`,
+				automation,
+				`"properties": {`+mrva+`}`,
+			) + "," + run(
+				`"results": [{"ruleId": "b"}]`,
+				`"versionControlProvenance": [`+provenance+`]`,
+				automation,
+				`"properties": {`+mrva+`}`,
+			) + `]}`,
+		},
+		{
+			name: "rules and taxonomies kept",
+			sarif: `{"runs": [{
+				"tool": {"driver": {"name": "CodeQL", "rules": [{"id": "js/xss", "properties": {"tags": ["security"]}}]}},
+				"taxonomies": [{"name": "CWE", "taxa": [{"id": "79"}]}]
+			}]}`,
+			want: `{"runs": [` + run(
+				`"tool": {"driver": {"name": "CodeQL", "rules": [{"id": "js/xss", "properties": {"tags": ["security"]}}]}}`,
+				`"taxonomies": [{"name": "CWE", "taxa": [{"id": "79"}]}]`,
+				`"versionControlProvenance": [`+provenance+`]`,
+				automation,
+				`"properties": {`+mrva+`}`,
+			) + `]}`,
+		},
+		{
+			name: "existing details",
+			sarif: `{"runs": [{
+				"versionControlProvenance": [{"repositoryUri": "https://example.com/source"}],
+				"automationDetails": {"id": "old/"},
+				"properties": {"semmle.formatSpecifier": "sarifv2.1.0", "mrva": {"sessionId": 1}}
+			}]}`,
+			want: `{"runs": [` + run(
+				`"versionControlProvenance": [{"repositoryUri": "https://example.com/source"}, `+provenance+`]`,
+				automation,
+				`"properties": {"semmle.formatSpecifier": "sarifv2.1.0", `+mrva+`}`,
+			) + `]}`,
+		},
+		{
+			name:  "no runs",
+			sarif: `{"version": "2.1.0", "$schema": "https://json.schemastore.org/sarif-2.1.0.json"}`,
+			want:  `{"version": "2.1.0", "$schema": "https://json.schemastore.org/sarif-2.1.0.json"}`,
+		},
+		{
+			name:    "not JSON",
+			sarif:   `{"runs": [`,
+			wantErr: true,
+		},
+		{
+			name:    "runs not a list",
+			sarif:   `{"runs": {}}`,
+			wantErr: true,
+		},
+		{
+			name:    "properties not an object",
+			sarif:   `{"runs": [{"properties": []}]}`,
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := postProcessSarif([]byte(tc.sarif), sc)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("postProcessSarif() = %s, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("postProcessSarif() error = %v", err)
+			}
+
+			var gotLog, wantLog interface{}
+			if err := json.Unmarshal(got, &gotLog); err != nil {
+				t.Fatalf("postProcessSarif() returned invalid JSON: %v\n%s", err, got)
+			}
+			if err := json.Unmarshal([]byte(tc.want), &wantLog); err != nil {
+				t.Fatalf("invalid expectation: %v", err)
+			}
+			if !reflect.DeepEqual(gotLog, wantLog) {
+				t.Errorf("postProcessSarif() =\n%s\nwant\n%s", got, tc.want)
+			}
+		})
+	}
+}
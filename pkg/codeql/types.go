@@ -1,16 +1,64 @@
 package codeql
 
+import (
+	"strconv"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+)
+
 // Types
 type CodeqlCli struct {
 	Path string
 }
 
+// Resources bound the memory and threads of one analysis.  Zero values
+// leave the CLI's own defaults.
+type Resources struct {
+	RAMMB   int
+	Threads int
+}
+
+// DefaultResources are used when an agent's configuration sets none.
+var DefaultResources = Resources{RAMMB: 2048, Threads: 1}
+
+// args are the --ram and --threads options applying the bounds.
+func (r Resources) args() []string {
+	var args []string
+	if r.RAMMB > 0 {
+		args = append(args, "--ram="+strconv.Itoa(r.RAMMB))
+	}
+	if r.Threads != 0 {
+		args = append(args, "--threads="+strconv.Itoa(r.Threads))
+	}
+	return args
+}
+
 type RunQueryResult struct {
+	CLIVersion           string
+	DatabaseUpgraded     bool
 	ResultCount          int
 	DatabaseSHA          string
 	SourceLocationPrefix string
 	BqrsFilePaths        BqrsFilePaths
 	SarifFilePath        string
+	QueryResults         []common.QueryResultCount
+	// EvaluatorLogSummary is the path of the evaluator log summary, if the
+	// job asked for one.
+	EvaluatorLogSummary string
+	SlowPredicates      []common.PredicateTiming
+}
+
+// AnalysisPacks are the extracted packs of an analysis.
+type AnalysisPacks struct {
+	QueryPack  string
+	ModelPacks []ModelPack
+}
+
+// ModelPack is an extracted model pack, whose data extensions customize the
+// queries' sources, sinks and summaries.
+type ModelPack struct {
+	Name string
+	Path string
 }
 
 type BqrsFilePaths struct {
@@ -26,12 +74,26 @@ const (
 )
 
 type SarifRun struct {
-	// XX: static types
-	VersionControlProvenance []interface{} `json:"versionControlProvenance,omitempty"`
+	VersionControlProvenance []VersionControlDetails `json:"versionControlProvenance,omitempty"`
 	// XX: never set, only read
 	Results []interface{} `json:"results"`
 }
 
+// SarifResult holds the fields of a SARIF result used for counting.
+type SarifResult struct {
+	RuleID string `json:"ruleId"`
+	Rule   *struct {
+		ID string `json:"id"`
+	} `json:"rule,omitempty"`
+	Level string `json:"level"`
+}
+
+type SarifResults struct {
+	Runs []struct {
+		Results []SarifResult `json:"results"`
+	} `json:"runs"`
+}
+
 type Sarif struct {
 	Runs []SarifRun `json:"runs"`
 }
@@ -42,7 +104,8 @@ type CreationMetadata struct {
 }
 
 type DatabaseMetadata struct {
-	CreationMetadata *CreationMetadata `yaml:"creationMetadata,omitempty"`
+	SourceLocationPrefix *string           `yaml:"sourceLocationPrefix,omitempty"`
+	CreationMetadata     *CreationMetadata `yaml:"creationMetadata,omitempty"`
 }
 
 type QueryMetadata struct {
@@ -67,10 +130,33 @@ type Query struct {
 	BqrsInfo             BQRSInfo      `json:"bqrsInfo"`
 }
 
+// ResolvedQuery is a query of a pack; paths are relative to the pack root.
+type ResolvedQuery struct {
+	RelativeQueryPath    string
+	RelativeBqrsFilePath string
+	QueryMetadata        QueryMetadata
+}
+
+type ResolvedPack struct {
+	QueryPack QueryPackFile
+	Queries   []ResolvedQuery
+}
+
 type QueryPackRunResults struct {
-	Queries           []Query `json:"queries"`
-	TotalResultsCount int     `json:"totalResultsCount"`
-	ResultsBasePath   string  `json:"resultsBasePath"`
+	Queries           []Query       `json:"queries"`
+	TotalResultsCount int           `json:"totalResultsCount"`
+	ResultsBasePath   string        `json:"resultsBasePath"`
+	QueryPack         QueryPackFile `json:"queryPack"`
+}
+
+// ResolvedQueries is the output of codeql resolve queries --format=bylanguage
+type ResolvedQueries struct {
+	ByLanguage map[string]map[string]interface{} `json:"byLanguage"`
+}
+
+type QueryPackFile struct {
+	Name    string `yaml:"name"`
+	Version string `yaml:"version"`
 }
 
 type ResolvedDatabase struct {
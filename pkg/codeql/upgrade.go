@@ -0,0 +1,92 @@
+package codeql
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+)
+
+// upgradedMarkerName records, inside an upgraded database directory, the CLI
+// version whose dbscheme the database now has.  Cached databases keep it, so
+// later jobs do not pick a CLI too old for the upgraded database.
+const upgradedMarkerName = ".mrva-upgraded-cli-version"
+
+// databaseNeedsUpgrade reports whether the database's dbscheme is older than
+// the one the CLI's extractor expects.
+func databaseNeedsUpgrade(codeql CodeqlCli, dbDir string, dbMetadata *DatabaseMetadata, cliVersion string) (bool, error) {
+	dbCLIVersion := databaseCLIVersion(dbDir, dbMetadata)
+	if dbCLIVersion != "" && compareVersions(dbCLIVersion, cliVersion) >= 0 {
+		// Same or newer; upgrades only go forward
+		return false, nil
+	}
+
+	schemes, err := filepath.Glob(filepath.Join(dbDir, "db-*", "*.dbscheme"))
+	if err != nil {
+		return false, err
+	}
+	for _, scheme := range schemes {
+		language := strings.TrimPrefix(filepath.Base(filepath.Dir(scheme)), "db-")
+		extractorDir, err := resolveExtractor(codeql, language)
+		if err != nil {
+			return false, err
+		}
+
+		current, err := os.ReadFile(filepath.Join(extractorDir, filepath.Base(scheme)))
+		if err != nil {
+			// No dbscheme to compare with; go by the recorded version
+			slog.Debug("CLI dbscheme not found", "language", language, "error", err)
+			return dbCLIVersion != "", nil
+		}
+		existing, err := os.ReadFile(scheme)
+		if err != nil {
+			return false, fmt.Errorf("failed to read database dbscheme: %v", err)
+		}
+		if !bytes.Equal(current, existing) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// databaseCLIVersion is the CLI version the database's dbscheme belongs to:
+// the version of an earlier upgrade, or else the creating CLI's.
+func databaseCLIVersion(dbDir string, dbMetadata *DatabaseMetadata) string {
+	if data, err := os.ReadFile(filepath.Join(dbDir, upgradedMarkerName)); err == nil {
+		return strings.TrimSpace(string(data))
+	}
+	if dbMetadata.CreationMetadata != nil && dbMetadata.CreationMetadata.CLIVersion != nil {
+		return *dbMetadata.CreationMetadata.CLIVersion
+	}
+	return ""
+}
+
+func resolveExtractor(codeql CodeqlCli, language string) (string, error) {
+	output, err := runCommand([]string{codeql.Path, "resolve", "extractor", "--language=" + language})
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s extractor: %v", language, err)
+	}
+	return strings.TrimSpace(output.Stdout), nil
+}
+
+// upgradeDatabase upgrades the database in place to the CLI's dbscheme,
+// using the libraries bundled with the query pack, and marks it as upgraded.
+func upgradeDatabase(codeql CodeqlCli, dbDir string, packs AnalysisPacks, cliVersion string) error {
+	cmd := exec.Command(codeql.Path, "database", "upgrade",
+		"--additional-packs", packs.additionalPacks(), "--", dbDir)
+	if err := runCLI("upgrade database", cmd); err != nil {
+		// Without a clearer cause, the dbscheme has no upgrade path
+		var ae *AnalysisError
+		if errors.As(err, &ae) && ae.Diagnostic.Kind == common.DiagnosticUnknown {
+			ae.Diagnostic.Kind = common.DiagnosticUnsupportedDBScheme
+		}
+		return err
+	}
+	return os.WriteFile(filepath.Join(dbDir, upgradedMarkerName), []byte(cliVersion+"\n"), 0644)
+}
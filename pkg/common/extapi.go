@@ -1,5 +1,7 @@
 package common
 
+import "strconv"
+
 type JobInfo struct {
 	QueryLanguage       string
 	CreatedAt           string
@@ -29,6 +31,13 @@ type NoCodeqlDBRepos struct {
 	Repositories    []Repository `json:"repositories"`
 }
 
+// ReusedResultRepos lists the repositories whose results were taken from an
+// earlier identical analysis instead of being run again.
+type ReusedResultRepos struct {
+	RepositoryCount     int      `json:"repository_count"`
+	RepositoryFullNames []string `json:"repository_full_names"`
+}
+
 type OverLimitRepos struct {
 	RepositoryCount int          `json:"repository_count"`
 	Repositories    []Repository `json:"repositories"`
@@ -100,10 +109,197 @@ type ControllerRepo struct {
 }
 
 type ScannedRepo struct {
-	Repository        Repository `json:"repository"`
-	AnalysisStatus    string     `json:"analysis_status"`
-	ResultCount       int        `json:"result_count"`
-	ArtifactSizeBytes int        `json:"artifact_size_in_bytes"`
+	Repository        Repository         `json:"repository"`
+	AnalysisStatus    string             `json:"analysis_status"`
+	ResultCount       int                `json:"result_count"`
+	ArtifactSizeBytes int                `json:"artifact_size_in_bytes"`
+	ResultFromCache   bool               `json:"result_from_cache,omitempty"`
+	QueryResults      []QueryResultCount `json:"query_results,omitempty"`
+	CLIVersion        string             `json:"cli_version,omitempty"`
+	DatabaseUpgraded  bool               `json:"database_upgraded,omitempty"`
+	FailureMessage    string             `json:"failure_message,omitempty"`
+	Diagnostic        *Diagnostic        `json:"diagnostic,omitempty"`
+	Attempts          []JobAttempt       `json:"attempts,omitempty"`
+}
+
+// JobAttempt is a failed attempt at analysing a repository.  RetryAt is
+// set when the failure was transient and the job will be tried again.
+type JobAttempt struct {
+	Attempt  int            `json:"attempt"`
+	Kind     DiagnosticKind `json:"kind"`
+	Message  string         `json:"message"`
+	FailedAt string         `json:"failed_at"`
+	RetryAt  string         `json:"retry_at,omitempty"`
+}
+
+// QueryResultCount is the number of results of one query in one analysis.
+// Levels counts SARIF results by level; it is empty for queries without
+// SARIF output, whose count is the BQRS row count.
+type QueryResultCount struct {
+	QueryID     string         `json:"query_id"`
+	ResultCount int            `json:"result_count"`
+	Levels      map[string]int `json:"levels,omitempty"`
+}
+
+// Diagnostic explains why the analysis of a repository failed.  File, Line
+// and Column locate compilation errors, relative to the query pack.
+type Diagnostic struct {
+	Kind     DiagnosticKind `json:"kind"`
+	Message  string         `json:"message"`
+	File     string         `json:"file,omitempty"`
+	Line     int            `json:"line,omitempty"`
+	Column   int            `json:"column,omitempty"`
+	ExitCode int            `json:"exit_code,omitempty"`
+}
+
+// DiagnosticKind classifies the cause of a failed analysis.
+type DiagnosticKind string
+
+const (
+	DiagnosticCompilationError    DiagnosticKind = "compilation_error"
+	DiagnosticOutOfMemory         DiagnosticKind = "out_of_memory"
+	DiagnosticDatabaseCorrupt     DiagnosticKind = "database_corrupt"
+	DiagnosticTimeout             DiagnosticKind = "timeout"
+	DiagnosticUnsupportedDBScheme DiagnosticKind = "unsupported_dbscheme"
+	DiagnosticInsufficientDisk    DiagnosticKind = "insufficient_disk"
+	DiagnosticAgentLost           DiagnosticKind = "agent_lost"
+	DiagnosticNetworkError        DiagnosticKind = "network_error"
+	DiagnosticStorageError        DiagnosticKind = "storage_error"
+	DiagnosticUnknown             DiagnosticKind = "unknown"
+)
+
+// Retryable reports whether a failure of this kind is likely transient, so
+// that the job may succeed when tried again.
+func (k DiagnosticKind) Retryable() bool {
+	switch k {
+	case DiagnosticNetworkError, DiagnosticStorageError:
+		return true
+	}
+	return false
+}
+
+// Summary is a one-line description for display, e.g.
+// "query failed to compile at Foo.ql:12: could not resolve type Bar".
+func (d Diagnostic) Summary() string {
+	var prefix string
+	switch d.Kind {
+	case DiagnosticCompilationError:
+		prefix = "query failed to compile"
+		if d.File != "" {
+			prefix += " at " + d.File
+			if d.Line > 0 {
+				prefix += ":" + strconv.Itoa(d.Line)
+			}
+		}
+	case DiagnosticOutOfMemory:
+		prefix = "analysis ran out of memory"
+	case DiagnosticDatabaseCorrupt:
+		prefix = "database is corrupt"
+	case DiagnosticTimeout:
+		prefix = "analysis timed out"
+	case DiagnosticUnsupportedDBScheme:
+		prefix = "database schema is not supported"
+	case DiagnosticInsufficientDisk:
+		prefix = "database does not fit on the agent's disk"
+	case DiagnosticAgentLost:
+		prefix = "agent running the analysis stopped responding"
+	case DiagnosticNetworkError:
+		prefix = "a service could not be reached"
+	case DiagnosticStorageError:
+		prefix = "storage could not be read or written"
+	default:
+		return d.Message
+	}
+	if d.Message == "" {
+		return prefix
+	}
+	return prefix + ": " + d.Message
+}
+
+// PredicateTiming is the evaluation time of one predicate in one analysis,
+// from the evaluator log.
+type PredicateTiming struct {
+	PredicateName string `json:"predicate_name"`
+	Millis        int64  `json:"millis"`
+	ResultSize    int64  `json:"result_size"`
+	Query         string `json:"query,omitempty"`
+}
+
+// SlowPredicatesResponse lists the predicates of a session that took longest
+// to evaluate, over all repositories analysed with an evaluator log.
+type SlowPredicatesResponse struct {
+	SessionId    int             `json:"id"`
+	Repositories int             `json:"repositories"`
+	Predicates   []SlowPredicate `json:"predicates"`
+}
+
+type SlowPredicate struct {
+	PredicateName string `json:"predicate_name"`
+	Query         string `json:"query,omitempty"`
+	TotalMillis   int64  `json:"total_millis"`
+	MaxMillis     int64  `json:"max_millis"`
+	// MaxRepository is the repository with the longest evaluation.
+	MaxRepository string `json:"max_repository"`
+	Repositories  int    `json:"repositories"`
+}
+
+// ResultBreakdownResponse lists per-query result counts for all repositories
+// of a session.
+type ResultBreakdownResponse struct {
+	SessionId    int                   `json:"id"`
+	Queries      []QueryResultCount    `json:"queries"`
+	Repositories []RepoResultBreakdown `json:"repositories"`
+}
+
+type RepoResultBreakdown struct {
+	FullName       string             `json:"full_name"`
+	AnalysisStatus string             `json:"analysis_status"`
+	ResultCount    int                `json:"result_count"`
+	QueryResults   []QueryResultCount `json:"query_results"`
+}
+
+// AgentsResponse lists the agents that reported to the server.  Agents
+// that missed their heartbeats are listed as "lost" for a while.
+type AgentsResponse struct {
+	Agents []AgentStatus `json:"agents"`
+}
+
+type AgentStatus struct {
+	AgentID         string       `json:"agent_id"`
+	Status          string       `json:"status"`
+	RegisteredAt    string       `json:"registered_at"`
+	LastHeartbeat   string       `json:"last_heartbeat"`
+	Workers         int          `json:"workers"`
+	CachedDatabases int          `json:"cached_databases"`
+	RunningJobs     []RunningJob `json:"running_jobs"`
+}
+
+// RunningJob is the analysis of one repository in one session.
+type RunningJob struct {
+	SessionId int    `json:"id"`
+	FullName  string `json:"full_name"`
+}
+
+// DeadLettersResponse lists the jobs and results that could not be
+// processed.
+type DeadLettersResponse struct {
+	DeadLetters []DeadLetter `json:"dead_letters"`
+}
+
+// DeadLetter describes a dead-lettered message.  Body, the message as
+// published, is only included when a single dead letter is inspected.
+type DeadLetter struct {
+	ID             string      `json:"id"`
+	Queue          string      `json:"queue"`
+	Reason         string      `json:"reason"`
+	Attempts       int         `json:"attempts"`
+	DeadLetteredAt string      `json:"dead_lettered_at"`
+	Job            *RunningJob `json:"job,omitempty"`
+	Body           string      `json:"body,omitempty"`
+}
+
+type DeadLettersPurgedResponse struct {
+	Purged int `json:"purged"`
 }
 
 type Repository struct {
@@ -116,13 +312,19 @@ type Repository struct {
 }
 
 type DownloadResponse struct {
-	Repository           DownloadRepo `json:"repository"`
-	AnalysisStatus       string       `json:"analysis_status"`
-	ResultCount          int          `json:"result_count"`
-	ArtifactSizeBytes    int          `json:"artifact_size_in_bytes"`
-	DatabaseCommitSha    string       `json:"database_commit_sha"`
-	SourceLocationPrefix string       `json:"source_location_prefix"`
-	ArtifactURL          string       `json:"artifact_url"`
+	Repository           DownloadRepo       `json:"repository"`
+	AnalysisStatus       string             `json:"analysis_status"`
+	ResultCount          int                `json:"result_count"`
+	ArtifactSizeBytes    int                `json:"artifact_size_in_bytes"`
+	DatabaseCommitSha    string             `json:"database_commit_sha"`
+	SourceLocationPrefix string             `json:"source_location_prefix"`
+	ArtifactURL          string             `json:"artifact_url"`
+	QueryResults         []QueryResultCount `json:"query_results,omitempty"`
+	CLIVersion           string             `json:"cli_version,omitempty"`
+	DatabaseUpgraded     bool               `json:"database_upgraded,omitempty"`
+	EvaluatorLogURL      string             `json:"evaluator_log_url,omitempty"`
+	FailureMessage       string             `json:"failure_message,omitempty"`
+	Diagnostic           *Diagnostic        `json:"diagnostic,omitempty"`
 }
 
 type DownloadRepo struct {
@@ -216,6 +418,7 @@ type SubmitResponse struct {
 	UpdatedAt           string              `json:"updated_at"`
 	Status              string              `json:"status"`
 	SkippedRepositories SkippedRepositories `json:"skipped_repositories"`
+	ReusedResultRepos   ReusedResultRepos   `json:"reused_result_repos"`
 }
 
 type SubmitMsg struct {
@@ -223,4 +426,16 @@ type SubmitMsg struct {
 	Language      string   `json:"language"`
 	QueryPack     string   `json:"query_pack"`
 	Repositories  []string `json:"repositories"`
+	// CLIVersion optionally pins the CodeQL CLI version of the analyses.
+	CLIVersion string `json:"cli_version,omitempty"`
+	// ModelPacks are base64-encoded model pack archives sent with the
+	// submission; ModelPackNames refer to packs uploaded to the server.
+	ModelPacks     []string `json:"model_packs,omitempty"`
+	ModelPackNames []string `json:"model_pack_names,omitempty"`
+	// ThreatModels enable, or with a leading '!' disable, threat models,
+	// e.g. "local" or "!remote".
+	ThreatModels []string `json:"threat_models,omitempty"`
+	// EvaluatorLog asks for evaluator log summaries, see
+	// /slow-predicates/{id}.  It disables result reuse.
+	EvaluatorLog bool `json:"evaluator_log,omitempty"`
 }
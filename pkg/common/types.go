@@ -42,6 +42,17 @@ type JobSpec struct {
 	NameWithOwner
 }
 
+// ResultCacheKey identifies an analysis whose result can be reused: the same
+// query pack run on the same database version by the same CodeQL CLI.
+// QueryPackHash also covers model packs and threat models; see
+// queue.AnalyzeJob.AnalysisHash.
+type ResultCacheKey struct {
+	QueryPackHash    string
+	DatabaseIdentity string
+	CLIVersion       string
+	NameWithOwner
+}
+
 type StatusSummary struct {
 	Overall Status
 	Counts  map[Status]int
@@ -8,10 +8,16 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/hohn/mrvacommander/config/mcc"
+	"github.com/hohn/mrvacommander/pkg/agent"
 	"github.com/hohn/mrvacommander/pkg/artifactstore"
+	"github.com/hohn/mrvacommander/pkg/codeql"
+	"github.com/hohn/mrvacommander/pkg/diskcache"
 	"github.com/hohn/mrvacommander/pkg/qldbstore"
 	"github.com/hohn/mrvacommander/pkg/queue"
+	"github.com/hohn/mrvacommander/pkg/server"
 	"github.com/hohn/mrvacommander/pkg/state"
 	"github.com/minio/minio-go/v7"
 )
@@ -50,9 +56,13 @@ func InitRabbitMQ(isAgent bool) (queue.Queue, error) {
 		return nil, fmt.Errorf("failed to parse RabbitMQ port: %v", err)
 	}
 
+	// Set to redeclare the queues of deployments predating durable queues
+	migrateQueues := os.Getenv("MRVA_RABBITMQ_MIGRATE_QUEUES") == "1"
+
 	log.Println("Initializing RabbitMQ queue")
 
-	rabbitMQQueue, err := queue.NewRabbitMQQueue(rmqHost, int16(rmqPortAsInt), rmqUser, rmqPass, isAgent)
+	rabbitMQQueue, err := queue.NewRabbitMQQueue(rmqHost, int16(rmqPortAsInt), rmqUser, rmqPass,
+		isAgent, migrateQueues)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize RabbitMQ: %v", err)
 	}
@@ -120,6 +130,144 @@ func InitHEPCDatabaseStore() (qldbstore.Store, error) {
 	return store, nil
 }
 
+// InitDatabaseCache opens the agent's database cache as configured in cfg.
+// It returns nil when caching is disabled.
+func InitDatabaseCache(cfg mcc.Runner) (*diskcache.Cache, error) {
+	const defaultDBCacheMaxMB = 20 * 1024
+
+	if cfg.DBCacheDir == "" {
+		slog.Info("Database cache disabled")
+		return nil, nil
+	}
+
+	maxMB := cfg.DBCacheMaxMB
+	if maxMB <= 0 {
+		maxMB = defaultDBCacheMaxMB
+	}
+
+	cache, err := diskcache.New("databases", cfg.DBCacheDir, maxMB*1024*1024)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize database cache: %v", err)
+	}
+	return cache, nil
+}
+
+// InitPackCache opens the agent's compiled query pack cache as configured in
+// cfg.  It returns nil when caching is disabled.
+func InitPackCache(cfg mcc.Runner) (*diskcache.Cache, error) {
+	const defaultPackCacheMaxMB = 2 * 1024
+
+	if cfg.PackCacheDir == "" {
+		slog.Info("Query pack cache disabled")
+		return nil, nil
+	}
+
+	maxMB := cfg.PackCacheMaxMB
+	if maxMB <= 0 {
+		maxMB = defaultPackCacheMaxMB
+	}
+
+	cache, err := diskcache.New("query-packs", cfg.PackCacheDir, maxMB*1024*1024)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize query pack cache: %v", err)
+	}
+	return cache, nil
+}
+
+// InitAnalysisRunner returns the runner for the agent's analyses: a pool of
+// query servers if cfg asks for one, otherwise one CLI process per step.
+func InitAnalysisRunner(cfg mcc.Runner) (agent.AnalysisRunner, error) {
+	res := codeql.DefaultResources
+	if cfg.RAMMB > 0 {
+		res.RAMMB = cfg.RAMMB
+	}
+	if cfg.Threads != 0 {
+		res.Threads = cfg.Threads
+	}
+
+	if cfg.QueryServers <= 0 {
+		slog.Info("Running analyses with the CodeQL CLI",
+			"ram_mb", res.RAMMB, "threads", res.Threads)
+		return codeql.CLIRunner{Resources: res}, nil
+	}
+
+	slog.Info("Running analyses on CodeQL query servers", "count", cfg.QueryServers,
+		"ram_mb", res.RAMMB, "threads", res.Threads)
+	runner, err := codeql.NewQueryServerRunner(cfg.QueryServers, res)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize query servers: %v", err)
+	}
+	return runner, nil
+}
+
+// InitScratch returns the agent's scratch space as configured in cfg,
+// creating the directory if needed.
+func InitScratch(cfg mcc.Runner) (agent.Scratch, error) {
+	const defaultMinFreeDiskMB = 1024
+
+	scratch := agent.Scratch{
+		Dir:           cfg.ScratchDir,
+		MinFreeDiskMB: cfg.MinFreeDiskMB,
+	}
+	if scratch.Dir == "" {
+		scratch.Dir = os.TempDir()
+	}
+	if scratch.MinFreeDiskMB <= 0 {
+		scratch.MinFreeDiskMB = defaultMinFreeDiskMB
+	}
+	if err := os.MkdirAll(scratch.Dir, 0700); err != nil {
+		return agent.Scratch{}, fmt.Errorf("failed to create scratch directory: %v", err)
+	}
+	slog.Info("Agent scratch space", "dir", scratch.Dir, "min_free_disk_mb", scratch.MinFreeDiskMB)
+	return scratch, nil
+}
+
+// InitAutoscale returns the bounds of the agent's adaptive worker pool as
+// configured in cfg, or nil for a fixed worker count.  Each added worker
+// needs the memory CodeQL may use per analysis.
+func InitAutoscale(cfg mcc.Runner) *agent.Autoscale {
+	workerMemoryMB := int64(codeql.DefaultResources.RAMMB)
+	if cfg.RAMMB > 0 {
+		workerMemoryMB = int64(cfg.RAMMB)
+	}
+	autoscale := agent.NewAutoscale(cfg.MinWorkers, cfg.MaxWorkers, workerMemoryMB,
+		cfg.MaxLoadPerCPU, time.Duration(cfg.ScaleIntervalSec)*time.Second)
+	if autoscale == nil {
+		slog.Info("Worker autoscaling disabled")
+	}
+	return autoscale
+}
+
+// InitMetrics starts serving the agent's metrics on cfg.MetricsAddr, if
+// set.
+func InitMetrics(cfg mcc.Runner) error {
+	if cfg.MetricsAddr == "" {
+		slog.Info("Agent metrics not served")
+		return nil
+	}
+	addr, err := agent.ServeMetrics(cfg.MetricsAddr)
+	if err != nil {
+		return fmt.Errorf("failed to serve agent metrics: %w", err)
+	}
+	slog.Info("Serving agent metrics", "addr", addr.String())
+	return nil
+}
+
+// InitRetryPolicy returns the retries of failed jobs as configured in cfg,
+// or nil if jobs are not retried.
+func InitRetryPolicy(cfg mcc.Commander) *server.RetryPolicy {
+	retry := server.NewRetryPolicy(cfg.MaxAttempts,
+		time.Duration(cfg.RetryBackoffSec)*time.Second,
+		time.Duration(cfg.MaxRetryBackoffSec)*time.Second)
+	if retry == nil {
+		slog.Info("Job retries disabled")
+	} else {
+		slog.Info("Job retries", "max_attempts", retry.MaxAttempts,
+			"backoff", retry.Backoff, "max_backoff", retry.MaxBackoff)
+	}
+	return retry
+}
+
 func InitPGState() state.ServerState {
 	slog.Info("Initializing Postgres state")
 	return state.NewPGState()
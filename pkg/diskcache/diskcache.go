@@ -0,0 +1,468 @@
+// Package diskcache keeps directories on local disk between uses, bounded by
+// total size and evicted least-recently-used first.
+package diskcache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dataDirName   = "data"
+	entryFileName = "entry.json"
+
+	// evictedPrefix names the directories of evicted entries awaiting
+	// removal.
+	evictedPrefix = "evicted-"
+)
+
+// Cache is a size-bounded, disk-backed LRU cache of directories.
+//
+// Each entry is a directory filled once by a caller-supplied function and
+// handed out through a Lease.  A lease from Acquire is exclusive: a second
+// caller asking for the same key waits until the first one releases it.
+// Leases from AcquireShared are for read-only use and may be held by several
+// callers at once.  Entries held by a lease are never evicted.
+type Cache struct {
+	name     string
+	root     string
+	maxBytes int64
+
+	mu      sync.Mutex
+	entries map[string]*entry
+	lru     *list.List // front = most recently used
+	used    int64
+
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+type entry struct {
+	key   string
+	dir   string
+	size  int64
+	ready bool
+	refs  int
+	elem  *list.Element
+
+	use sync.RWMutex // held for the duration of a lease
+}
+
+// entryMeta is persisted next to the data so the cache survives restarts.
+type entryMeta struct {
+	Key      string    `json:"key"`
+	Size     int64     `json:"size"`
+	LastUsed time.Time `json:"last_used"`
+}
+
+// Stats is a snapshot of the cache counters.
+type Stats struct {
+	Name      string `json:"name"`
+	Entries   int    `json:"entries"`
+	Bytes     int64  `json:"bytes"`
+	MaxBytes  int64  `json:"max_bytes"`
+	Hits      int64  `json:"hits"`
+	Misses    int64  `json:"misses"`
+	Evictions int64  `json:"evictions"`
+}
+
+// Lease grants use of a cache entry until Release is called.
+type Lease struct {
+	// Dir holds the entry content.
+	Dir string
+	// Hit reports whether the content was already cached.
+	Hit bool
+
+	cache  *Cache
+	entry  *entry
+	shared bool
+	once   sync.Once
+}
+
+// New opens the cache rooted at dir, picking up entries left by a previous
+// process.  name is only used in logs and stats.
+func New(name, dir string, maxBytes int64) (*Cache, error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("cache %s: size limit must be positive, got %d", name, maxBytes)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("cache %s: failed to create directory: %w", name, err)
+	}
+
+	c := &Cache{
+		name:     name,
+		root:     dir,
+		maxBytes: maxBytes,
+		entries:  make(map[string]*entry),
+		lru:      list.New(),
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	evicted := c.evictLocked()
+	c.mu.Unlock()
+	c.removeEvicted(evicted)
+
+	slog.Info("Opened disk cache", "name", name, "dir", dir,
+		"entries", len(c.entries), "bytes", c.used, "max_bytes", maxBytes)
+	return c, nil
+}
+
+// load rebuilds the index from the entry directories on disk.  Incomplete
+// entries, e.g. from a crash during fill, are removed.
+func (c *Cache) load() error {
+	dirs, err := os.ReadDir(c.root)
+	if err != nil {
+		return fmt.Errorf("cache %s: failed to list directory: %w", c.name, err)
+	}
+
+	type loaded struct {
+		meta entryMeta
+		dir  string
+	}
+	var found []loaded
+
+	for _, d := range dirs {
+		entryDir := filepath.Join(c.root, d.Name())
+		if !d.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(d.Name(), evictedPrefix) {
+			// Evicted before a crash
+			os.RemoveAll(entryDir)
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(entryDir, entryFileName))
+		if err != nil {
+			slog.Warn("Removing incomplete cache entry", "cache", c.name, "dir", entryDir)
+			os.RemoveAll(entryDir)
+			continue
+		}
+		var meta entryMeta
+		if err := json.Unmarshal(data, &meta); err != nil || entryDirName(meta.Key) != d.Name() {
+			slog.Warn("Removing unreadable cache entry", "cache", c.name, "dir", entryDir)
+			os.RemoveAll(entryDir)
+			continue
+		}
+		found = append(found, loaded{meta: meta, dir: entryDir})
+	}
+
+	// Oldest first, so that pushing to the front leaves the newest in front.
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].meta.LastUsed.Before(found[j].meta.LastUsed)
+	})
+
+	for _, f := range found {
+		e := &entry{
+			key:   f.meta.Key,
+			dir:   f.dir,
+			size:  f.meta.Size,
+			ready: true,
+		}
+		e.elem = c.lru.PushFront(e)
+		c.entries[e.key] = e
+		c.used += e.size
+	}
+	return nil
+}
+
+// Acquire returns a lease on the entry for key.  On a miss, fill is called
+// with an empty directory to populate; if it fails, nothing is cached and
+// the error is returned.
+func (c *Cache) Acquire(key string, fill func(dir string) error) (*Lease, error) {
+	e := c.register(key)
+
+	e.use.Lock()
+
+	c.mu.Lock()
+	if e.ready {
+		c.hits++
+		c.lru.MoveToFront(e.elem)
+		c.mu.Unlock()
+		slog.Debug("Disk cache hit", "cache", c.name, "key", key)
+		return &Lease{Dir: filepath.Join(e.dir, dataDirName), Hit: true, cache: c, entry: e}, nil
+	}
+	c.misses++
+	c.mu.Unlock()
+
+	if err := c.fillEntry(e, fill); err != nil {
+		c.unregister(e)
+		e.use.Unlock()
+		return nil, err
+	}
+
+	return &Lease{Dir: filepath.Join(e.dir, dataDirName), Hit: false, cache: c, entry: e}, nil
+}
+
+// AcquireShared is like Acquire, but the lease may be shared with other
+// AcquireShared callers.  The holder must not modify the entry.
+func (c *Cache) AcquireShared(key string, fill func(dir string) error) (*Lease, error) {
+	e := c.register(key)
+	hit := true
+
+	for {
+		e.use.RLock()
+		c.mu.Lock()
+		if e.ready {
+			if hit {
+				c.hits++
+			}
+			c.lru.MoveToFront(e.elem)
+			c.mu.Unlock()
+			slog.Debug("Disk cache shared lease", "cache", c.name, "key", key, "hit", hit)
+			return &Lease{Dir: filepath.Join(e.dir, dataDirName), Hit: hit, cache: c, entry: e, shared: true}, nil
+		}
+		c.mu.Unlock()
+		e.use.RUnlock()
+
+		// Fill under the exclusive lock, unless someone else got there first
+		e.use.Lock()
+		c.mu.Lock()
+		ready := e.ready
+		if !ready {
+			c.misses++
+		}
+		c.mu.Unlock()
+		if !ready {
+			hit = false
+			if err := c.fillEntry(e, fill); err != nil {
+				c.unregister(e)
+				e.use.Unlock()
+				return nil, err
+			}
+		}
+		e.use.Unlock()
+	}
+}
+
+// register finds or creates the entry for key and counts the caller as a
+// user, so the entry is not evicted.
+func (c *Cache) register(key string) *entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		e = &entry{
+			key: key,
+			dir: filepath.Join(c.root, entryDirName(key)),
+		}
+		c.entries[key] = e
+	}
+	e.refs++
+	return e
+}
+
+// unregister undoes register after a failed fill.
+func (c *Cache) unregister(e *entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e.refs--
+	if e.refs == 0 && !e.ready {
+		delete(c.entries, e.key)
+	}
+}
+
+// fillEntry populates e, which the caller holds exclusively, and adds it to
+// the cache.
+func (c *Cache) fillEntry(e *entry, fill func(dir string) error) error {
+	slog.Debug("Disk cache miss", "cache", c.name, "key", e.key)
+
+	size, err := c.fill(e, fill)
+	if err != nil {
+		os.RemoveAll(e.dir)
+		return err
+	}
+
+	c.mu.Lock()
+	e.size = size
+	e.ready = true
+	e.elem = c.lru.PushFront(e)
+	c.used += size
+	evicted := c.evictLocked()
+	c.mu.Unlock()
+	c.removeEvicted(evicted)
+	return nil
+}
+
+func (c *Cache) fill(e *entry, fill func(dir string) error) (int64, error) {
+	os.RemoveAll(e.dir)
+	dataDir := filepath.Join(e.dir, dataDirName)
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return 0, fmt.Errorf("cache %s: failed to create entry directory: %w", c.name, err)
+	}
+	if err := fill(dataDir); err != nil {
+		return 0, err
+	}
+	size, err := dirSize(dataDir)
+	if err != nil {
+		return 0, fmt.Errorf("cache %s: failed to measure entry: %w", c.name, err)
+	}
+	if err := writeMeta(e.dir, entryMeta{Key: e.key, Size: size, LastUsed: time.Now()}); err != nil {
+		return 0, fmt.Errorf("cache %s: failed to write entry metadata: %w", c.name, err)
+	}
+	return size, nil
+}
+
+// Release ends the lease.  It is safe to call more than once.
+func (l *Lease) Release() {
+	l.once.Do(func() {
+		c, e := l.cache, l.entry
+
+		// The content may have changed while leased, e.g. query results
+		// written into a database directory.
+		if !l.shared {
+			if size, err := dirSize(filepath.Join(e.dir, dataDirName)); err == nil {
+				c.mu.Lock()
+				c.used += size - e.size
+				e.size = size
+				c.mu.Unlock()
+			}
+		}
+		c.mu.Lock()
+		meta := entryMeta{Key: e.key, Size: e.size, LastUsed: time.Now()}
+		c.mu.Unlock()
+		if err := writeMeta(e.dir, meta); err != nil {
+			slog.Warn("Failed to update cache entry metadata", "cache", c.name, "key", e.key, "error", err)
+		}
+
+		if l.shared {
+			e.use.RUnlock()
+		} else {
+			e.use.Unlock()
+		}
+
+		c.mu.Lock()
+		e.refs--
+		evicted := c.evictLocked()
+		c.mu.Unlock()
+		c.removeEvicted(evicted)
+	})
+}
+
+// evictLocked removes least recently used entries until the cache fits its
+// size limit or only leased entries remain.  c.mu must be held.
+//
+// Evicted entries are only renamed out of the way, so their key can be
+// filled again at once; the caller deletes the returned directories with
+// removeEvicted after releasing c.mu.
+func (c *Cache) evictLocked() []string {
+	var evicted []string
+	for elem := c.lru.Back(); elem != nil && c.used > c.maxBytes; {
+		e := elem.Value.(*entry)
+		prev := elem.Prev()
+		if e.refs == 0 {
+			c.lru.Remove(elem)
+			delete(c.entries, e.key)
+			c.used -= e.size
+			c.evictions++
+			dir := filepath.Join(c.root, fmt.Sprintf("%s%d-%s", evictedPrefix, c.evictions, filepath.Base(e.dir)))
+			if err := os.Rename(e.dir, dir); err != nil {
+				// Filling the key again clears the directory
+				slog.Warn("Failed to remove evicted cache entry", "cache", c.name, "key", e.key, "error", err)
+			} else {
+				evicted = append(evicted, dir)
+			}
+			slog.Debug("Disk cache eviction", "cache", c.name, "key", e.key, "size", e.size)
+		}
+		elem = prev
+	}
+	return evicted
+}
+
+// removeEvicted deletes the directories of evicted entries.
+func (c *Cache) removeEvicted(dirs []string) {
+	for _, dir := range dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			slog.Warn("Failed to remove evicted cache entry", "cache", c.name, "dir", dir, "error", err)
+		}
+	}
+}
+
+// Keys lists the keys of all complete entries, most recently used first.
+func (c *Cache) Keys() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := make([]string, 0, c.lru.Len())
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		keys = append(keys, elem.Value.(*entry).key)
+	}
+	return keys
+}
+
+// Stats returns the current counters.
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return Stats{
+		Name:      c.name,
+		Entries:   c.lru.Len(),
+		Bytes:     c.used,
+		MaxBytes:  c.maxBytes,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+}
+
+// entryDirName maps a key of arbitrary content to a safe directory name.
+func entryDirName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:16])
+}
+
+func writeMeta(dir string, meta entryMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	// Shared leases may update the metadata concurrently
+	tmp, err := os.CreateTemp(dir, entryFileName+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, entryFileName))
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,240 @@
+package diskcache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// fillWith returns a fill function writing size bytes of content naming key.
+func fillWith(key string, size int) func(dir string) error {
+	return func(dir string) error {
+		content := strings.Repeat(key, size)[:size]
+		return os.WriteFile(filepath.Join(dir, "content"), []byte(content), 0644)
+	}
+}
+
+func acquire(t *testing.T, c *Cache, key string, size int) *Lease {
+	t.Helper()
+	lease, err := c.Acquire(key, fillWith(key, size))
+	if err != nil {
+		t.Fatalf("Acquire(%q) error = %v", key, err)
+	}
+	return lease
+}
+
+// use acquires and releases the entry for key.
+func use(t *testing.T, c *Cache, key string, size int) bool {
+	t.Helper()
+	lease := acquire(t, c, key, size)
+	lease.Release()
+	return lease.Hit
+}
+
+func newCache(t *testing.T, dir string, maxBytes int64) *Cache {
+	t.Helper()
+	c, err := New("test", dir, maxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// entryDirs lists the directories below the cache root.
+func entryDirs(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestEvictionOrder(t *testing.T) {
+	dir := t.TempDir()
+	c := newCache(t, dir, 25)
+
+	use(t, c, "a", 10)
+	use(t, c, "b", 10)
+	if !use(t, c, "a", 10) {
+		t.Error("second use of a missed")
+	}
+
+	// b is least recently used
+	use(t, c, "c", 10)
+	if got, want := c.Keys(), []string{"c", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Keys() = %v, want %v", got, want)
+	}
+	if use(t, c, "b", 10) {
+		t.Error("evicted b hit")
+	}
+	if got, want := c.Keys(), []string{"b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Keys() = %v, want %v", got, want)
+	}
+	if got := c.Stats().Evictions; got != 2 {
+		t.Errorf("evictions = %d, want 2", got)
+	}
+
+	// Evicted entries leave nothing behind
+	if got := entryDirs(t, dir); len(got) != 2 {
+		t.Errorf("cache directory holds %v, want the two cached entries", got)
+	}
+
+	// The order survives reopening, and leftovers of evictions are removed
+	if err := os.MkdirAll(filepath.Join(dir, evictedPrefix+"1-leftover", dataDirName), 0755); err != nil {
+		t.Fatal(err)
+	}
+	c = newCache(t, dir, 25)
+	if got, want := c.Keys(), []string{"b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("reopened Keys() = %v, want %v", got, want)
+	}
+	if got := entryDirs(t, dir); len(got) != 2 {
+		t.Errorf("reopened cache directory holds %v, want the two cached entries", got)
+	}
+}
+
+func TestSizeLimit(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		maxBytes int64
+		sizes    []int
+		want     []string
+		bytes    int64
+	}{
+		{"within limit", 30, []int{10, 10, 10}, []string{"e2", "e1", "e0"}, 30},
+		{"one over", 29, []int{10, 10, 10}, []string{"e2", "e1"}, 20},
+		{"large entry evicts several", 30, []int{10, 10, 25}, []string{"e2"}, 25},
+		{"entry above limit", 20, []int{10, 30}, []string{}, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newCache(t, t.TempDir(), tc.maxBytes)
+			for i, size := range tc.sizes {
+				use(t, c, fmt.Sprintf("e%d", i), size)
+			}
+			if got := c.Keys(); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Keys() = %v, want %v", got, tc.want)
+			}
+			if got := c.Stats().Bytes; got != tc.bytes {
+				t.Errorf("bytes = %d, want %d", got, tc.bytes)
+			}
+		})
+	}
+}
+
+func TestLeasedEntriesNotEvicted(t *testing.T) {
+	c := newCache(t, t.TempDir(), 15)
+
+	held := acquire(t, c, "held", 10)
+	use(t, c, "other", 10)
+	if got, want := c.Keys(), []string{"held"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Keys() = %v, want %v", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(held.Dir, "content")); err != nil {
+		t.Errorf("leased entry content: %v", err)
+	}
+
+	// Growing while leased counts once released
+	if err := os.WriteFile(filepath.Join(held.Dir, "more"), make([]byte, 10), 0644); err != nil {
+		t.Fatal(err)
+	}
+	held.Release()
+	if got := c.Stats(); got.Entries != 0 || got.Bytes != 0 {
+		t.Errorf("stats = %+v, want the grown entry evicted", got)
+	}
+}
+
+func TestCounters(t *testing.T) {
+	c := newCache(t, t.TempDir(), 100)
+
+	use(t, c, "a", 10)
+	use(t, c, "a", 10)
+	shared, err := c.AcquireShared("a", fillWith("a", 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !shared.Hit {
+		t.Error("shared lease of cached entry missed")
+	}
+	shared.Release()
+	shared.Release() // Releasing twice is harmless
+
+	failed := fmt.Errorf("fill failed")
+	if _, err := c.Acquire("b", func(string) error { return failed }); err != failed {
+		t.Errorf("Acquire with failing fill error = %v, want %v", err, failed)
+	}
+	use(t, c, "c", 10)
+
+	got := c.Stats()
+	want := Stats{Name: "test", Entries: 2, Bytes: 20, MaxBytes: 100, Hits: 2, Misses: 3}
+	if got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+}
+
+func TestConcurrentAcquire(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		maxBytes int64
+	}{
+		{"without eviction", 1000},
+		{"with eviction", 25},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newCache(t, t.TempDir(), tc.maxBytes)
+			keys := []string{"a", "b", "c", "d"}
+			var fills atomic.Int64
+
+			var wg sync.WaitGroup
+			for worker := 0; worker < 8; worker++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < 50; i++ {
+						key := keys[(worker+i)%len(keys)]
+						fill := func(dir string) error {
+							fills.Add(1)
+							return fillWith(key, 10)(dir)
+						}
+						var lease *Lease
+						var err error
+						if i%2 == 0 {
+							lease, err = c.AcquireShared(key, fill)
+						} else {
+							lease, err = c.Acquire(key, fill)
+						}
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						data, err := os.ReadFile(filepath.Join(lease.Dir, "content"))
+						if err != nil || string(data) != strings.Repeat(key, 10) {
+							t.Errorf("entry %s content = %q, %v", key, data, err)
+						}
+						lease.Release()
+					}
+				}()
+			}
+			wg.Wait()
+
+			stats := c.Stats()
+			if stats.Hits+stats.Misses != 8*50 || stats.Misses != fills.Load() {
+				t.Errorf("stats = %+v after %d fills, want a hit or miss per lease", stats, fills.Load())
+			}
+			if stats.Bytes > tc.maxBytes || stats.Bytes != 10*int64(stats.Entries) {
+				t.Errorf("stats = %+v, want the entries within the limit", stats)
+			}
+			if tc.maxBytes > 10*int64(len(keys)) && fills.Load() != int64(len(keys)) {
+				t.Errorf("filled %d times, want once per key", fills.Load())
+			}
+		})
+	}
+}
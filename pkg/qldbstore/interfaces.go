@@ -12,4 +12,8 @@ type Store interface {
 	// GetDatabase: return the database as a byte slice for the specified repository.
 	// The slice is a CodeQL database -- a zip archive to be processed by the CodeQL CLI.
 	GetDatabase(location common.NameWithOwner) ([]byte, error)
+
+	// GetDatabaseInfo: describe the database GetDatabase would currently return,
+	// without fetching its content.
+	GetDatabaseInfo(location common.NameWithOwner) (DatabaseInfo, error)
 }
@@ -388,40 +388,11 @@ func (h *HepcStore) GetDatabase(location common.NameWithOwner) ([]byte, error) {
 	           → (body, nil)
 	*/
 
-	h.cacheMutex.Lock()
-	if time.Since(h.cacheLastUpdated) > h.cacheDuration {
-		results, err := h.fetchMetadata()
-		if err != nil {
-			slog.Error("error refreshing metadata cache", "error", err)
-			h.cacheMutex.Unlock()
-			return nil, fmt.Errorf("error refreshing metadata cache: %w", err)
-		}
-		h.metadataCache = results
-		h.cacheLastUpdated = time.Now()
-	}
-	cachedResults := h.metadataCache
-	h.cacheMutex.Unlock()
-
-	key := fmt.Sprintf("%s/%s", location.Owner, location.Repo)
-
-	var resultURL string
-	for _, result := range cachedResults {
-		// TODO:  handle cid-containing names properly.
-		// The original info may just be owner=Serial-Studio repo=Serial-Studio; this is legacy behavior.
-		// After retrieval, the full CID-using name, e.g.
-		// 		http://hepc:8070/db/db-collection-host.tmp/Serial-Studio-Serial-Studio-ctsj-2b2721.zip
-		// will be used implicitly.
-		// The correct incoming repo name is Serial-Studio-ctsj-2b2721 -- it includes the CID
-		if result.Projname == key {
-			resultURL = result.ResultURL
-			break
-		}
-	}
-
-	if resultURL == "" {
-		slog.Error("database not found in metadata", "repo", key)
-		return nil, fmt.Errorf("database not found for repository: %s", key)
+	result, err := h.lookupResult(location)
+	if err != nil {
+		return nil, err
 	}
+	resultURL := result.ResultURL
 
 	resp, err := http.Get(replaceHepcURL(resultURL))
 	if err != nil {
@@ -467,6 +438,52 @@ func (h *HepcStore) GetDatabase(location common.NameWithOwner) ([]byte, error) {
 	return fullBody, nil
 }
 
+func (h *HepcStore) GetDatabaseInfo(location common.NameWithOwner) (DatabaseInfo, error) {
+	result, err := h.lookupResult(location)
+	if err != nil {
+		return DatabaseInfo{}, err
+	}
+	return DatabaseInfo{
+		CommitID:   result.GitCommitID,
+		IngestedAt: result.IngestionDatetime,
+	}, nil
+}
+
+// lookupResult finds the metadata entry for location, refreshing the
+// metadata cache first if it has expired.
+func (h *HepcStore) lookupResult(location common.NameWithOwner) (HepcResult, error) {
+	h.cacheMutex.Lock()
+	if time.Since(h.cacheLastUpdated) > h.cacheDuration {
+		results, err := h.fetchMetadata()
+		if err != nil {
+			slog.Error("error refreshing metadata cache", "error", err)
+			h.cacheMutex.Unlock()
+			return HepcResult{}, fmt.Errorf("error refreshing metadata cache: %w", err)
+		}
+		h.metadataCache = results
+		h.cacheLastUpdated = time.Now()
+	}
+	cachedResults := h.metadataCache
+	h.cacheMutex.Unlock()
+
+	key := fmt.Sprintf("%s/%s", location.Owner, location.Repo)
+
+	for _, result := range cachedResults {
+		// TODO:  handle cid-containing names properly.
+		// The original info may just be owner=Serial-Studio repo=Serial-Studio; this is legacy behavior.
+		// After retrieval, the full CID-using name, e.g.
+		// 		http://hepc:8070/db/db-collection-host.tmp/Serial-Studio-Serial-Studio-ctsj-2b2721.zip
+		// will be used implicitly.
+		// The correct incoming repo name is Serial-Studio-ctsj-2b2721 -- it includes the CID
+		if result.Projname == key && result.ResultURL != "" {
+			return result, nil
+		}
+	}
+
+	slog.Error("database not found in metadata", "repo", key)
+	return HepcResult{}, fmt.Errorf("database not found for repository: %s", key)
+}
+
 // replaceHepcURL replaces the fixed "http://hepc" with the value from
 // MRVA_HEPC_ENDPOINT
 func replaceHepcURL(originalURL string) string {
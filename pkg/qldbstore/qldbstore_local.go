@@ -5,6 +5,7 @@ import (
 	"github.com/hohn/mrvacommander/pkg/common"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 type FilesystemCodeQLDatabaseStore struct {
@@ -55,3 +56,24 @@ func (store *FilesystemCodeQLDatabaseStore) GetDatabase(location common.NameWith
 	}
 	return data, nil
 }
+
+func (store *FilesystemCodeQLDatabaseStore) GetDatabaseInfo(location common.NameWithOwner) (DatabaseInfo, error) {
+
+	// Form the file path
+	filePath := filepath.Join(store.basePath,
+		fmt.Sprintf("%s/%s/%s_%s_db.zip", location.Owner, location.Repo, location.Owner, location.Repo))
+
+	// The file carries no commit; its modification time and size identify
+	// the version.
+	info, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return DatabaseInfo{}, fmt.Errorf("database not found for %s", location)
+	}
+	if err != nil {
+		return DatabaseInfo{}, err
+	}
+
+	return DatabaseInfo{
+		IngestedAt: fmt.Sprintf("%s-%d", info.ModTime().UTC().Format(time.RFC3339Nano), info.Size()),
+	}, nil
+}
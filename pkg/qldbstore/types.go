@@ -0,0 +1,15 @@
+package qldbstore
+
+import "fmt"
+
+// DatabaseInfo identifies one stored version of a repository's database.
+// Two infos with equal Identity() refer to the same database content.
+type DatabaseInfo struct {
+	CommitID   string // commit the database was built from, if known
+	IngestedAt string // when the store received this version
+}
+
+// Identity returns a string that changes whenever the stored database does.
+func (info DatabaseInfo) Identity() string {
+	return fmt.Sprintf("%s@%s", info.CommitID, info.IngestedAt)
+}
@@ -0,0 +1,312 @@
+// Package querypack inspects the query pack archives sent with variant
+// analysis submissions, so malformed packs are rejected before any job is
+// queued.
+package querypack
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Limits on the decompressed archive.  Real packs, including their bundled
+// library dependencies, stay far below these.
+const (
+	maxUncompressedBytes = 512 << 20 // 512 MB
+	maxEntries           = 50000
+	maxPackFileBytes     = 1 << 20 // qlpack.yml / codeql-pack.yml
+)
+
+// Pack file names, in the order the CLI looks for them.
+var packFileNames = []string{"qlpack.yml", "codeql-pack.yml"}
+
+// languageAliases maps alternative language names to the name used in the
+// standard library pack names (codeql/<language>-all).
+var languageAliases = map[string]string{
+	"c":                     "cpp",
+	"c-cpp":                 "cpp",
+	"c++":                   "cpp",
+	"c#":                    "csharp",
+	"java-kotlin":           "java",
+	"kotlin":                "java",
+	"javascript-typescript": "javascript",
+	"typescript":            "javascript",
+}
+
+// Info describes a valid query pack.
+type Info struct {
+	Name    string
+	Version string
+	// Language is derived from the pack's codeql/<language>-all or
+	// codeql/<language>-queries dependencies; empty if there are none.
+	Language string
+	// Queries are the archive paths of the queries in the pack itself,
+	// excluding bundled dependencies.
+	Queries []string
+	// ContentHash is the SHA-256 of the archive's file names and contents.
+	// Unlike a hash of the archive, it does not depend on compression,
+	// timestamps or the order of entries.
+	ContentHash string
+}
+
+// packFile is the part of qlpack.yml / codeql-pack.yml we check.
+type packFile struct {
+	Name         string            `yaml:"name"`
+	Version      string            `yaml:"version"`
+	Dependencies map[string]string `yaml:"dependencies"`
+	// Model packs only; dataExtensions is a glob or a list of globs.
+	ExtensionTargets map[string]string `yaml:"extensionTargets"`
+	DataExtensions   interface{}       `yaml:"dataExtensions"`
+}
+
+// NormalizeLanguage returns the canonical name of a CodeQL language.
+func NormalizeLanguage(language string) string {
+	language = strings.ToLower(strings.TrimSpace(language))
+	if canonical, ok := languageAliases[language]; ok {
+		return canonical
+	}
+	return language
+}
+
+// Inspect checks that tgz is a well-formed query pack archive and describes it.
+func Inspect(tgz []byte) (Info, error) {
+	info, _, err := inspect(tgz)
+	if err != nil {
+		return Info{}, err
+	}
+	if len(info.Queries) == 0 {
+		return Info{}, errors.New("query pack contains no queries")
+	}
+	return info, nil
+}
+
+// InspectModelPack checks that tgz is a well-formed model pack archive, one
+// with data extensions adding sources, sinks and summaries, and describes
+// it.  Its language comes from the packs the extensions target.
+func InspectModelPack(tgz []byte) (Info, error) {
+	info, pf, err := inspect(tgz)
+	if err != nil {
+		return Info{}, err
+	}
+	if pf.DataExtensions == nil {
+		return Info{}, fmt.Errorf("model pack %s declares no dataExtensions", info.Name)
+	}
+	if len(pf.ExtensionTargets) > 0 {
+		info.Language, err = dependencyLanguage(pf.ExtensionTargets)
+		if err != nil {
+			return Info{}, fmt.Errorf("model pack %s: extension targets: %w", info.Name, err)
+		}
+	}
+	return info, nil
+}
+
+// inspect validates the archive and its pack file.
+func inspect(tgz []byte) (Info, packFile, error) {
+	gzr, err := gzip.NewReader(bytes.NewReader(tgz))
+	if err != nil {
+		return Info{}, packFile{}, fmt.Errorf("query pack is not gzip-compressed: %w", err)
+	}
+	defer gzr.Close()
+
+	// Read one byte past the limit to detect oversized archives
+	limited := &io.LimitedReader{R: gzr, N: maxUncompressedBytes + 1}
+	tr := tar.NewReader(limited)
+
+	var info Info
+	packFiles := map[string][]byte{}
+	fileHashes := map[string][]byte{}
+	entries := 0
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if limited.N <= 0 {
+				return Info{}, packFile{}, fmt.Errorf("query pack exceeds %d bytes uncompressed", maxUncompressedBytes)
+			}
+			return Info{}, packFile{}, fmt.Errorf("query pack is not a valid tar archive: %w", err)
+		}
+
+		entries++
+		if entries > maxEntries {
+			return Info{}, packFile{}, fmt.Errorf("query pack has more than %d entries", maxEntries)
+		}
+
+		name, err := cleanEntryName(header.Name)
+		if err != nil {
+			return Info{}, packFile{}, err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			continue
+		case tar.TypeReg:
+		default:
+			return Info{}, packFile{}, fmt.Errorf("query pack entry %q is not a regular file or directory", header.Name)
+		}
+
+		h := sha256.New()
+		var content io.Reader = tr
+		if isPackFileName(name) {
+			data, err := io.ReadAll(io.LimitReader(tr, maxPackFileBytes+1))
+			if err != nil {
+				return Info{}, packFile{}, fmt.Errorf("failed to read %s: %w", name, err)
+			}
+			if len(data) > maxPackFileBytes {
+				return Info{}, packFile{}, fmt.Errorf("%s exceeds %d bytes", name, maxPackFileBytes)
+			}
+			packFiles[name] = data
+			content = bytes.NewReader(data)
+		}
+		if _, err := io.Copy(h, content); err != nil {
+			if limited.N <= 0 {
+				return Info{}, packFile{}, fmt.Errorf("query pack exceeds %d bytes uncompressed", maxUncompressedBytes)
+			}
+			return Info{}, packFile{}, fmt.Errorf("query pack is not a valid tar archive: %w", err)
+		}
+		fileHashes[name] = h.Sum(nil)
+
+		// Bundled dependencies live under .codeql/
+		if (strings.HasSuffix(name, ".ql") || strings.HasSuffix(name, ".qlx")) &&
+			!strings.HasPrefix(name, ".codeql/") {
+			info.Queries = append(info.Queries, name)
+		}
+	}
+
+	// Drain the remainder so trailing data counts against the limit
+	if _, err := io.Copy(io.Discard, tr); err != nil {
+		return Info{}, packFile{}, fmt.Errorf("query pack is not a valid tar archive: %w", err)
+	}
+	if limited.N <= 0 {
+		return Info{}, packFile{}, fmt.Errorf("query pack exceeds %d bytes uncompressed", maxUncompressedBytes)
+	}
+
+	var packFileName string
+	for _, candidate := range packFileNames {
+		if _, ok := packFiles[candidate]; ok {
+			packFileName = candidate
+			break
+		}
+	}
+	if packFileName == "" {
+		return Info{}, packFile{}, errors.New("query pack has no qlpack.yml or codeql-pack.yml at its root")
+	}
+
+	var pf packFile
+	if err := yaml.Unmarshal(packFiles[packFileName], &pf); err != nil {
+		return Info{}, packFile{}, fmt.Errorf("failed to parse %s: %w", packFileName, err)
+	}
+	if pf.Name == "" {
+		return Info{}, packFile{}, fmt.Errorf("%s has no pack name", packFileName)
+	}
+	info.Name = pf.Name
+	info.Version = pf.Version
+
+	info.Language, err = dependencyLanguage(pf.Dependencies)
+	if err != nil {
+		return Info{}, packFile{}, fmt.Errorf("%s: %w", packFileName, err)
+	}
+
+	sort.Strings(info.Queries)
+	info.ContentHash = contentHash(fileHashes)
+
+	return info, pf, nil
+}
+
+// contentHash combines the hashes of the files, by name.
+func contentHash(fileHashes map[string][]byte) string {
+	names := make([]string, 0, len(fileHashes))
+	for name := range fileHashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s\x00%x\n", name, fileHashes[name])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// CheckLanguage reports an error if the pack targets a different language
+// than the submission.
+func (info Info) CheckLanguage(language string) error {
+	if info.Language == "" {
+		return nil
+	}
+	if NormalizeLanguage(language) != info.Language {
+		return fmt.Errorf("query pack %s depends on %s libraries but the submission language is %q",
+			info.Name, info.Language, language)
+	}
+	return nil
+}
+
+// cleanEntryName rejects entry names that would escape the extraction
+// directory and returns the name relative to the archive root.
+func cleanEntryName(name string) (string, error) {
+	if strings.Contains(name, "\\") {
+		return "", fmt.Errorf("illegal file path in query pack: %s", name)
+	}
+	if path.IsAbs(name) {
+		return "", fmt.Errorf("illegal absolute path in query pack: %s", name)
+	}
+	cleaned := path.Clean(name)
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("illegal file path in query pack: %s", name)
+	}
+	return cleaned, nil
+}
+
+func isPackFileName(name string) bool {
+	for _, candidate := range packFileNames {
+		if name == candidate {
+			return true
+		}
+	}
+	return false
+}
+
+// dependencyLanguage derives the pack's language from its dependencies on
+// the standard library and query packs.
+func dependencyLanguage(dependencies map[string]string) (string, error) {
+	languages := map[string]bool{}
+	for dep := range dependencies {
+		lib, ok := strings.CutPrefix(dep, "codeql/")
+		if !ok {
+			continue
+		}
+		for _, suffix := range []string{"-all", "-queries"} {
+			if language, ok := strings.CutSuffix(lib, suffix); ok {
+				languages[NormalizeLanguage(language)] = true
+			}
+		}
+	}
+
+	switch len(languages) {
+	case 0:
+		return "", nil
+	case 1:
+		for language := range languages {
+			return language, nil
+		}
+	}
+
+	var names []string
+	for language := range languages {
+		names = append(names, language)
+	}
+	sort.Strings(names)
+	return "", fmt.Errorf("dependencies target several languages: %s", strings.Join(names, ", "))
+}
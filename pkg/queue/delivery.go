@@ -0,0 +1,49 @@
+package queue
+
+// JobDelivery is a job taken from the queue by an agent.  The queue keeps
+// the job until the agent calls exactly one of Complete, Requeue or Return,
+// so a job whose agent dies is delivered again.
+type JobDelivery struct {
+	Job AnalyzeJob
+
+	complete func(result AnalyzeResult) error
+	requeue  func() error
+	ret      func() error
+}
+
+// Complete publishes the job's result and then removes the job from the
+// queue.  If the result cannot be published, the job is returned to the
+// queue instead.
+func (d JobDelivery) Complete(result AnalyzeResult) error {
+	return d.complete(result)
+}
+
+// Requeue returns a job the worker took up but could not run, for
+// instance for lack of disk space, to the queue for any agent to take.  It
+// counts as an attempt; see maxJobRequeues.
+func (d JobDelivery) Requeue() error {
+	return d.requeue()
+}
+
+// Return gives back a job no worker took up, such as a prefetched job of a
+// stopping worker.  Unlike Requeue, it does not count as an attempt.
+func (d JobDelivery) Return() error {
+	return d.ret()
+}
+
+// ResultDelivery is a result taken from the queue by the server.  The queue
+// keeps the result until the server calls Ack, so a result the server did
+// not store before it stopped is delivered again.
+type ResultDelivery struct {
+	Result AnalyzeResult
+
+	ack func() error
+}
+
+// Ack removes the result from the queue, once the server stored it.
+func (d ResultDelivery) Ack() error {
+	if d.ack == nil {
+		return nil
+	}
+	return d.ack()
+}
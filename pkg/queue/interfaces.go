@@ -1,7 +1,60 @@
 package queue
 
+import "time"
+
 type Queue interface {
+	// Jobs takes the jobs the server publishes.
 	Jobs() chan AnalyzeJob
-	Results() chan AnalyzeResult
+	// Deliveries hands jobs to agents, each to be completed with its result
+	// or requeued; see JobDelivery.
+	Deliveries() chan JobDelivery
+	// Results delivers the agents' results to the server, each to be
+	// acknowledged once stored; see ResultDelivery.  A result may be
+	// delivered more than once.
+	Results() chan ResultDelivery
 	Close()
 }
+
+// AgentReporter is implemented by queues through which agents send their
+// heartbeats to the server.  Queues that route jobs to the agent already
+// holding the job's database use the reported databases.
+type AgentReporter interface {
+	// ReportAgent sends a report for this agent, filling in its ID and the
+	// time sent.
+	ReportAgent(report AgentReport) error
+}
+
+// AgentReportSource is implemented by queues that deliver agents' reports
+// to the server.
+type AgentReportSource interface {
+	Reports() chan AgentReport
+}
+
+// DepthReporter is implemented by queues that can tell how many jobs are
+// waiting, for agents to size their worker pools.
+type DepthReporter interface {
+	// Depth returns the number of jobs waiting for this agent.
+	Depth() (int, error)
+}
+
+// DeadLetterQueue is implemented by queues that keep the messages they could
+// not process, such as unparseable jobs and results, or jobs whose agents
+// stopped on every attempt.
+type DeadLetterQueue interface {
+	// DeadLetters lists the dead letters, oldest first.
+	DeadLetters() ([]DeadLetter, error)
+	// RequeueDeadLetter returns a dead letter to the queue it came from.
+	RequeueDeadLetter(id string) error
+	// DiscardDeadLetter removes one dead letter.
+	DiscardDeadLetter(id string) error
+	// PurgeDeadLetters removes all dead letters, returning how many.
+	PurgeDeadLetters() (int, error)
+}
+
+// JobRetrier is implemented by queues that can hold a job back before
+// delivering it again.  Unlike a send on Jobs(), a retry pending when the
+// queue is closed is dropped rather than sent on a closed queue.
+type JobRetrier interface {
+	// RetryJob publishes the job once delay has passed.
+	RetryJob(job AnalyzeJob, delay time.Duration) error
+}
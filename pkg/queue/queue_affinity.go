@@ -0,0 +1,98 @@
+package queue
+
+import (
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	agentsQueueName = "agents"
+
+	// AgentReportInterval is how often agents report the databases they hold
+	// and the jobs they run.
+	AgentReportInterval = 30 * time.Second
+
+	// agentReportTTL is how long a report counts after it was received.
+	agentReportTTL = 3 * AgentReportInterval
+
+	// affinityDelay is how long a job waits in the queue of the agent holding
+	// its database before it falls back to the shared jobs queue.
+	affinityDelay = 10 * time.Second
+
+	// agentQueueExpiry removes the queue of an agent that stopped consuming it.
+	agentQueueExpiry = 10 * time.Minute
+
+	// reportBufferSize bounds the agent reports waiting for the server.
+	reportBufferSize = 100
+)
+
+// agentQueueName is the name of the queue only the given agent consumes.
+func agentQueueName(agentID string) string {
+	return jobsQueueName + "." + agentID
+}
+
+// declareAgentQueue declares the queue for jobs routed to one agent.
+// Messages not picked up within affinityDelay are dead-lettered to the shared
+// jobs queue, so a busy or vanished agent never holds on to a job.  The queue
+// is durable like the jobs queue, and an unused one still expires.
+func declareAgentQueue(ch *amqp.Channel, agentID string) error {
+	_, err := ch.QueueDeclare(agentQueueName(agentID), true, false, false, false, amqp.Table{
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": jobsQueueName,
+		"x-message-ttl":             affinityDelay.Milliseconds(),
+		"x-expires":                 agentQueueExpiry.Milliseconds(),
+	})
+	return err
+}
+
+// databaseAffinity records which agents reported holding which databases.
+type databaseAffinity struct {
+	mu     sync.Mutex
+	agents map[string]agentDatabases
+}
+
+type agentDatabases struct {
+	repos map[common.NameWithOwner]struct{}
+	seen  time.Time
+}
+
+// update replaces what is known about the reporting agent.
+func (a *databaseAffinity) update(report AgentReport) {
+	repos := make(map[common.NameWithOwner]struct{}, len(report.Databases))
+	for _, nwo := range report.Databases {
+		repos[nwo] = struct{}{}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.agents == nil {
+		a.agents = make(map[string]agentDatabases)
+	}
+	a.agents[report.AgentID] = agentDatabases{repos: repos, seen: time.Now()}
+}
+
+// agentFor picks one of the agents that recently reported holding the
+// database for nwo.
+func (a *databaseAffinity) agentFor(nwo common.NameWithOwner) (string, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var candidates []string
+	for id, agent := range a.agents {
+		if time.Since(agent.seen) > agentReportTTL {
+			delete(a.agents, id)
+			continue
+		}
+		if _, ok := agent.repos[nwo]; ok {
+			candidates = append(candidates, id)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+	return candidates[rand.IntN(len(candidates))], true
+}
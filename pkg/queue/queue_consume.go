@@ -0,0 +1,151 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	// resubscribeDelay is how long a consumer waits before subscribing again
+	// after its channel or connection was lost.
+	resubscribeDelay = 5 * time.Second
+
+	// resultsPrefetch bounds the results pushed to the server ahead of it
+	// storing them.
+	resultsPrefetch = 16
+)
+
+// subscription is a channel consuming one or more queues.  Each consumer
+// has a channel of its own, so its prefetch limit applies to it alone and
+// losing it leaves the publishers' channel intact.
+type subscription struct {
+	ch       *amqp.Channel
+	messages chan amqp.Delivery
+
+	// held counts the messages handed on but not yet acknowledged; see
+	// hold.
+	mu   sync.Mutex
+	held int
+}
+
+// subscribe opens a channel on the current connection, reconnecting if
+// needed, and consumes queueNames on it.  The messages of all queues arrive
+// on one channel, which is closed when the subscription is lost or ctx is
+// cancelled.
+//
+// Messages not acknowledged automatically are limited to prefetch for the
+// whole channel, so consumers of several queues share the limit.
+func (q *RabbitMQQueue) subscribe(ctx context.Context, prefetch int, autoAck bool,
+	queueNames ...string) (*subscription, error) {
+	if err := q.reconnectIfNeeded(); err != nil {
+		return nil, err
+	}
+	q.mu.Lock()
+	conn := q.conn
+	q.mu.Unlock()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open channel: %w", err)
+	}
+	if !autoAck {
+		if err := ch.Qos(prefetch, 0, true); err != nil {
+			ch.Close()
+			return nil, fmt.Errorf("failed to set QoS: %w", err)
+		}
+	}
+
+	sub := &subscription{ch: ch, messages: make(chan amqp.Delivery)}
+	var wg sync.WaitGroup
+	for _, queueName := range queueNames {
+		msgs, err := ch.Consume(queueName, "", autoAck, false, false, false, nil)
+		if err != nil {
+			ch.Close()
+			return nil, fmt.Errorf("failed to consume %s: %w", queueName, err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for msg := range msgs {
+				select {
+				case sub.messages <- msg:
+				case <-ctx.Done():
+					// Unacknowledged messages are requeued when the
+					// channel closes
+					return
+				}
+			}
+		}()
+	}
+	lost := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(sub.messages)
+		close(lost)
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			ch.Close()
+		case <-lost:
+		}
+	}()
+	return sub, nil
+}
+
+// hold records that a message was handed on and will be acknowledged later,
+// and lets the broker push one more.  The prefetch limit thus stays one
+// above the messages held, so a consumer whose messages take long to
+// process keeps no more than one waiting that another could take.
+func (s *subscription) hold() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.held++
+	s.setPrefetch()
+}
+
+// release records that a held message was acknowledged or rejected.
+func (s *subscription) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.held--
+	s.setPrefetch()
+}
+
+func (s *subscription) setPrefetch() {
+	// A worker may release a message before it was recorded as held
+	if err := s.ch.Qos(max(s.held+1, 1), 0, true); err != nil && !s.ch.IsClosed() {
+		slog.Warn("failed to adjust prefetch", slog.Int("held", s.held), slog.Any("error", err))
+	}
+}
+
+// consume passes the messages of queueNames to handle until ctx is
+// cancelled, subscribing again whenever the subscription is lost.
+func (q *RabbitMQQueue) consume(ctx context.Context, prefetch int, autoAck bool,
+	handle func(sub *subscription, msg amqp.Delivery), queueNames ...string) {
+	for {
+		sub, err := q.subscribe(ctx, prefetch, autoAck, queueNames...)
+		if err != nil {
+			slog.Error("failed to subscribe", slog.Any("queues", queueNames), slog.Any("error", err))
+		} else {
+			slog.Info("Subscribed", slog.Any("queues", queueNames))
+			for msg := range sub.messages {
+				handle(sub, msg)
+			}
+			if ctx.Err() == nil {
+				slog.Warn("Subscription lost", slog.Any("queues", queueNames))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(resubscribeDelay):
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hohn/mrvacommander/pkg/common"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	// deadLettersName names both the exchange messages are dead-lettered to
+	// and the queue keeping them.
+	deadLettersName = "dead-letters"
+
+	// maxJobRequeues is how often workers may take up a job and requeue it
+	// without completing it before the job is dead-lettered.
+	maxJobRequeues = 3
+
+	// maxListedDeadLetters bounds the dead letters inspected at once.
+	maxListedDeadLetters = 1000
+
+	// Headers recording why and from where a message was dead-lettered, and
+	// how often a job was requeued.
+	headerReason         = "x-mrva-reason"
+	headerSourceQueue    = "x-mrva-source-queue"
+	headerDeadLetteredAt = "x-mrva-dead-lettered-at"
+	headerAttempts       = "x-mrva-attempts"
+)
+
+// ErrDeadLetterNotFound is returned for an ID not among the dead letters.
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// declareDeadLetters declares the exchange dead letters are published to
+// and the queue keeping them.
+func declareDeadLetters(ch *amqp.Channel) error {
+	err := ch.ExchangeDeclare(deadLettersName, amqp.ExchangeFanout, true, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("failed to declare dead letter exchange: %w", err)
+	}
+	if _, err := ch.QueueDeclare(deadLettersName, true, false, false, false, nil); err != nil {
+		return fmt.Errorf("failed to declare dead letter queue: %w", err)
+	}
+	if err := ch.QueueBind(deadLettersName, "", deadLettersName, false, nil); err != nil {
+		return fmt.Errorf("failed to bind dead letter queue: %w", err)
+	}
+	return nil
+}
+
+// deadLetter moves a message taken from sourceQueue to the dead letters,
+// recording the reason and how often it was delivered.
+func (q *RabbitMQQueue) deadLetter(msg amqp.Delivery, sourceQueue, reason string, attempts int) error {
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[headerReason] = reason
+	headers[headerAttempts] = int64(attempts)
+	headers[headerSourceQueue] = sourceQueue
+	headers[headerDeadLetteredAt] = time.Now().UTC().Format(time.RFC3339)
+
+	slog.Warn("Dead-lettering message", slog.String("queue", sourceQueue), slog.String("reason", reason))
+	err := q.publish(deadLettersName, "", amqp.Publishing{
+		Headers:      headers,
+		ContentType:  msg.ContentType,
+		DeliveryMode: amqp.Persistent,
+		MessageId:    uuid.New().String(),
+		Body:         msg.Body,
+	})
+	if err != nil {
+		// Rejected messages are dropped, so keep it until it can be moved
+		_ = msg.Nack(false, true)
+		return fmt.Errorf("failed to dead-letter message: %w", err)
+	}
+	return msg.Ack(false)
+}
+
+// requeuedJob decides about a job a worker took up and requeued.  It
+// republishes the job counting the attempt, or dead-letters it and
+// publishes a failed result once it was requeued maxJobRequeues times.
+// Either way the message is settled.
+func (q *RabbitMQQueue) requeuedJob(job AnalyzeJob, msg amqp.Delivery, queueName string) error {
+	attempts, exhausted := countRequeue(msg)
+	if !exhausted {
+		slog.Warn("Job requeued by its worker",
+			slog.Any("job", job.Spec), slog.Int("requeues", attempts))
+		return q.republishJob(msg, attempts)
+	}
+
+	reason := fmt.Sprintf("requeued %d times without being completed", attempts)
+	if err := q.deadLetter(msg, queueName, reason, attempts); err != nil {
+		return err
+	}
+	return q.publishResult(resultsQueueName, AnalyzeResult{
+		Spec:     job.Spec,
+		Status:   common.StatusFailed,
+		Attempts: job.Attempts,
+		Diagnostic: &common.Diagnostic{
+			Kind:    common.DiagnosticUnknown,
+			Message: "no agent could run the analysis; the job was " + reason,
+		},
+	})
+}
+
+// countRequeue returns the requeues of a job message, counting one more,
+// and whether they reached maxJobRequeues.  Only the header counts: whether
+// the broker redelivered the message says nothing about the job having run.
+func countRequeue(msg amqp.Delivery) (int, bool) {
+	attempts := headerInt(msg.Headers, headerAttempts) + 1
+	return attempts, attempts >= maxJobRequeues
+}
+
+// republishJob publishes a copy of a job message with the given count of
+// requeues to the shared jobs queue and acknowledges the original.
+func (q *RabbitMQQueue) republishJob(msg amqp.Delivery, attempts int) error {
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[headerAttempts] = int64(attempts)
+
+	err := q.publish("", jobsQueueName, amqp.Publishing{
+		Headers:      headers,
+		ContentType:  msg.ContentType,
+		DeliveryMode: amqp.Persistent,
+		Body:         msg.Body,
+	})
+	if err != nil {
+		_ = msg.Nack(false, true)
+		return fmt.Errorf("failed to requeue job: %w", err)
+	}
+	return msg.Ack(false)
+}
+
+// headerInt returns an integer header, or 0 if it is missing.
+func headerInt(headers amqp.Table, key string) int {
+	switch v := headers[key].(type) {
+	case int:
+		return v
+	case int8:
+		return int(v)
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	}
+	return 0
+}
+
+func headerString(headers amqp.Table, key string) string {
+	s, _ := headers[key].(string)
+	return s
+}
+
+func newDeadLetter(msg amqp.Delivery) DeadLetter {
+	d := DeadLetter{
+		ID:          msg.MessageId,
+		SourceQueue: headerString(msg.Headers, headerSourceQueue),
+		Reason:      headerString(msg.Headers, headerReason),
+		Attempts:    headerInt(msg.Headers, headerAttempts),
+		Body:        msg.Body,
+	}
+	d.DeadLetteredAt, _ = time.Parse(time.RFC3339, headerString(msg.Headers, headerDeadLetteredAt))
+	return d
+}
+
+// deadLettersChannel opens a channel for inspecting the dead letters.  The
+// caller holds deadLettersMu: inspecting takes the messages from the queue,
+// and another inspection must not find it empty meanwhile.
+func (q *RabbitMQQueue) deadLettersChannel() (*amqp.Channel, error) {
+	if err := q.reconnectIfNeeded(); err != nil {
+		return nil, err
+	}
+	q.mu.Lock()
+	conn := q.conn
+	q.mu.Unlock()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open channel: %w", err)
+	}
+	return ch, nil
+}
+
+// browseDeadLetters passes the dead letters, oldest first, to visit until it
+// returns true.  Closing the channel afterwards returns those visit did not
+// acknowledge to the queue, in their order.
+func (q *RabbitMQQueue) browseDeadLetters(visit func(msg amqp.Delivery) (bool, error)) error {
+	q.deadLettersMu.Lock()
+	defer q.deadLettersMu.Unlock()
+
+	ch, err := q.deadLettersChannel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	for i := 0; i < maxListedDeadLetters; i++ {
+		msg, ok, err := ch.Get(deadLettersName, false)
+		if err != nil {
+			return fmt.Errorf("failed to get dead letter: %w", err)
+		}
+		if !ok {
+			return nil
+		}
+		if done, err := visit(msg); done || err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeadLetters lists the dead letters, oldest first, up to
+// maxListedDeadLetters.
+func (q *RabbitMQQueue) DeadLetters() ([]DeadLetter, error) {
+	var letters []DeadLetter
+	err := q.browseDeadLetters(func(msg amqp.Delivery) (bool, error) {
+		letters = append(letters, newDeadLetter(msg))
+		return false, nil
+	})
+	return letters, err
+}
+
+// RequeueDeadLetter publishes a dead letter to the queue it came from again,
+// with its attempts reset, and removes it from the dead letters.
+func (q *RabbitMQQueue) RequeueDeadLetter(id string) error {
+	found := false
+	err := q.browseDeadLetters(func(msg amqp.Delivery) (bool, error) {
+		if msg.MessageId != id {
+			return false, nil
+		}
+		found = true
+
+		queueName := headerString(msg.Headers, headerSourceQueue)
+		if queueName == "" {
+			return true, fmt.Errorf("dead letter %s does not record its queue", id)
+		}
+		headers := amqp.Table{}
+		for k, v := range msg.Headers {
+			switch k {
+			case headerReason, headerSourceQueue, headerDeadLetteredAt, headerAttempts:
+			default:
+				headers[k] = v
+			}
+		}
+		err := q.publish("", queueName, amqp.Publishing{
+			Headers:      headers,
+			ContentType:  msg.ContentType,
+			DeliveryMode: amqp.Persistent,
+			Body:         msg.Body,
+		})
+		if err != nil {
+			return true, fmt.Errorf("failed to requeue dead letter: %w", err)
+		}
+		slog.Info("Requeued dead letter", slog.String("id", id), slog.String("queue", queueName))
+		return true, msg.Ack(false)
+	})
+	if err == nil && !found {
+		return ErrDeadLetterNotFound
+	}
+	return err
+}
+
+// DiscardDeadLetter removes one dead letter.
+func (q *RabbitMQQueue) DiscardDeadLetter(id string) error {
+	found := false
+	err := q.browseDeadLetters(func(msg amqp.Delivery) (bool, error) {
+		if msg.MessageId != id {
+			return false, nil
+		}
+		found = true
+		slog.Info("Discarding dead letter", slog.String("id", id))
+		return true, msg.Ack(false)
+	})
+	if err == nil && !found {
+		return ErrDeadLetterNotFound
+	}
+	return err
+}
+
+// PurgeDeadLetters removes all dead letters, returning how many there were.
+func (q *RabbitMQQueue) PurgeDeadLetters() (int, error) {
+	q.deadLettersMu.Lock()
+	defer q.deadLettersMu.Unlock()
+
+	ch, err := q.deadLettersChannel()
+	if err != nil {
+		return 0, err
+	}
+	defer ch.Close()
+
+	purged, err := ch.QueuePurge(deadLettersName, false)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge dead letters: %w", err)
+	}
+	slog.Warn("Purged dead letters", slog.Int("count", purged))
+	return purged, nil
+}
@@ -0,0 +1,48 @@
+package queue
+
+import (
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestCountRequeue(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		msg           amqp.Delivery
+		wantAttempts  int
+		wantExhausted bool
+	}{
+		{
+			name:         "first requeue",
+			msg:          amqp.Delivery{},
+			wantAttempts: 1,
+		},
+		{
+			// A prefetched job the broker redelivered several times, for
+			// instance after shutdowns, has not run
+			name:         "redelivered without running",
+			msg:          amqp.Delivery{Redelivered: true},
+			wantAttempts: 1,
+		},
+		{
+			name:         "requeued before",
+			msg:          amqp.Delivery{Headers: amqp.Table{headerAttempts: int64(1)}},
+			wantAttempts: 2,
+		},
+		{
+			name:          "last requeue",
+			msg:           amqp.Delivery{Headers: amqp.Table{headerAttempts: int32(maxJobRequeues - 1)}},
+			wantAttempts:  maxJobRequeues,
+			wantExhausted: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			attempts, exhausted := countRequeue(tc.msg)
+			if attempts != tc.wantAttempts || exhausted != tc.wantExhausted {
+				t.Errorf("countRequeue() = %d, %v, want %d, %v",
+					attempts, exhausted, tc.wantAttempts, tc.wantExhausted)
+			}
+		})
+	}
+}
@@ -4,21 +4,50 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"os"
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	amqp "github.com/rabbitmq/amqp091-go"
 	"golang.org/x/exp/slog"
 )
 
+const (
+	// XX: static typing?
+	jobsQueueName    = "tasks"
+	resultsQueueName = "results"
+
+	// publishTimeout bounds publishing a message and awaiting its
+	// confirmation.
+	publishTimeout = 10 * time.Second
+
+	// publishRetryDelay is how long a job whose publication failed waits
+	// before it is published again.
+	publishRetryDelay = 5 * time.Second
+)
+
 type RabbitMQQueue struct {
-	jobs    chan AnalyzeJob
-	results chan AnalyzeResult
-	conn    *amqp.Connection
-	channel *amqp.Channel
+	jobs       chan AnalyzeJob
+	deliveries chan JobDelivery
+	results    chan ResultDelivery
+	reports    chan AgentReport
+	conn       *amqp.Connection
+	channel    *amqp.Channel
 
 	mu         sync.Mutex
 	connString string
+
+	// deadLettersMu serializes inspecting the dead letters.
+	deadLettersMu sync.Mutex
+
+	// cancel stops the consumers.
+	cancel context.CancelFunc
+
+	// agentID names this agent's own jobs queue; empty on the server.
+	agentID string
+	// affinity routes jobs on the server.
+	affinity databaseAffinity
 }
 
 // NewRabbitMQQueue initializes a RabbitMQ queue.
@@ -28,19 +57,24 @@ type RabbitMQQueue struct {
 // Otherwise, the queue is initialized to be used by the server.
 // The difference in behaviour is that the agent consumes jobs and publishes results,
 // while the server publishes jobs and consumes results.
+//
+// Each agent also consumes a queue of its own, to which the server routes jobs
+// whose database the agent reported holding.
+//
+// The jobs and results queues are durable and their messages persistent.
+// If migrateQueues is true, queues declared differently by an earlier
+// version are redeclared, keeping their messages; see declareQueues.
 func NewRabbitMQQueue(
 	host string,
 	port int16,
 	user string,
 	password string,
 	isAgent bool,
+	migrateQueues bool,
 ) (*RabbitMQQueue, error) {
 	const (
 		tryCount      = 5
 		retryDelaySec = 3
-		// XX: static typing?
-		jobsQueueName    = "tasks"
-		resultsQueueName = "results"
 	)
 
 	var conn *amqp.Connection
@@ -68,42 +102,43 @@ func NewRabbitMQQueue(
 
 	slog.Info("Connected to RabbitMQ")
 
-	ch, err := conn.Channel()
+	ch, err := publishingChannel(conn)
 	if err != nil {
 		conn.Close()
-		return nil, fmt.Errorf("failed to open a channel: %w", err)
+		return nil, err
 	}
 
-	_, err = ch.QueueDeclare(jobsQueueName, false, false, false, true, nil)
-	if err != nil {
+	if err := declareQueues(conn, migrateQueues); err != nil {
 		conn.Close()
-		return nil, fmt.Errorf("failed to declare tasks queue: %w", err)
+		return nil, err
 	}
 
-	_, err = ch.QueueDeclare(resultsQueueName, false, false, false, true, nil)
-	if err != nil {
-		conn.Close()
-		return nil, fmt.Errorf("failed to declare results queue: %w", err)
-	}
-
-	err = ch.Qos(1, 0, false)
-	if err != nil {
-		conn.Close()
-		return nil, fmt.Errorf("failed to set QoS: %w", err)
+	var agentID string
+	if isAgent {
+		agentID = newAgentID()
+		if err := declareAgentQueue(ch, agentID); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to declare agent queue: %w", err)
+		}
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	result := RabbitMQQueue{
 		conn:       conn,
 		channel:    ch,
 		jobs:       make(chan AnalyzeJob),
-		results:    make(chan AnalyzeResult),
+		deliveries: make(chan JobDelivery),
+		results:    make(chan ResultDelivery),
+		reports:    make(chan AgentReport, reportBufferSize),
 		mu:         sync.Mutex{},
 		connString: rabbitMQURL,
+		cancel:     cancel,
+		agentID:    agentID,
 	}
 
 	if isAgent {
 		slog.Info("Starting tasks consumer")
-		go result.ConsumeJobs(jobsQueueName)
+		go result.ConsumeJobs(ctx, agentQueueName(agentID), jobsQueueName)
 
 		slog.Info("Starting results publisher")
 		go result.PublishResults(resultsQueueName)
@@ -112,7 +147,10 @@ func NewRabbitMQQueue(
 		go result.PublishJobs(jobsQueueName)
 
 		slog.Info("Starting results consumer")
-		go result.ConsumeResults(resultsQueueName)
+		go result.ConsumeResults(ctx, resultsQueueName)
+
+		slog.Info("Starting agent reports consumer")
+		go result.ConsumeReports(ctx, agentsQueueName)
 	}
 
 	return &result, nil
@@ -122,21 +160,75 @@ func (q *RabbitMQQueue) Jobs() chan AnalyzeJob {
 	return q.jobs
 }
 
-func (q *RabbitMQQueue) Results() chan AnalyzeResult {
+func (q *RabbitMQQueue) Results() chan ResultDelivery {
 	return q.results
 }
 
+func (q *RabbitMQQueue) Deliveries() chan JobDelivery {
+	return q.deliveries
+}
+
+// Depth returns the number of jobs ready in the shared jobs queue and this
+// agent's own queue.  It uses a channel of its own, since inspecting a
+// missing queue closes the channel.
+func (q *RabbitMQQueue) Depth() (int, error) {
+	if err := q.reconnectIfNeeded(); err != nil {
+		return 0, err
+	}
+	q.mu.Lock()
+	conn := q.conn
+	q.mu.Unlock()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return 0, fmt.Errorf("failed to open channel: %w", err)
+	}
+	defer ch.Close()
+
+	queueNames := []string{jobsQueueName}
+	if q.agentID != "" {
+		queueNames = append(queueNames, agentQueueName(q.agentID))
+	}
+	var depth int
+	for _, queueName := range queueNames {
+		info, err := ch.QueueDeclarePassive(queueName, false, false, false, false, nil)
+		if err != nil {
+			return 0, fmt.Errorf("failed to inspect queue %s: %w", queueName, err)
+		}
+		depth += info.Messages
+	}
+	return depth, nil
+}
+
 func (q *RabbitMQQueue) Close() {
-	q.channel.Close()
-	q.conn.Close()
+	q.cancel()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.channel != nil {
+		q.channel.Close()
+	}
+	if q.conn != nil {
+		q.conn.Close()
+	}
 }
 
+// reconnectIfNeeded reopens the publishers' channel if it was closed, and
+// the connection with it if that was lost.
 func (q *RabbitMQQueue) reconnectIfNeeded() error {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 
-	if q.conn != nil && !q.conn.IsClosed() && q.channel != nil {
-		return nil // still valid
+	if q.conn != nil && !q.conn.IsClosed() {
+		if q.channel != nil && !q.channel.IsClosed() {
+			return nil // still valid
+		}
+		// Only the channel was closed, for instance by a failed publish
+		ch, err := publishingChannel(q.conn)
+		if err != nil {
+			return err
+		}
+		q.channel = ch
+		return nil
 	}
 
 	// Recreate everything
@@ -145,208 +237,314 @@ func (q *RabbitMQQueue) reconnectIfNeeded() error {
 		return fmt.Errorf("failed to reconnect: %w", err)
 	}
 
-	ch, err := conn.Channel()
+	ch, err := publishingChannel(conn)
 	if err != nil {
 		conn.Close()
-		return fmt.Errorf("failed to open channel: %w", err)
+		return err
 	}
 
-	// Optional: redeclare queues here
-	// _, _ = ch.QueueDeclare(...)
+	// The broker may have restarted without its definitions
+	if err := declareQueues(conn, false); err != nil {
+		conn.Close()
+		return err
+	}
+	if q.agentID != "" {
+		if err := declareAgentQueue(ch, q.agentID); err != nil {
+			conn.Close()
+			return fmt.Errorf("failed to declare agent queue: %w", err)
+		}
+	}
 
 	q.conn = conn
 	q.channel = ch
 	return nil
 }
 
-func (q *RabbitMQQueue) invalidateConnection() {
+// redeclareAgentQueue declares an agent's queue on a channel of its own: a
+// failed declaration closes its channel, for instance because an agent of an
+// earlier version declared its queue differently, and must not close the
+// publishers' channel under concurrent publishes.
+func (q *RabbitMQQueue) redeclareAgentQueue(agentID string) error {
+	if err := q.reconnectIfNeeded(); err != nil {
+		return err
+	}
 	q.mu.Lock()
-	defer q.mu.Unlock()
+	conn := q.conn
+	q.mu.Unlock()
 
-	if q.channel != nil {
-		_ = q.channel.Close()
-	}
-	if q.conn != nil {
-		_ = q.conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open channel: %w", err)
 	}
-
-	q.channel = nil
-	q.conn = nil
+	defer ch.Close()
+	return declareAgentQueue(ch, agentID)
 }
 
-func (q *RabbitMQQueue) ConsumeJobs(queueName string) {
-	const pollInterval = 5 * time.Second
-
-	// | scenario          | result                                |
-	// |-------------------+---------------------------------------|
-	// | Queue is empty    | msg = zero, ok = false, err = nil     |
-	// | Queue has message | msg = valid, ok = true, err = nil     |
-	// | Connection lost   | msg = zero, ok = false, err = non-nil |
-
-	for {
-
-		if err := q.reconnectIfNeeded(); err != nil {
-			slog.Error("failed to reconnect", slog.Any("error", err))
-			time.Sleep(10 * time.Second)
-			continue
-		}
-
-		msg, ok, err := q.channel.Get(queueName, false) // false = manual ack
-		if err != nil {
-			slog.Error("polling error while getting job", slog.Any("error", err))
-			q.invalidateConnection()
-			time.Sleep(pollInterval)
-			continue
-		}
-
-		if !ok {
-			// No message in queue
-			time.Sleep(pollInterval)
-			continue
-		}
-
+// ConsumeJobs hands the jobs of the given queues to the agent's workers
+// until ctx is cancelled.  The broker pushes a job whenever the previous one
+// was taken by a worker, and holds back the rest for other agents.
+func (q *RabbitMQQueue) ConsumeJobs(ctx context.Context, queueNames ...string) {
+	q.consume(ctx, 1, false, func(sub *subscription, msg amqp.Delivery) {
 		var job AnalyzeJob
 		if err := json.Unmarshal(msg.Body, &job); err != nil {
 			slog.Error("failed to unmarshal job", slog.Any("error", err))
-			_ = msg.Nack(false, false) // do not requeue
-			continue
+			reason := fmt.Sprintf("invalid job: %v", err)
+			if err := q.deadLetter(msg, msg.RoutingKey, reason, 1); err != nil {
+				slog.Error("failed to dead-letter job", slog.Any("error", err))
+			}
+			return
 		}
-
-		// Send job to channel for processing
-		q.jobs <- job
-
-		// Acknowledge successful processing
-		if err := msg.Ack(false); err != nil {
-			slog.Error("failed to ack job message", slog.Any("error", err))
-			continue
+		// The message stays unacknowledged until the job is done, so the
+		// broker delivers it again if this agent dies.  Such a redelivery is
+		// not counted: the message may as well have been waiting in this
+		// agent's prefetch, or been requeued when a channel closed.
+		select {
+		case q.deliveries <- q.newDelivery(sub, job, msg):
+			sub.hold()
+		case <-ctx.Done():
 		}
+	}, queueNames...)
+}
+
+// newDelivery wraps a job message.  Should the channel it came on be gone
+// by the time the job is done, the broker has already requeued the message.
+func (q *RabbitMQQueue) newDelivery(sub *subscription, job AnalyzeJob, msg amqp.Delivery) JobDelivery {
+	return JobDelivery{
+		Job: job,
+		complete: func(result AnalyzeResult) error {
+			defer sub.release()
+			if err := q.publishResult(resultsQueueName, result); err != nil {
+				if nackErr := msg.Nack(false, true); nackErr != nil {
+					slog.Error("failed to requeue job message", slog.Any("error", nackErr))
+				}
+				return err
+			}
+			if err := msg.Ack(false); err != nil {
+				return fmt.Errorf("failed to ack job message: %w", err)
+			}
+			return nil
+		},
+		requeue: func() error {
+			defer sub.release()
+			return q.requeuedJob(job, msg, msg.RoutingKey)
+		},
+		ret: func() error {
+			defer sub.release()
+			return q.republishJob(msg, headerInt(msg.Headers, headerAttempts))
+		},
 	}
 }
 
+// PublishResults publishes results sent to Results() without a delivery,
+// acknowledging each once published.
 func (q *RabbitMQQueue) PublishResults(queueName string) {
-	for result := range q.results {
-		q.publishResult(queueName, result)
+	for d := range q.results {
+		if err := q.publishResult(queueName, d.Result); err != nil {
+			slog.Error("failed to publish result", slog.Any("error", err))
+			continue
+		}
+		if err := d.Ack(); err != nil {
+			slog.Error("failed to acknowledge result", slog.Any("error", err))
+		}
 	}
 }
 
-func (q *RabbitMQQueue) publishResult(queueName string, result AnalyzeResult) {
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-	defer cancel()
-
+func (q *RabbitMQQueue) publishResult(queueName string, result AnalyzeResult) error {
 	resultBytes, err := json.Marshal(result)
 	if err != nil {
-		slog.Error("failed to marshal result", slog.Any("error", err))
-		return
+		return fmt.Errorf("failed to marshal result: %w", err)
 	}
 
-	// Enable publisher confirms on the channel
-	err = q.channel.Confirm(false)
+	slog.Debug("Publishing result", slog.String("result", string(resultBytes)))
+	err = q.publish("", queueName, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		Body:         resultBytes,
+	})
 	if err != nil {
-		slog.Error("Failed to enable publisher confirms", slog.Any("error", err))
+		return fmt.Errorf("failed to publish result: %w", err)
 	}
+	return nil
+}
 
-	// Set up a confirmation channel.  This uses a large capacity to avoid blocking.
-	confirmChannelSize := 99999
-	confirmations := q.channel.NotifyPublish(make(chan amqp.Confirmation, confirmChannelSize))
-
-	// Publish the message
-	slog.Debug("Publishing result", slog.String("result", string(resultBytes)))
-	err = q.channel.PublishWithContext(ctx, "", queueName, false, false,
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        resultBytes,
-		})
+func (q *RabbitMQQueue) publishJob(queueName string, job AnalyzeJob) error {
+	jobBytes, err := json.Marshal(job)
 	if err != nil {
-		slog.Error("failed to publish result", slog.Any("error", err))
+		return fmt.Errorf("failed to marshal job: %w", err)
 	}
 
-	// Wait for the confirmation
-	confirm := <-confirmations
-	if !confirm.Ack {
-		slog.Error("Publish result message confirmation failed")
+	slog.Debug("Publishing job", slog.String("job", string(jobBytes)))
+	err = q.publish("", queueName, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		Body:         jobBytes,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish job: %w", err)
 	}
-
+	return nil
 }
 
-func (q *RabbitMQQueue) publishJob(queueName string, job AnalyzeJob) {
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+// publish publishes a message on the publishers' channel, reconnecting
+// first if needed, and waits for the broker to confirm it.  The channel is
+// in confirm mode from its creation, and each publish waits for its own
+// confirmation, so concurrent publishes need no further locking.
+func (q *RabbitMQQueue) publish(exchange, key string, msg amqp.Publishing) error {
+	if err := q.reconnectIfNeeded(); err != nil {
+		return err
+	}
+	q.mu.Lock()
+	ch := q.channel
+	q.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
 	defer cancel()
 
-	jobBytes, err := json.Marshal(job)
+	// A closed channel is reopened by the next publish
+	confirmation, err := ch.PublishWithDeferredConfirmWithContext(ctx, exchange, key, false, false, msg)
 	if err != nil {
-		slog.Error("failed to marshal job", slog.Any("error", err))
-		return
+		return err
 	}
-
-	// Enable publisher confirms on the channel
-	err = q.channel.Confirm(false)
+	acked, err := confirmation.WaitContext(ctx)
 	if err != nil {
-		slog.Error("Failed to enable publisher confirms", slog.Any("error", err))
+		return fmt.Errorf("publication not confirmed: %w", err)
 	}
+	if !acked {
+		return fmt.Errorf("publication rejected by broker")
+	}
+	return nil
+}
 
-	// Set up a confirmation channel.  This uses a large capacity to avoid
-	// blocking server requests.
-	confirmChannelSize := 99999
-	confirmations := q.channel.NotifyPublish(make(chan amqp.Confirmation, confirmChannelSize))
-
-	// Publish the job
-	slog.Debug("Publishing job", slog.String("job", string(jobBytes)))
-	err = q.channel.PublishWithContext(ctx, "", queueName, false, false,
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        jobBytes,
-		})
+// publishingChannel opens the publishers' channel on conn, in confirm mode.
+func publishingChannel(conn *amqp.Connection) (*amqp.Channel, error) {
+	ch, err := conn.Channel()
 	if err != nil {
-		slog.Error("failed to publish job", slog.Any("error", err))
+		return nil, fmt.Errorf("failed to open channel: %w", err)
 	}
-
-	// Wait for the confirmation
-	confirm := <-confirmations
-	if !confirm.Ack {
-		slog.Error("Publish result message confirmation failed")
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("failed to enable publisher confirms: %w", err)
 	}
-
+	return ch, nil
 }
 
+// PublishJobs publishes the jobs sent to Jobs().  A job is retried until the
+// broker confirms it, so that it stays pending rather than being lost while
+// the broker is unavailable.
 func (q *RabbitMQQueue) PublishJobs(queueName string) {
 	for job := range q.jobs {
-		q.publishJob(queueName, job)
+		for {
+			err := q.publishJob(q.routeJob(queueName, job), job)
+			if err == nil {
+				break
+			}
+			slog.Error("failed to publish job, retrying",
+				slog.Any("job", job.Spec), slog.Any("error", err))
+			time.Sleep(publishRetryDelay)
+		}
 	}
 }
 
-func (q *RabbitMQQueue) ConsumeResults(queueName string) {
-	autoAck := false // false = manual ack
-	sleepFor := 5    // polling interval
+// routeJob picks the queue of an agent that reported holding the job's
+// database, or queueName if there is none.
+func (q *RabbitMQQueue) routeJob(queueName string, job AnalyzeJob) string {
+	agentID, ok := q.affinity.agentFor(job.Spec.NameWithOwner)
+	if !ok {
+		return queueName
+	}
 
-	for {
+	// Declaring is idempotent and makes sure the job is not dropped if the
+	// agent's queue has expired; it then falls back after affinityDelay.
+	if err := q.redeclareAgentQueue(agentID); err != nil {
+		slog.Warn("failed to declare agent queue, using shared queue",
+			slog.String("agent", agentID), slog.Any("error", err))
+		return queueName
+	}
 
-		if err := q.reconnectIfNeeded(); err != nil {
-			slog.Error("failed to reconnect", slog.Any("error", err))
-			time.Sleep(10 * time.Second)
-			continue
-		}
+	slog.Debug("Routing job by database affinity",
+		slog.Any("job", job.Spec), slog.String("agent", agentID))
+	return agentQueueName(agentID)
+}
 
-		msg, ok, err := q.channel.Get(queueName, autoAck)
-		if err != nil {
-			slog.Error("poll error", slog.Any("err", err))
-			time.Sleep(time.Duration(sleepFor) * time.Second)
-			continue
+// ReportAgent publishes an AgentReport for this agent.
+func (q *RabbitMQQueue) ReportAgent(report AgentReport) error {
+	report.AgentID = q.agentID
+	report.SentAt = time.Now()
+	reportBytes, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to marshal agent report: %w", err)
+	}
+
+	err = q.publish("", agentsQueueName, amqp.Publishing{
+		ContentType: "application/json",
+		Body:        reportBytes,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish agent report: %w", err)
+	}
+	return nil
+}
+
+// Reports returns the agent reports received by the server.
+func (q *RabbitMQQueue) Reports() chan AgentReport {
+	return q.reports
+}
+
+// ConsumeReports keeps the database affinity up to date from agent reports
+// and passes the reports on to Reports() until ctx is cancelled.
+func (q *RabbitMQQueue) ConsumeReports(ctx context.Context, queueName string) {
+	q.consume(ctx, 0, true, func(_ *subscription, msg amqp.Delivery) { // reports may be lost
+		var report AgentReport
+		if err := json.Unmarshal(msg.Body, &report); err != nil {
+			slog.Error("unmarshal error", slog.Any("err", err))
+			return
 		}
-		if !ok {
-			// no message
-			time.Sleep(time.Duration(sleepFor) * time.Second)
-			continue
+
+		slog.Debug("Agent report consumed",
+			slog.String("agent", report.AgentID), slog.Int("databases", len(report.Databases)),
+			slog.Int("running_jobs", len(report.RunningJobs)))
+		q.affinity.update(report)
+
+		select {
+		case q.reports <- report:
+		default:
+			slog.Warn("Dropping agent report; server is not consuming reports",
+				slog.String("agent", report.AgentID))
 		}
+	}, queueName)
+}
 
+// newAgentID returns an ID that is unique per agent process.
+func newAgentID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "agent"
+	}
+	return fmt.Sprintf("%s-%s", host, uuid.New().String()[:8])
+}
+
+// ConsumeResults passes results on to Results() until ctx is cancelled.
+// Each stays unacknowledged until the server stored it, so the broker
+// delivers it again should the server stop before.
+func (q *RabbitMQQueue) ConsumeResults(ctx context.Context, queueName string) {
+	q.consume(ctx, resultsPrefetch, false, func(_ *subscription, msg amqp.Delivery) {
 		var result AnalyzeResult
 		if err := json.Unmarshal(msg.Body, &result); err != nil {
 			slog.Error("unmarshal error", slog.Any("err", err))
-			_ = msg.Nack(false, false) // finish .Get() with nack
-			continue
+			reason := fmt.Sprintf("invalid result: %v", err)
+			if err := q.deadLetter(msg, queueName, reason, 1); err != nil {
+				slog.Error("failed to dead-letter result", slog.Any("error", err))
+			}
+			return
 		}
 
-		q.results <- result
-		_ = msg.Ack(false) // finish .Get() with nack
-	}
-
+		d := ResultDelivery{
+			Result: result,
+			ack:    func() error { return msg.Ack(false) },
+		}
+		select {
+		case q.results <- d:
+		case <-ctx.Done():
+		}
+	}, queueName)
 }
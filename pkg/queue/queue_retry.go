@@ -0,0 +1,67 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"golang.org/x/exp/slog"
+)
+
+// retryQueueName names the queue holding jobs back for delay.
+func retryQueueName(delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%d", jobsQueueName, delay.Milliseconds())
+}
+
+// declareRetryQueue declares the queue holding jobs back for delay.  Its
+// messages expire into the shared jobs queue.  Each delay has a queue of its
+// own, since a message expires only at the head of its queue, and an unused
+// one is removed once its last job has left.
+func declareRetryQueue(ch *amqp.Channel, delay time.Duration) error {
+	_, err := ch.QueueDeclare(retryQueueName(delay), true, false, false, false, amqp.Table{
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": jobsQueueName,
+		"x-message-ttl":             delay.Milliseconds(),
+		"x-expires":                 (2*delay + time.Minute).Milliseconds(),
+	})
+	return err
+}
+
+// RetryJob publishes the job to the retry queue for delay, from which the
+// broker moves it to the shared jobs queue once delay has passed.  Without
+// a delay, it publishes the job to the shared jobs queue at once.
+func (q *RabbitMQQueue) RetryJob(job AnalyzeJob, delay time.Duration) error {
+	if delay <= 0 {
+		return q.publishJob(jobsQueueName, job)
+	}
+	if err := q.reconnectIfNeeded(); err != nil {
+		return err
+	}
+	jobBytes, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("failed to marshal job: %w", err)
+	}
+
+	q.mu.Lock()
+	conn := q.conn
+	q.mu.Unlock()
+
+	// A failed declaration closes its channel
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open channel: %w", err)
+	}
+	err = declareRetryQueue(ch, delay)
+	ch.Close()
+	if err != nil {
+		return fmt.Errorf("failed to declare retry queue: %w", err)
+	}
+
+	slog.Debug("Publishing job for retry", slog.Any("job", job.Spec), slog.Duration("delay", delay))
+	return q.publish("", retryQueueName(delay), amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		Body:         jobBytes,
+	})
+}
@@ -1,29 +1,132 @@
 package queue
 
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// singleAgentID names the agent sharing a QueueSingle with the server.
+const singleAgentID = "local"
+
 type QueueSingle struct {
 	NumWorkers int
 	jobs       chan AnalyzeJob
-	results    chan AnalyzeResult
+	deliveries chan JobDelivery
+	results    chan ResultDelivery
+	reports    chan AgentReport
+
+	// done is closed by Close, which waits for the pending retries to
+	// give up before closing jobs.
+	done    chan struct{}
+	retries *sync.WaitGroup
 }
 
 func NewQueueSingle(numWorkers int) Queue {
 	q := QueueSingle{
 		NumWorkers: numWorkers,
 		jobs:       make(chan AnalyzeJob, 10),
-		results:    make(chan AnalyzeResult, 10),
+		deliveries: make(chan JobDelivery),
+		results:    make(chan ResultDelivery, 10),
+		reports:    make(chan AgentReport, 10),
+		done:       make(chan struct{}),
+		retries:    &sync.WaitGroup{},
 	}
+	go q.deliver()
 	return q
 }
 
+// deliver hands the published jobs to the in-process workers.
+func (q QueueSingle) deliver() {
+	defer close(q.deliveries)
+	for job := range q.jobs {
+		q.deliveries <- JobDelivery{
+			Job: job,
+			complete: func(result AnalyzeResult) error {
+				q.results <- ResultDelivery{Result: result}
+				return nil
+			},
+			requeue: func() error {
+				return q.requeue(job)
+			},
+			ret: func() error {
+				return q.requeue(job)
+			},
+		}
+	}
+}
+
 func (q QueueSingle) Jobs() chan AnalyzeJob {
 	return q.jobs
 }
 
-func (q QueueSingle) Results() chan AnalyzeResult {
+func (q QueueSingle) Deliveries() chan JobDelivery {
+	return q.deliveries
+}
+
+func (q QueueSingle) Results() chan ResultDelivery {
 	return q.results
 }
 
+// requeue returns the job to the queue as soon as there is room, unless
+// the queue is closed first.  It does not wait: the worker returning the
+// job may be the one that would make room.
+func (q QueueSingle) requeue(job AnalyzeJob) error {
+	return q.RetryJob(job, 0)
+}
+
+// RetryJob queues the job once delay has passed, unless the queue is
+// closed first.
+func (q QueueSingle) RetryJob(job AnalyzeJob, delay time.Duration) error {
+	select {
+	case <-q.done:
+		return errors.New("queue is closed")
+	default:
+	}
+
+	q.retries.Add(1)
+	go func() {
+		defer q.retries.Done()
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-q.done:
+			return
+		}
+		select {
+		case q.jobs <- job:
+		case <-q.done:
+		}
+	}()
+	return nil
+}
+
+// ReportAgent passes the report to the server, dropping it if the server
+// is behind; reports are periodic.
+func (q QueueSingle) ReportAgent(report AgentReport) error {
+	report.AgentID = singleAgentID
+	report.SentAt = time.Now()
+	select {
+	case q.reports <- report:
+		return nil
+	default:
+		return errors.New("agent report queue is full")
+	}
+}
+
+func (q QueueSingle) Reports() chan AgentReport {
+	return q.reports
+}
+
+// Depth returns the number of buffered jobs.
+func (q QueueSingle) Depth() (int, error) {
+	return len(q.jobs), nil
+}
+
 func (q QueueSingle) Close() {
+	close(q.done)
+	q.retries.Wait()
 	close(q.jobs)
 	close(q.results)
 }
@@ -0,0 +1,187 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"golang.org/x/exp/slog"
+)
+
+// queueSpec is how a queue is declared.  The server, the agents and
+// init/rabbitmq/definitions.json must agree on it, since the broker refuses
+// to redeclare a queue with different properties.
+type queueSpec struct {
+	name       string
+	durable    bool
+	autoDelete bool
+	args       amqp.Table
+}
+
+// sharedQueues are the queues both the server and the agents declare.  Jobs
+// and results are durable and published persistent, so they survive a broker
+// restart; agent reports are periodic and expire anyway.
+var sharedQueues = []queueSpec{
+	{name: jobsQueueName, durable: true},
+	{name: resultsQueueName, durable: true},
+	{name: agentsQueueName, args: amqp.Table{
+		"x-message-ttl": agentReportTTL.Milliseconds(),
+	}},
+}
+
+// migratingSuffix names the queue holding the messages of a queue while it
+// is redeclared.
+const migratingSuffix = ".migrating"
+
+func (s queueSpec) declare(ch *amqp.Channel) error {
+	_, err := ch.QueueDeclare(s.name, s.durable, s.autoDelete, false, false, s.args)
+	return err
+}
+
+// declareQueues declares the shared queues and the dead letters.  A queue
+// declared differently by an earlier version, such as a non-durable jobs
+// queue, is redeclared if migrate is set and is an error otherwise.
+func declareQueues(conn *amqp.Connection, migrate bool) error {
+	for _, spec := range sharedQueues {
+		if err := declareQueue(conn, spec, migrate); err != nil {
+			return fmt.Errorf("failed to declare %s queue: %w", spec.name, err)
+		}
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	return declareDeadLetters(ch)
+}
+
+func declareQueue(conn *amqp.Connection, spec queueSpec, migrate bool) error {
+	// A failed declaration closes its channel, so each gets its own
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	err = spec.declare(ch)
+	ch.Close()
+
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) && amqpErr.Code == amqp.PreconditionFailed {
+		if !migrate {
+			return fmt.Errorf("%w; the queue was declared by an earlier version, "+
+				"start one process with MRVA_RABBITMQ_MIGRATE_QUEUES=1 to redeclare it", err)
+		}
+		return migrateQueue(conn, spec)
+	}
+	if err != nil || !migrate {
+		return err
+	}
+
+	// Finish a migration that was interrupted after its queue was redeclared
+	if exists, err := queueExists(conn, spec.name+migratingSuffix); err != nil || !exists {
+		return err
+	}
+	return migrateQueue(conn, spec)
+}
+
+// migrateQueue redeclares a queue as spec, keeping its messages.  They are
+// moved to a durable holding queue while the queue is deleted and declared
+// again, so an interrupted migration loses no messages and is finished by
+// the next one.
+func migrateQueue(conn *amqp.Connection, spec queueSpec) error {
+	slog.Warn("Migrating queue to its current declaration",
+		slog.String("queue", spec.name), slog.Bool("durable", spec.durable))
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	if err := ch.Confirm(false); err != nil {
+		return fmt.Errorf("failed to enable publisher confirms: %w", err)
+	}
+
+	holding := queueSpec{name: spec.name + migratingSuffix, durable: true}
+	if err := holding.declare(ch); err != nil {
+		return fmt.Errorf("failed to declare holding queue: %w", err)
+	}
+
+	oldExists, err := queueExists(conn, spec.name)
+	if err != nil {
+		return err
+	}
+	if oldExists {
+		moved, err := moveMessages(ch, spec.name, holding.name)
+		if err != nil {
+			return err
+		}
+		slog.Info("Moved messages to holding queue",
+			slog.String("queue", spec.name), slog.Int("messages", moved))
+		if _, err := ch.QueueDelete(spec.name, false, false, false); err != nil {
+			return fmt.Errorf("failed to delete queue: %w", err)
+		}
+	}
+
+	if err := spec.declare(ch); err != nil {
+		return err
+	}
+	moved, err := moveMessages(ch, holding.name, spec.name)
+	if err != nil {
+		return err
+	}
+	if _, err := ch.QueueDelete(holding.name, false, true, false); err != nil {
+		return fmt.Errorf("failed to delete holding queue: %w", err)
+	}
+	slog.Info("Migrated queue", slog.String("queue", spec.name), slog.Int("messages", moved))
+	return nil
+}
+
+// moveMessages republishes the messages of one queue, persistent, to
+// another.  Each is acknowledged only after the broker confirmed its copy.
+func moveMessages(ch *amqp.Channel, from, to string) (int, error) {
+	confirmations := ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	var moved int
+	for {
+		msg, ok, err := ch.Get(from, false)
+		if err != nil {
+			return moved, fmt.Errorf("failed to get message from %s: %w", from, err)
+		}
+		if !ok {
+			return moved, nil
+		}
+
+		err = ch.Publish("", to, false, false, amqp.Publishing{
+			Headers:      msg.Headers,
+			ContentType:  msg.ContentType,
+			DeliveryMode: amqp.Persistent,
+			Body:         msg.Body,
+		})
+		if err != nil {
+			return moved, fmt.Errorf("failed to publish message to %s: %w", to, err)
+		}
+		if confirm := <-confirmations; !confirm.Ack {
+			return moved, fmt.Errorf("message to %s not confirmed by broker", to)
+		}
+		if err := msg.Ack(false); err != nil {
+			return moved, fmt.Errorf("failed to ack message from %s: %w", from, err)
+		}
+		moved++
+	}
+}
+
+// queueExists inspects a queue on a channel of its own, since inspecting a
+// missing queue closes the channel.
+func queueExists(conn *amqp.Connection, name string) (bool, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return false, err
+	}
+	defer ch.Close()
+
+	_, err = ch.QueueDeclarePassive(name, false, false, false, false, nil)
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) && amqpErr.Code == amqp.NotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
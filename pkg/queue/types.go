@@ -1,6 +1,10 @@
 package queue
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
 	"github.com/hohn/mrvacommander/pkg/artifactstore"
 	"github.com/hohn/mrvacommander/pkg/common"
 )
@@ -9,11 +13,49 @@ type QueryLanguage string
 
 // AnalyzeJob represents a job specifying a repository and a query pack to analyze it with.
 // This is the message format that the agent receives from the queue.
+// CLIVersion is the CodeQL CLI version requested by the submission; when
+// empty, the agent picks one matching the database.
+// Attempts are the earlier failed attempts of a retried job; results carry
+// them back.
+// QueryPackHash is the SHA-256 of the query pack's contents; see
+// querypack.Info.ContentHash.
 // TODO: make query_pack_location query_pack_url with a presigned URL
 type AnalyzeJob struct {
 	Spec              common.JobSpec                 // json:"job_spec"
 	QueryPackLocation artifactstore.ArtifactLocation // json:"query_pack_location"
 	QueryLanguage     QueryLanguage                  // json:"query_language"
+	QueryPackHash     string                         // json:"query_pack_hash"
+	CLIVersion        string                         // json:"cli_version"
+	ModelPacks        []ModelPackRef                 // json:"model_packs"
+	ThreatModels      []string                       // json:"threat_models"
+	EvaluatorLog      bool                           // json:"evaluator_log"
+	Attempts          []common.JobAttempt            // json:"attempts"
+}
+
+// AnalysisHash identifies the query pack together with the model packs and
+// threat models customizing it.  Without customizations it is the query pack
+// hash.
+func (job AnalyzeJob) AnalysisHash() string {
+	if len(job.ModelPacks) == 0 && len(job.ThreatModels) == 0 {
+		return job.QueryPackHash
+	}
+	h := sha256.New()
+	h.Write([]byte(job.QueryPackHash))
+	for _, mp := range job.ModelPacks {
+		h.Write([]byte("\x00model-pack\x00" + mp.Name + "\x00" + mp.Hash))
+	}
+	for _, tm := range job.ThreatModels {
+		h.Write([]byte("\x00threat-model\x00" + tm))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ModelPackRef is a model pack stored for a session.  Hash is the SHA-256
+// of its contents; see querypack.Info.ContentHash.
+type ModelPackRef struct {
+	Name     string                         // json:"name"
+	Location artifactstore.ArtifactLocation // json:"location"
+	Hash     string                         // json:"hash"
 }
 
 // AnalyzeResult represents the result of an analysis job.
@@ -27,4 +69,39 @@ type AnalyzeResult struct {
 	ResultLocation       artifactstore.ArtifactLocation // json:"result_location"
 	SourceLocationPrefix string                         // json:"source_location_prefix"
 	DatabaseSHA          string                         // json:"database_sha"
+	DatabaseIdentity     string                         // json:"database_identity"
+	QueryPackHash        string                         // json:"query_pack_hash"
+	AnalysisHash         string                         // json:"analysis_hash"
+	CLIVersion           string                         // json:"cli_version"
+	FromCache            bool                           // json:"from_cache"
+	DatabaseUpgraded     bool                           // json:"database_upgraded"
+	QueryResults         []common.QueryResultCount      // json:"query_results"
+	EvaluatorLogLocation artifactstore.ArtifactLocation // json:"evaluator_log_location"
+	SlowPredicates       []common.PredicateTiming       // json:"slow_predicates"
+	Diagnostic           *common.Diagnostic             // json:"diagnostic"
+	Attempts             []common.JobAttempt            // json:"attempts"
+}
+
+// AgentReport is an agent's heartbeat: the databases it holds in its cache,
+// for routing jobs, and the jobs it is running, for recovering them should
+// the agent stop.
+// This is the message format that agents send to the server.
+type AgentReport struct {
+	AgentID     string                 // json:"agent_id"
+	Databases   []common.NameWithOwner // json:"databases"
+	RunningJobs []common.JobSpec       // json:"running_jobs"
+	Workers     int                    // json:"workers"
+	SentAt      time.Time              // json:"sent_at"
+}
+
+// DeadLetter is a message the server or an agent could not process, kept
+// for inspection.  Attempts counts the deliveries of a job that were never
+// completed.
+type DeadLetter struct {
+	ID             string
+	SourceQueue    string
+	Reason         string
+	Attempts       int
+	DeadLetteredAt time.Time
+	Body           []byte
 }
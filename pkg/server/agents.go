@@ -0,0 +1,220 @@
+package server
+
+import (
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/hohn/mrvacommander/pkg/queue"
+)
+
+const (
+	// agentHeartbeatTimeout is how long an agent may go without a report
+	// before it is considered lost and its running jobs are recovered.
+	agentHeartbeatTimeout = 3 * queue.AgentReportInterval
+
+	// lostAgentRetention is how long a lost agent stays listed.
+	lostAgentRetention = 10 * time.Minute
+
+	// maxOrphanRequeues is how often a job is requeued after losing its
+	// agent before it is failed instead.
+	maxOrphanRequeues = 2
+)
+
+// agentRegistry records the agents that reported to the server.
+type agentRegistry struct {
+	mu     sync.Mutex
+	agents map[string]*agentRecord
+	// orphaned counts how often each job was recovered from a lost agent.
+	orphaned map[common.JobSpec]int
+}
+
+type agentRecord struct {
+	report       queue.AgentReport
+	registeredAt time.Time
+	lastSeen     time.Time
+	lost         bool
+}
+
+// update records a report received at the given time.  The first report of
+// an agent registers it.
+func (r *agentRegistry) update(report queue.AgentReport, received time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.agents == nil {
+		r.agents = make(map[string]*agentRecord)
+	}
+	agent, ok := r.agents[report.AgentID]
+	if !ok {
+		slog.Info("Agent registered", "agent", report.AgentID)
+		agent = &agentRecord{registeredAt: received}
+		r.agents[report.AgentID] = agent
+	} else if agent.lost {
+		slog.Warn("Lost agent reported again", "agent", report.AgentID)
+	}
+	agent.report = report
+	agent.lastSeen = received
+	agent.lost = false
+}
+
+// expire marks the agents silent since before now-agentHeartbeatTimeout as
+// lost, returning the jobs they were running, and forgets agents lost long
+// ago.
+func (r *agentRegistry) expire(now time.Time) []common.JobSpec {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var orphans []common.JobSpec
+	for id, agent := range r.agents {
+		silence := now.Sub(agent.lastSeen)
+		switch {
+		case agent.lost && silence > lostAgentRetention:
+			delete(r.agents, id)
+		case !agent.lost && silence > agentHeartbeatTimeout:
+			slog.Warn("Agent missed its heartbeats", "agent", id,
+				"last_seen", agent.lastSeen, "running_jobs", len(agent.report.RunningJobs))
+			agent.lost = true
+			orphans = append(orphans, agent.report.RunningJobs...)
+		}
+	}
+	return orphans
+}
+
+// recordOrphan counts a recovery of the job and reports whether it may be
+// requeued once more.
+func (r *agentRegistry) recordOrphan(spec common.JobSpec) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.orphaned == nil {
+		r.orphaned = make(map[common.JobSpec]int)
+	}
+	r.orphaned[spec]++
+	return r.orphaned[spec] <= maxOrphanRequeues
+}
+
+// list describes the registered agents by ID.
+func (r *agentRegistry) list() []common.AgentStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	agents := make([]common.AgentStatus, 0, len(r.agents))
+	for id, agent := range r.agents {
+		status := "active"
+		if agent.lost {
+			status = "lost"
+		}
+		running := make([]common.RunningJob, 0, len(agent.report.RunningJobs))
+		for _, spec := range agent.report.RunningJobs {
+			running = append(running, common.RunningJob{
+				SessionId: spec.SessionID,
+				FullName:  spec.Owner + "/" + spec.Repo,
+			})
+		}
+		agents = append(agents, common.AgentStatus{
+			AgentID:         id,
+			Status:          status,
+			RegisteredAt:    agent.registeredAt.Format(time.RFC3339),
+			LastHeartbeat:   agent.lastSeen.Format(time.RFC3339),
+			Workers:         agent.report.Workers,
+			CachedDatabases: len(agent.report.Databases),
+			RunningJobs:     running,
+		})
+	}
+	sort.Slice(agents, func(i, j int) bool {
+		return agents[i].AgentID < agents[j].AgentID
+	})
+	return agents
+}
+
+// ConsumeAgentReports registers agents from their heartbeats and recovers
+// the jobs of agents that stop sending them.
+func (c *CommanderSingle) ConsumeAgentReports() {
+	source, ok := c.v.Queue.(queue.AgentReportSource)
+	if !ok {
+		slog.Warn("Queue does not deliver agent reports; lost jobs will not be recovered")
+		return
+	}
+	slog.Info("Started agent reports consumer.")
+
+	ticker := time.NewTicker(queue.AgentReportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case report := <-source.Reports():
+			c.agents.update(report, time.Now())
+		case now := <-ticker.C:
+			c.recoverOrphanedJobs(now)
+		}
+	}
+}
+
+// recoverOrphanedJobs requeues the unfinished jobs of agents lost by now,
+// or fails those already requeued maxOrphanRequeues times.  An agent that
+// hangs may still hold its jobs, and a broker redelivers them once its
+// connection is gone, so a job can run twice; acceptResult drops the
+// result that comes second.
+func (c *CommanderSingle) recoverOrphanedJobs(now time.Time) {
+	orphans := c.agents.expire(now)
+	for _, spec := range orphans {
+		status, err := c.v.State.GetStatus(spec)
+		if err != nil || status != common.StatusInProgress {
+			// Finished, or already recovered
+			continue
+		}
+
+		if !c.agents.recordOrphan(spec) {
+			slog.Error("Failing job whose agents keep being lost", "job", spec)
+			c.failOrphan(spec, "the analysis was interrupted on every attempt", now)
+			continue
+		}
+
+		job, ok := c.findJob(spec)
+		if !ok {
+			slog.Error("Cannot requeue unknown job", "job", spec)
+			continue
+		}
+		slog.Warn("Requeueing job of lost agent", "job", spec)
+		c.v.State.SetStatus(spec, common.StatusPending)
+		if err := c.requeueJob(job, 0); err != nil {
+			slog.Error("Failed to requeue job of lost agent", "job", spec, "error", err)
+			c.failOrphan(spec, "the analysis was interrupted and could not be requeued", now)
+		}
+	}
+}
+
+// failOrphan fails a job of a lost agent that is not requeued.
+func (c *CommanderSingle) failOrphan(spec common.JobSpec, message string, now time.Time) {
+	result := queue.AnalyzeResult{
+		Spec:   spec,
+		Status: common.StatusFailed,
+		Diagnostic: &common.Diagnostic{
+			Kind:    common.DiagnosticAgentLost,
+			Message: message,
+		},
+		Attempts: c.jobAttempts(spec),
+	}
+	c.recordAttempt(&result, now)
+	c.v.State.SetResult(spec, result)
+	c.v.State.SetStatus(spec, common.StatusFailed)
+	c.jobFinished(spec)
+}
+
+// findJob returns the job queued for spec, with its failed attempts.
+func (c *CommanderSingle) findJob(spec common.JobSpec) (queue.AnalyzeJob, bool) {
+	jobs, err := c.v.State.GetJobList(spec.SessionID)
+	if err != nil {
+		return queue.AnalyzeJob{}, false
+	}
+	for _, job := range jobs {
+		if job.Spec == spec {
+			job.Attempts = c.jobAttempts(spec)
+			return job, true
+		}
+	}
+	return queue.AnalyzeJob{}, false
+}
@@ -12,4 +12,13 @@ type CommanderAPI interface {
 	MRVADownloadArtifact(w http.ResponseWriter, r *http.Request)
 	MRVADownloadQLDB(w http.ResponseWriter, r *http.Request)
 	MRVADownloadServe(w http.ResponseWriter, r *http.Request)
+	MRVAQueryPack(w http.ResponseWriter, r *http.Request)
+	MRVAResultBreakdown(w http.ResponseWriter, r *http.Request)
+	MRVAModelPack(w http.ResponseWriter, r *http.Request)
+	MRVASlowPredicates(w http.ResponseWriter, r *http.Request)
+	MRVAEvaluatorLog(w http.ResponseWriter, r *http.Request)
+	MRVAAgents(w http.ResponseWriter, r *http.Request)
+	MRVADeadLetters(w http.ResponseWriter, r *http.Request)
+	MRVADeadLetter(w http.ResponseWriter, r *http.Request)
+	MRVADeadLetterRequeue(w http.ResponseWriter, r *http.Request)
 }
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/hohn/mrvacommander/pkg/queue"
+)
+
+const (
+	defaultRetryBackoff    = 30 * time.Second
+	defaultMaxRetryBackoff = 30 * time.Minute
+)
+
+// RetryPolicy bounds the retries of jobs that failed for a transient cause,
+// such as an unreachable store; see common.DiagnosticKind.Retryable.  A nil
+// *RetryPolicy fails jobs on their first failure.
+type RetryPolicy struct {
+	// MaxAttempts counts the first attempt.
+	MaxAttempts int
+	// Backoff is the delay before the first retry; it doubles with every
+	// further one up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// NewRetryPolicy allows maxAttempts attempts per job, or returns nil if
+// maxAttempts <= 1.  Zero backoff and maxBackoff select defaults.
+func NewRetryPolicy(maxAttempts int, backoff, maxBackoff time.Duration) *RetryPolicy {
+	if maxAttempts <= 1 {
+		return nil
+	}
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxRetryBackoff
+	}
+	return &RetryPolicy{MaxAttempts: maxAttempts, Backoff: backoff, MaxBackoff: max(backoff, maxBackoff)}
+}
+
+// retryDelay returns the delay before retrying a job after its failed
+// attempts, and whether it is retried at all.
+func (p *RetryPolicy) retryDelay(attempts []common.JobAttempt) (time.Duration, bool) {
+	if p == nil || len(attempts) == 0 || len(attempts) >= p.MaxAttempts {
+		return 0, false
+	}
+	if !attempts[len(attempts)-1].Kind.Retryable() {
+		return 0, false
+	}
+	delay := p.Backoff
+	for i := 1; i < len(attempts) && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, p.MaxBackoff), true
+}
+
+// jobAttempts are the failed attempts recorded for a job.
+func (c *CommanderSingle) jobAttempts(js common.JobSpec) []common.JobAttempt {
+	result, err := c.v.State.GetResult(js)
+	if err != nil {
+		return nil
+	}
+	return result.Attempts
+}
+
+// recordAttempt adds a failed result to the job's attempts and, if the
+// failure is retryable and the policy allows, schedules the job again.  It
+// reports whether the job was retried; the result then only records the
+// attempts.
+func (c *CommanderSingle) recordAttempt(r *queue.AnalyzeResult, now time.Time) bool {
+	if r.Status != common.StatusFailed {
+		return false
+	}
+	attempt := common.JobAttempt{
+		Attempt:  len(r.Attempts) + 1,
+		Kind:     common.DiagnosticUnknown,
+		FailedAt: now.Format(time.RFC3339),
+	}
+	if r.Diagnostic != nil {
+		attempt.Kind = r.Diagnostic.Kind
+		attempt.Message = r.Diagnostic.Summary()
+	}
+	r.Attempts = append(r.Attempts, attempt)
+
+	delay, retry := c.v.Retry.retryDelay(r.Attempts)
+	if !retry {
+		return false
+	}
+	job, ok := c.findJob(r.Spec)
+	if !ok {
+		slog.Error("Cannot retry unknown job", "job", r.Spec)
+		return false
+	}
+	r.Attempts[len(r.Attempts)-1].RetryAt = now.Add(delay).Format(time.RFC3339)
+	job.Attempts = r.Attempts
+
+	slog.Warn("Retrying failed job", "job", r.Spec, "attempt", attempt.Attempt,
+		"kind", attempt.Kind, "delay", delay)
+	c.v.State.SetResult(r.Spec, *r)
+	c.v.State.SetStatus(r.Spec, common.StatusPending)
+
+	if err := c.requeueJob(job, delay); err != nil {
+		slog.Error("Failed to schedule retry", "job", r.Spec, "error", err)
+		r.Attempts[len(r.Attempts)-1].RetryAt = ""
+		return false
+	}
+	return true
+}
+
+// requeueJob queues a job again once delay has passed.  It goes through the
+// queue's own retries, which the queue stops when closed; queues without
+// them get the job at once.
+func (c *CommanderSingle) requeueJob(job queue.AnalyzeJob, delay time.Duration) error {
+	if retrier, ok := c.v.Queue.(queue.JobRetrier); ok {
+		return retrier.RetryJob(job, delay)
+	}
+	c.v.Queue.Jobs() <- job
+	return nil
+}
@@ -10,12 +10,16 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"regexp"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/hohn/mrvacommander/pkg/artifactstore"
 	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/hohn/mrvacommander/pkg/querypack"
 	"github.com/hohn/mrvacommander/pkg/queue"
 	"github.com/hohn/mrvacommander/utils"
 
@@ -24,12 +28,13 @@ import (
 
 func (c *CommanderSingle) startAnalyses(
 	analysisRepos []common.NameWithOwner,
-	queryPackLocation artifactstore.ArtifactLocation,
-	sessionId int,
-	queryLanguage queue.QueryLanguage) {
+	submission SubmissionInfo,
+	sessionId int) []common.NameWithOwner {
 
 	slog.Debug("Queueing analysis jobs", "count", len(analysisRepos))
 
+	var reused []common.NameWithOwner
+	var queued []queue.AnalyzeJob
 	for _, nwo := range analysisRepos {
 		jobSpec := common.JobSpec{
 			SessionID:     sessionId,
@@ -37,16 +42,167 @@ func (c *CommanderSingle) startAnalyses(
 		}
 		info := queue.AnalyzeJob{
 			Spec:              jobSpec,
-			QueryPackLocation: queryPackLocation,
-			QueryLanguage:     queryLanguage,
+			QueryPackLocation: submission.QueryPackLocation,
+			QueryLanguage:     submission.Language,
+			QueryPackHash:     submission.QueryPackHash,
+			CLIVersion:        submission.CLIVersion,
+			ModelPacks:        submission.ModelPacks,
+			ThreatModels:      submission.ThreatModels,
+			EvaluatorLog:      submission.EvaluatorLog,
+		}
+		if c.reuseResult(info) {
+			reused = append(reused, nwo)
+			continue
 		}
-		c.v.Queue.Jobs() <- info
 		c.v.State.SetStatus(jobSpec, common.StatusPending)
 		c.v.State.AddJob(info)
+		queued = append(queued, info)
+	}
+
+	// All jobs are recorded before any is queued, so the session is not
+	// taken for finished when its first jobs are.
+	for _, job := range queued {
+		c.v.Queue.Jobs() <- job
+	}
+	if len(queued) == 0 {
+		// No job will reference the packs
+		c.releasePacks(sessionId, submission.QueryPackLocation, submission.ModelPacks)
+	}
+	return reused
+}
+
+// releasePacks drops the session's references to its query and model packs.
+func (c *CommanderSingle) releasePacks(sessionId int, queryPack artifactstore.ArtifactLocation,
+	modelPacks []queue.ModelPackRef) {
+	if err := c.v.Artifacts.ReleaseQueryPack(sessionId, queryPack); err != nil {
+		slog.Error("Failed to release query pack", "session_id", sessionId, "error", err)
+	}
+	for _, mp := range modelPacks {
+		if err := c.v.Artifacts.ReleaseQueryPack(sessionId, mp.Location); err != nil {
+			slog.Error("Failed to release model pack", "session_id", sessionId,
+				"name", mp.Name, "error", err)
+		}
+	}
+}
+
+// sessionFinished reports whether none of the session's jobs is pending or in
+// progress.
+func (c *CommanderSingle) sessionFinished(sessionId int) bool {
+	summary, err := c.v.State.GetSessionStatus(sessionId)
+	if err != nil {
+		return false
+	}
+	return summary.Counts[common.StatusPending] == 0 && summary.Counts[common.StatusInProgress] == 0
+}
+
+// jobFinished releases the session's packs once the job that just finished
+// was its last one.  It is called once per job, when its status first
+// becomes final.
+func (c *CommanderSingle) jobFinished(js common.JobSpec) {
+	c.releaseFinishedSession(js.SessionID)
+}
+
+// releaseFinishedSession releases the session's packs if none of its jobs
+// can run again: none is pending or in progress, and none is among the dead
+// letters, from which it may be requeued.
+func (c *CommanderSingle) releaseFinishedSession(sessionId int) {
+	if !c.sessionFinished(sessionId) {
+		return
+	}
+	jobs, err := c.v.State.GetJobList(sessionId)
+	if err != nil || len(jobs) == 0 {
+		return
 	}
+	if c.sessionDeadLettered(sessionId) {
+		slog.Info("Session finished, keeping its packs for its dead letters", "session_id", sessionId)
+		return
+	}
+	slog.Info("Session finished, releasing its packs", "session_id", sessionId)
+	c.releasePacks(sessionId, jobs[0].QueryPackLocation, jobs[0].ModelPacks)
+}
+
+// sessionDeadLettered reports whether a dead letter names a job of the
+// session.  If the dead letters cannot be listed, it assumes one does.
+func (c *CommanderSingle) sessionDeadLettered(sessionId int) bool {
+	dlq, ok := c.v.Queue.(queue.DeadLetterQueue)
+	if !ok {
+		return false
+	}
+	letters, err := dlq.DeadLetters()
+	if err != nil {
+		slog.Error("Failed to list dead letters", "error", err)
+		return true
+	}
+	for _, d := range letters {
+		if spec, ok := deadLetterJob(d); ok && spec.SessionID == sessionId {
+			return true
+		}
+	}
+	return false
+}
+
+// reuseResult completes the job with the result of an earlier identical
+// analysis, if there is one.  It reports whether the job was completed.
+//
+// The reused SARIF is not rewritten: its automationDetails and mrva run
+// properties name the session that ran the analysis, not this one.  Its
+// versionControlProvenance is the same, being the same database.
+func (c *CommanderSingle) reuseResult(job queue.AnalyzeJob) bool {
+	if job.EvaluatorLog {
+		// The point is to measure this run
+		return false
+	}
+
+	if job.AnalysisHash() == "" {
+		return false
+	}
+
+	info, err := c.v.CodeQLDBStore.GetDatabaseInfo(job.Spec.NameWithOwner)
+	if err != nil {
+		slog.Warn("Cannot identify database, not reusing results",
+			"owner", job.Spec.Owner, "repo", job.Spec.Repo, "error", err)
+		return false
+	}
+
+	// Without a pinned version, the agents select the CLI by the database,
+	// so assume the one they selected for it before
+	cliVersion := job.CLIVersion
+	if cliVersion == "" {
+		cliVersion, _ = c.v.State.GetSelectedCLI(job.Spec.NameWithOwner, info.Identity())
+	}
+	if cliVersion == "" {
+		return false
+	}
+
+	key := common.ResultCacheKey{
+		QueryPackHash:    job.AnalysisHash(),
+		DatabaseIdentity: info.Identity(),
+		CLIVersion:       cliVersion,
+		NameWithOwner:    job.Spec.NameWithOwner,
+	}
+	cached, ok := c.v.State.GetCachedResult(key)
+	if !ok {
+		return false
+	}
+
+	slog.Info("Reusing earlier result",
+		"owner", job.Spec.Owner, "repo", job.Spec.Repo,
+		"session_id", job.Spec.SessionID, "from_session_id", cached.Spec.SessionID)
+
+	cached.Spec = job.Spec
+	cached.FromCache = true
+	c.v.State.AddJob(job)
+	c.v.State.SetResult(job.Spec, cached)
+	c.v.State.SetStatus(job.Spec, common.StatusSucceeded)
+	return true
 }
 
 func setupEndpoints(c CommanderAPI) {
+	go ListenAndServe(newRouter(c))
+}
+
+// newRouter maps the server's endpoints to the handlers of c.
+func newRouter(c CommanderAPI) *mux.Router {
 	r := mux.NewRouter()
 
 	// Root handler
@@ -79,13 +235,56 @@ func setupEndpoints(c CommanderAPI) {
 	// Endpoint to serve downloads using encoded JobSpec
 	r.HandleFunc("/download/{encoded_job_spec}", c.MRVADownloadServe)
 
+	// Endpoint for per-query result counts of all repositories in a session
+	r.HandleFunc("/result-breakdown/{codeql_variant_analysis_id}", c.MRVAResultBreakdown).Methods("GET")
+
+	// Endpoints for evaluator log summaries of sessions submitted with evaluator_log
+	r.HandleFunc("/slow-predicates/{codeql_variant_analysis_id}", c.MRVASlowPredicates).Methods("GET")
+	r.HandleFunc("/evaluator-logs/{codeql_variant_analysis_id}/{repo_owner}/{repo_name}", c.MRVAEvaluatorLog).Methods("GET")
+
+	// Endpoint to download the query pack of a session; this is query_pack_url
+	r.HandleFunc("/query-packs/{codeql_variant_analysis_id}", c.MRVAQueryPack).Methods("GET")
+
+	// Endpoint to upload and download model packs that submissions refer to
+	// by name, e.g. /model-packs/acme/java-models
+	r.HandleFunc("/model-packs/{scope}/{name}", c.MRVAModelPack).Methods("GET", "PUT")
+
+	// Endpoint listing the agents known from their heartbeats
+	r.HandleFunc("/agents", c.MRVAAgents).Methods("GET")
+
+	// Endpoints to inspect, requeue and remove the jobs and results that
+	// could not be processed
+	r.HandleFunc("/dead-letters", c.MRVADeadLetters).Methods("GET", "DELETE")
+	r.HandleFunc("/dead-letters/{id}", c.MRVADeadLetter).Methods("GET", "DELETE")
+	r.HandleFunc("/dead-letters/{id}/requeue", c.MRVADeadLetterRequeue).Methods("POST")
+
 	// Handler for unhandled endpoints
 	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		slog.Error("Unhandled endpoint", "method", r.Method, "uri", r.RequestURI)
 		http.Error(w, "Not Found", http.StatusNotFound)
 	})
 
-	go ListenAndServe(r)
+	return r
+}
+
+// serverURL is the base URL under which clients reach this server.
+// TODO: document/make less hacky
+func serverURL() string {
+	host := os.Getenv("SERVER_HOST")
+	if host == "" {
+		host = "localhost"
+	}
+
+	port := os.Getenv("SERVER_PORT")
+	if port == "" {
+		port = "8080"
+	}
+
+	return fmt.Sprintf("http://%s:%s", host, port)
+}
+
+func queryPackURL(sessionId int) string {
+	return fmt.Sprintf("%s/query-packs/%d", serverURL(), sessionId)
 }
 
 func ListenAndServe(r *mux.Router) {
@@ -196,8 +395,16 @@ func (c *CommanderSingle) submitStatusResponse(w http.ResponseWriter, js common.
 		// Get the job result if complete, otherwise return default values
 		var artifactSize int
 		var resultCount int
-
-		if status != common.StatusSucceeded {
+		var fromCache bool
+		var queryResults []common.QueryResultCount
+		var cliVersion string
+		var databaseUpgraded bool
+		var diagnostic *common.Diagnostic
+
+		if status == common.StatusFailed {
+			// Agents report why; failures from elsewhere have no result
+			diagnostic = c.failureDiagnostic(job.Spec)
+		} else if status != common.StatusSucceeded {
 			// If the job is not successful, we don't need to get the result
 			artifactSize = 0
 			resultCount = 0
@@ -215,6 +422,10 @@ func (c *CommanderSingle) submitStatusResponse(w http.ResponseWriter, js common.
 				return
 			}
 			resultCount = jobResult.ResultCount
+			fromCache = jobResult.FromCache
+			queryResults = jobResult.QueryResults
+			cliVersion = jobResult.CLIVersion
+			databaseUpgraded = jobResult.DatabaseUpgraded
 		}
 		// Get jobRepoID from (owner,repo)
 		jobRepoId := c.v.State.GetRepoId(job.Spec.NameWithOwner)
@@ -233,6 +444,13 @@ func (c *CommanderSingle) submitStatusResponse(w http.ResponseWriter, js common.
 				AnalysisStatus:    status.ToExternalString(),
 				ResultCount:       resultCount,
 				ArtifactSizeBytes: int(artifactSize),
+				ResultFromCache:   fromCache,
+				QueryResults:      queryResults,
+				CLIVersion:        cliVersion,
+				DatabaseUpgraded:  databaseUpgraded,
+				FailureMessage:    failureMessage(diagnostic),
+				Diagnostic:        diagnostic,
+				Attempts:          c.jobAttempts(job.Spec),
 			},
 		)
 	}
@@ -244,12 +462,18 @@ func (c *CommanderSingle) submitStatusResponse(w http.ResponseWriter, js common.
 		return
 	}
 
+	// A finished session's query pack may be released
+	var packURL string
+	if !c.sessionFinished(js.SessionID) {
+		packURL = queryPackURL(js.SessionID)
+	}
+
 	status := common.StatusResponse{
 		SessionId:            js.SessionID,
 		ControllerRepo:       common.ControllerRepo{},
 		Actor:                common.Actor{},
 		QueryLanguage:        ji.QueryLanguage,
-		QueryPackURL:         "", // FIXME
+		QueryPackURL:         packURL,
 		CreatedAt:            ji.CreatedAt,
 		UpdatedAt:            ji.UpdatedAt,
 		ActionsWorkflowRunID: -1, // FIXME
@@ -468,18 +692,7 @@ func (c *CommanderSingle) sendArtifactDownloadResponse(w http.ResponseWriter,
 			return
 		}
 
-		// TODO: document/make less hacky
-		host := os.Getenv("SERVER_HOST")
-		if host == "" {
-			host = "localhost"
-		}
-
-		port := os.Getenv("SERVER_PORT")
-		if port == "" {
-			port = "8080"
-		}
-
-		artifactURL := fmt.Sprintf("http://%s:%s/download/%s", host, port, encodedJobSpec)
+		artifactURL := fmt.Sprintf("%s/download/%s", serverURL(), encodedJobSpec)
 
 		response = common.DownloadResponse{
 			Repository: common.DownloadRepo{
@@ -494,6 +707,13 @@ func (c *CommanderSingle) sendArtifactDownloadResponse(w http.ResponseWriter,
 			DatabaseCommitSha:    jobResult.DatabaseSHA,
 			SourceLocationPrefix: jobResult.SourceLocationPrefix,
 			ArtifactURL:          artifactURL,
+			QueryResults:         jobResult.QueryResults,
+			CLIVersion:           jobResult.CLIVersion,
+			DatabaseUpgraded:     jobResult.DatabaseUpgraded,
+		}
+		if jobResult.EvaluatorLogLocation.Key != "" {
+			response.EvaluatorLogURL = fmt.Sprintf("%s/evaluator-logs/%d/%s/%s",
+				serverURL(), jobSpec.SessionID, jobSpec.Owner, jobSpec.Repo)
 		}
 	} else {
 		// not successful status
@@ -511,6 +731,10 @@ func (c *CommanderSingle) sendArtifactDownloadResponse(w http.ResponseWriter,
 			SourceLocationPrefix: "",
 			ArtifactURL:          "",
 		}
+		if jobStatus == common.StatusFailed {
+			response.Diagnostic = c.failureDiagnostic(jobSpec)
+			response.FailureMessage = failureMessage(response.Diagnostic)
+		}
 	}
 
 	// Encode the response as JSON
@@ -562,18 +786,550 @@ func (c *CommanderSingle) MRVADownloadServe(w http.ResponseWriter, r *http.Reque
 	w.Write(data)
 }
 
+// MRVAResultBreakdown reports per-query result counts for every repository of
+// a session.  Repositories are sorted by total result count, or by the count
+// of the query given as ?sort=<query id>, highest first.
+func (c *CommanderSingle) MRVAResultBreakdown(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	sortQuery := r.URL.Query().Get("sort")
+
+	sessionId, err := strconv.ParseInt(vars["codeql_variant_analysis_id"], 10, 32)
+	if err != nil {
+		slog.Error("Variant analysis ID is not an integer", "id", vars["codeql_variant_analysis_id"])
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	jobs, err := c.v.State.GetJobList(int(sessionId))
+	if err != nil {
+		msg := "No jobs found for given session id"
+		slog.Error(msg, "id", sessionId)
+		http.Error(w, msg, http.StatusNotFound)
+		return
+	}
+
+	response := common.ResultBreakdownResponse{
+		SessionId:    int(sessionId),
+		Queries:      []common.QueryResultCount{},
+		Repositories: []common.RepoResultBreakdown{},
+	}
+	totals := map[string]*common.QueryResultCount{}
+	var queryOrder []string
+
+	for _, job := range jobs {
+		status, err := c.v.State.GetStatus(job.Spec)
+		if err != nil {
+			slog.Error("Error getting status", "error", err.Error())
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		repo := common.RepoResultBreakdown{
+			FullName:       fmt.Sprintf("%s/%s", job.Spec.Owner, job.Spec.Repo),
+			AnalysisStatus: status.ToExternalString(),
+			QueryResults:   []common.QueryResultCount{},
+		}
+
+		if status == common.StatusSucceeded {
+			jobResult, err := c.v.State.GetResult(job.Spec)
+			if err != nil {
+				slog.Error("Error getting result", "error", err.Error())
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+			repo.ResultCount = jobResult.ResultCount
+			if jobResult.QueryResults != nil {
+				repo.QueryResults = jobResult.QueryResults
+			}
+
+			for _, qr := range jobResult.QueryResults {
+				total, ok := totals[qr.QueryID]
+				if !ok {
+					total = &common.QueryResultCount{QueryID: qr.QueryID, Levels: map[string]int{}}
+					totals[qr.QueryID] = total
+					queryOrder = append(queryOrder, qr.QueryID)
+				}
+				total.ResultCount += qr.ResultCount
+				for level, n := range qr.Levels {
+					total.Levels[level] += n
+				}
+			}
+		}
+
+		response.Repositories = append(response.Repositories, repo)
+	}
+
+	for _, id := range queryOrder {
+		response.Queries = append(response.Queries, *totals[id])
+	}
+
+	sortKey := func(repo common.RepoResultBreakdown) int {
+		if sortQuery == "" {
+			return repo.ResultCount
+		}
+		for _, qr := range repo.QueryResults {
+			if qr.QueryID == sortQuery {
+				return qr.ResultCount
+			}
+		}
+		return 0
+	}
+	sort.SliceStable(response.Repositories, func(i, j int) bool {
+		ki, kj := sortKey(response.Repositories[i]), sortKey(response.Repositories[j])
+		if ki != kj {
+			return ki > kj
+		}
+		return response.Repositories[i].FullName < response.Repositories[j].FullName
+	})
+
+	responseJson, err := json.Marshal(response)
+	if err != nil {
+		slog.Error("Error encoding response as JSON:",
+			"error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJson)
+}
+
+// MRVAQueryPack serves the query pack submitted for a session
+func (c *CommanderSingle) MRVAQueryPack(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	sessionId, err := strconv.ParseInt(vars["codeql_variant_analysis_id"], 10, 32)
+	if err != nil {
+		slog.Error("Variant analysis ID is not an integer", "id", vars["codeql_variant_analysis_id"])
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// All jobs of a session share the query pack
+	jobs, err := c.v.State.GetJobList(int(sessionId))
+	if err != nil || len(jobs) == 0 {
+		msg := "No query pack found for given session id"
+		slog.Error(msg, "id", sessionId)
+		http.Error(w, msg, http.StatusNotFound)
+		return
+	}
+	data, err := c.v.Artifacts.GetQueryPack(jobs[0].QueryPackLocation)
+	if err != nil && c.sessionFinished(int(sessionId)) {
+		http.Error(w, "The query pack was released when the session finished", http.StatusGone)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to retrieve query pack", "error", err)
+		http.Error(w, "Failed to retrieve query pack", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Write(data)
+}
+
+// MRVASlowPredicates lists the predicates that took longest to evaluate over
+// all repositories of a session, by total time.  ?limit=N bounds the list.
+func (c *CommanderSingle) MRVASlowPredicates(w http.ResponseWriter, r *http.Request) {
+	const defaultLimit = 50
+
+	vars := mux.Vars(r)
+	sessionId, err := strconv.ParseInt(vars["codeql_variant_analysis_id"], 10, 32)
+	if err != nil {
+		slog.Error("Variant analysis ID is not an integer", "id", vars["codeql_variant_analysis_id"])
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	jobs, err := c.v.State.GetJobList(int(sessionId))
+	if err != nil {
+		msg := "No jobs found for given session id"
+		slog.Error(msg, "id", sessionId)
+		http.Error(w, msg, http.StatusNotFound)
+		return
+	}
+
+	response := common.SlowPredicatesResponse{
+		SessionId:  int(sessionId),
+		Predicates: []common.SlowPredicate{},
+	}
+	byName := map[string]*common.SlowPredicate{}
+
+	for _, job := range jobs {
+		status, err := c.v.State.GetStatus(job.Spec)
+		if err != nil || status != common.StatusSucceeded {
+			continue
+		}
+		jobResult, err := c.v.State.GetResult(job.Spec)
+		if err != nil {
+			slog.Error("Error getting result", "error", err.Error())
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if jobResult.SlowPredicates == nil {
+			continue
+		}
+		response.Repositories++
+
+		repo := fmt.Sprintf("%s/%s", job.Spec.Owner, job.Spec.Repo)
+		for _, timing := range jobResult.SlowPredicates {
+			p, ok := byName[timing.PredicateName]
+			if !ok {
+				p = &common.SlowPredicate{PredicateName: timing.PredicateName, Query: timing.Query}
+				byName[timing.PredicateName] = p
+			}
+			p.TotalMillis += timing.Millis
+			p.Repositories++
+			if timing.Millis > p.MaxMillis || p.MaxRepository == "" {
+				p.MaxMillis = timing.Millis
+				p.MaxRepository = repo
+			}
+		}
+	}
+
+	for _, p := range byName {
+		response.Predicates = append(response.Predicates, *p)
+	}
+	sort.Slice(response.Predicates, func(i, j int) bool {
+		a, b := response.Predicates[i], response.Predicates[j]
+		if a.TotalMillis != b.TotalMillis {
+			return a.TotalMillis > b.TotalMillis
+		}
+		return a.PredicateName < b.PredicateName
+	})
+	if len(response.Predicates) > limit {
+		response.Predicates = response.Predicates[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		slog.Error("Error encoding slow predicates", "error", err)
+	}
+}
+
+// MRVAEvaluatorLog serves the evaluator log summary of one repository's
+// analysis.
+func (c *CommanderSingle) MRVAEvaluatorLog(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	sessionId, err := strconv.ParseInt(vars["codeql_variant_analysis_id"], 10, 32)
+	if err != nil {
+		slog.Error("Variant analysis ID is not an integer", "id", vars["codeql_variant_analysis_id"])
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	jobSpec := common.JobSpec{
+		SessionID: int(sessionId),
+		NameWithOwner: common.NameWithOwner{
+			Owner: vars["repo_owner"],
+			Repo:  vars["repo_name"],
+		},
+	}
+	jobResult, err := c.v.State.GetResult(jobSpec)
+	if err != nil || jobResult.EvaluatorLogLocation.Key == "" {
+		http.Error(w, "No evaluator log for this repository", http.StatusNotFound)
+		return
+	}
+
+	data, err := c.v.Artifacts.GetEvaluatorLogSummary(jobResult.EvaluatorLogLocation)
+	if err != nil {
+		slog.Error("Failed to retrieve evaluator log summary", "error", err)
+		http.Error(w, "Failed to retrieve evaluator log summary", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(data)
+}
+
+// MRVAAgents lists the registered agents and the jobs they are running.
+func (c *CommanderSingle) MRVAAgents(w http.ResponseWriter, r *http.Request) {
+	response := common.AgentsResponse{Agents: c.agents.list()}
+
+	responseJson, err := json.Marshal(response)
+	if err != nil {
+		slog.Error("Error encoding response as JSON:", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJson)
+}
+
+// deadLetterQueue returns the queue's dead letters, or responds that the
+// queue keeps none.
+func (c *CommanderSingle) deadLetterQueue(w http.ResponseWriter) (queue.DeadLetterQueue, bool) {
+	dlq, ok := c.v.Queue.(queue.DeadLetterQueue)
+	if !ok {
+		http.Error(w, "queue does not keep dead letters", http.StatusNotImplemented)
+	}
+	return dlq, ok
+}
+
+// deadLetterStatus describes a dead letter, with its body if withBody.
+func deadLetterStatus(d queue.DeadLetter, withBody bool) common.DeadLetter {
+	status := common.DeadLetter{
+		ID:       d.ID,
+		Queue:    d.SourceQueue,
+		Reason:   d.Reason,
+		Attempts: d.Attempts,
+	}
+	if !d.DeadLetteredAt.IsZero() {
+		status.DeadLetteredAt = d.DeadLetteredAt.Format(time.RFC3339)
+	}
+	if spec, ok := deadLetterJob(d); ok {
+		status.Job = &common.RunningJob{
+			SessionId: spec.SessionID,
+			FullName:  spec.Owner + "/" + spec.Repo,
+		}
+	}
+	if withBody {
+		status.Body = string(d.Body)
+	}
+	return status
+}
+
+// deadLetterJob returns the job a dead letter names, if it is readable.
+func deadLetterJob(d queue.DeadLetter) (common.JobSpec, bool) {
+	// Jobs and results both name their job
+	var message struct{ Spec common.JobSpec }
+	if err := json.Unmarshal(d.Body, &message); err != nil || message.Spec.Owner == "" {
+		return common.JobSpec{}, false
+	}
+	return message.Spec, true
+}
+
+// deadLetteredSessions returns the sessions named by the dead letters with
+// the given IDs, or by all of them if ids is nil.
+func deadLetteredSessions(dlq queue.DeadLetterQueue, ids ...string) map[int]bool {
+	letters, err := dlq.DeadLetters()
+	if err != nil {
+		slog.Error("Failed to list dead letters", "error", err)
+		return nil
+	}
+	sessions := make(map[int]bool)
+	for _, d := range letters {
+		if ids != nil && !slices.Contains(ids, d.ID) {
+			continue
+		}
+		if spec, ok := deadLetterJob(d); ok {
+			sessions[spec.SessionID] = true
+		}
+	}
+	return sessions
+}
+
+// findDeadLetter responds with 404 if there is no dead letter id.
+func findDeadLetter(w http.ResponseWriter, dlq queue.DeadLetterQueue, id string) (queue.DeadLetter, bool) {
+	letters, err := dlq.DeadLetters()
+	if err != nil {
+		slog.Error("Failed to list dead letters", "error", err)
+		http.Error(w, "Failed to list dead letters", http.StatusInternalServerError)
+		return queue.DeadLetter{}, false
+	}
+	for _, d := range letters {
+		if d.ID == id {
+			return d, true
+		}
+	}
+	http.Error(w, queue.ErrDeadLetterNotFound.Error(), http.StatusNotFound)
+	return queue.DeadLetter{}, false
+}
+
+// MRVADeadLetters lists (GET) or purges (DELETE) the dead letters.
+func (c *CommanderSingle) MRVADeadLetters(w http.ResponseWriter, r *http.Request) {
+	dlq, ok := c.deadLetterQueue(w)
+	if !ok {
+		return
+	}
+
+	var response interface{}
+	if r.Method == http.MethodDelete {
+		sessions := deadLetteredSessions(dlq)
+		purged, err := dlq.PurgeDeadLetters()
+		if err != nil {
+			slog.Error("Failed to purge dead letters", "error", err)
+			http.Error(w, "Failed to purge dead letters", http.StatusInternalServerError)
+			return
+		}
+		for sessionId := range sessions {
+			c.releaseFinishedSession(sessionId)
+		}
+		response = common.DeadLettersPurgedResponse{Purged: purged}
+	} else {
+		letters, err := dlq.DeadLetters()
+		if err != nil {
+			slog.Error("Failed to list dead letters", "error", err)
+			http.Error(w, "Failed to list dead letters", http.StatusInternalServerError)
+			return
+		}
+		list := common.DeadLettersResponse{DeadLetters: make([]common.DeadLetter, 0, len(letters))}
+		for _, d := range letters {
+			list.DeadLetters = append(list.DeadLetters, deadLetterStatus(d, false))
+		}
+		response = list
+	}
+
+	responseJson, err := json.Marshal(response)
+	if err != nil {
+		slog.Error("Error encoding response as JSON:", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJson)
+}
+
+// MRVADeadLetter inspects (GET) or discards (DELETE) one dead letter.
+func (c *CommanderSingle) MRVADeadLetter(w http.ResponseWriter, r *http.Request) {
+	dlq, ok := c.deadLetterQueue(w)
+	if !ok {
+		return
+	}
+	id := mux.Vars(r)["id"]
+
+	if r.Method == http.MethodDelete {
+		sessions := deadLetteredSessions(dlq, id)
+		err := dlq.DiscardDeadLetter(id)
+		if errors.Is(err, queue.ErrDeadLetterNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			slog.Error("Failed to discard dead letter", "id", id, "error", err)
+			http.Error(w, "Failed to discard dead letter", http.StatusInternalServerError)
+			return
+		}
+		for sessionId := range sessions {
+			c.releaseFinishedSession(sessionId)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	d, ok := findDeadLetter(w, dlq, id)
+	if !ok {
+		return
+	}
+	responseJson, err := json.Marshal(deadLetterStatus(d, true))
+	if err != nil {
+		slog.Error("Error encoding response as JSON:", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJson)
+}
+
+// MRVADeadLetterRequeue returns a dead letter to the queue it came from.  A
+// requeued job is pending again, so that its session keeps its packs until
+// the job finished.
+func (c *CommanderSingle) MRVADeadLetterRequeue(w http.ResponseWriter, r *http.Request) {
+	dlq, ok := c.deadLetterQueue(w)
+	if !ok {
+		return
+	}
+	id := mux.Vars(r)["id"]
+
+	d, ok := findDeadLetter(w, dlq, id)
+	if !ok {
+		return
+	}
+	err := dlq.RequeueDeadLetter(id)
+	if errors.Is(err, queue.ErrDeadLetterNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to requeue dead letter", "id", id, "error", err)
+		http.Error(w, "Failed to requeue dead letter", http.StatusInternalServerError)
+		return
+	}
+	if spec, ok := deadLetterJob(d); ok {
+		if status, err := c.v.State.GetStatus(spec); err == nil && status == common.StatusFailed {
+			c.v.State.SetStatus(spec, common.StatusPending)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// MRVAModelPack stores (PUT) or returns (GET) a named model pack archive.
+func (c *CommanderSingle) MRVAModelPack(w http.ResponseWriter, r *http.Request) {
+	const maxModelPackBytes = 64 << 20
+
+	vars := mux.Vars(r)
+	name := vars["scope"] + "/" + vars["name"]
+
+	if r.Method == http.MethodGet {
+		data, err := c.v.Artifacts.GetModelPack(name)
+		if errors.Is(err, artifactstore.ErrModelPackNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			slog.Error("Failed to retrieve model pack", "name", name, "error", err)
+			http.Error(w, "Failed to retrieve model pack", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Write(data)
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxModelPackBytes))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	info, err := querypack.InspectModelPack(data)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid model pack: %v", err), http.StatusUnprocessableEntity)
+		return
+	}
+	if info.Name != name {
+		http.Error(w, fmt.Sprintf("model pack is named %s, not %s", info.Name, name),
+			http.StatusUnprocessableEntity)
+		return
+	}
+	if err := c.v.Artifacts.SaveModelPack(name, data); err != nil {
+		slog.Error("Failed to save model pack", "name", name, "error", err)
+		http.Error(w, "Failed to save model pack", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Stored model pack", "name", name, "version", info.Version, "language", info.Language)
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (c *CommanderSingle) MRVARequestCommon(w http.ResponseWriter, r *http.Request) {
 	sessionId := c.v.State.NextID()
 	slog.Info("New MRVA Request", "id", fmt.Sprint(sessionId))
-	queryLanguage, repoNWOs, queryPackLocation, err := c.collectRequestInfoAndSaveQueryPack(w, r, sessionId)
+	submission, err := c.collectRequestInfoAndSaveQueryPack(r, sessionId)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		status := http.StatusBadRequest
+		var se *submissionError
+		if errors.As(err, &se) {
+			status = se.status
+		}
+		http.Error(w, err.Error(), status)
 		return
 	}
+	queryLanguage := submission.Language
 
-	slog.Debug("Processed request info", "location", queryPackLocation, "language", queryLanguage)
+	slog.Debug("Processed request info", "location", submission.QueryPackLocation, "language", queryLanguage)
 
-	notFoundRepos, analysisRepos := c.v.CodeQLDBStore.FindAvailableDBs(repoNWOs)
+	notFoundRepos, analysisRepos := c.v.CodeQLDBStore.FindAvailableDBs(submission.Repositories)
 
 	if len(analysisRepos) == 0 {
 		slog.Warn("No repositories found for analysis")
@@ -582,18 +1338,24 @@ func (c *CommanderSingle) MRVARequestCommon(w http.ResponseWriter, r *http.Reque
 	// XX: session_is is separate from the query pack ref.  Value may be equal.
 	// QueryPackURL is returned to the client, separately from the ID.
 	// The values may be equal here, but this is irrelevant
-	c.startAnalyses(analysisRepos, queryPackLocation, sessionId, queryLanguage)
+	reusedRepos := c.startAnalyses(analysisRepos, submission, sessionId)
+
+	// Without queued jobs, the query pack was released already
+	var packURL string
+	if len(reusedRepos) < len(analysisRepos) {
+		packURL = queryPackURL(sessionId)
+	}
 
 	sessionInfo := SessionInfo{
 		ID: sessionId,
 
-		QueryPack: strconv.Itoa(sessionId), // TODO
+		QueryPack: packURL,
 		Language:  queryLanguage,
 
 		AccessMismatchRepos: nil, /* FIXME */
 		NotFoundRepos:       notFoundRepos,
 		NoCodeqlDBRepos:     nil, /* FIXME */
-
+		ReusedRepos:         reusedRepos,
 	}
 
 	slog.Debug("Forming and sending response for submitted analysis job", "id", sessionInfo.ID)
@@ -644,17 +1406,96 @@ func nwoToDummyRepositoryArray(nwo []common.NameWithOwner) ([]common.Repository,
 	return repos, count
 }
 
-// ConsumeResults moves results from 'queue' to server 'state'
+// ConsumeResults moves results from 'queue' to server 'state'.  Each is
+// acknowledged only once stored, so none is lost if the server stops.
 func (c *CommanderSingle) ConsumeResults() {
 	slog.Info("Started server results consumer.")
-	for {
-		r := <-c.v.Queue.Results()
-		slog.Debug("Result consumed:", "r", r, "status", r.Status.ToExternalString())
-		c.v.State.SetResult(r.Spec, r)
-		c.v.State.SetStatus(r.Spec, r.Status)
+	for d := range c.v.Queue.Results() {
+		c.storeResult(d.Result)
+		if err := d.Ack(); err != nil {
+			slog.Error("Failed to acknowledge result", "job", d.Result.Spec, "error", err)
+		}
 	}
 }
 
+// storeResult records a result taken from the queue.
+func (c *CommanderSingle) storeResult(r queue.AnalyzeResult) {
+	slog.Debug("Result consumed:", "r", r, "status", r.Status.ToExternalString())
+	if !c.acceptResult(r) {
+		return
+	}
+	if c.recordAttempt(&r, time.Now()) {
+		return
+	}
+	previous, err := c.v.State.GetStatus(r.Spec)
+	c.v.State.SetResult(r.Spec, r)
+	c.v.State.SetStatus(r.Spec, r.Status)
+	c.rememberResult(r)
+	if err != nil || previous == common.StatusPending || previous == common.StatusInProgress {
+		c.jobFinished(r.Spec)
+	}
+}
+
+// acceptResult reports whether a result should be recorded.  Jobs are
+// delivered at least once, so a job may report more than once: after its
+// agent died between publishing the result and releasing the job, or after
+// being recovered from an agent thought lost.  The first successful result
+// stands; a later one would only replace it with an equivalent or a failure.
+//
+// Results also carry the job's earlier attempts; one with fewer than
+// recorded is from an attempt already retried.
+func (c *CommanderSingle) acceptResult(r queue.AnalyzeResult) bool {
+	status, err := c.v.State.GetStatus(r.Spec)
+	if err == nil && status == common.StatusSucceeded {
+		slog.Info("Ignoring repeated result of completed job",
+			"job", r.Spec, "status", r.Status.ToExternalString())
+		return false
+	}
+	if recorded := c.jobAttempts(r.Spec); len(r.Attempts) < len(recorded) {
+		slog.Info("Ignoring result of earlier attempt",
+			"job", r.Spec, "attempt", len(r.Attempts)+1, "attempts", len(recorded))
+		return false
+	}
+	return true
+}
+
+// failureDiagnostic is the cause an agent reported for a failed job, or nil.
+func (c *CommanderSingle) failureDiagnostic(js common.JobSpec) *common.Diagnostic {
+	result, err := c.v.State.GetResult(js)
+	if err != nil {
+		return nil
+	}
+	return result.Diagnostic
+}
+
+func failureMessage(d *common.Diagnostic) string {
+	if d == nil {
+		return ""
+	}
+	return d.Summary()
+}
+
+// rememberResult makes a successful result available for reuse by later
+// sessions running the same query pack on the same database.
+func (c *CommanderSingle) rememberResult(r queue.AnalyzeResult) {
+	if r.Status != common.StatusSucceeded || r.FromCache || r.CLIVersion == "" ||
+		r.AnalysisHash == "" || r.DatabaseIdentity == "" {
+		return
+	}
+
+	// Only results from the selected version are reused for jobs without a
+	// pinned one
+	if job, ok := c.findJob(r.Spec); ok && job.CLIVersion == "" {
+		c.v.State.SetSelectedCLI(r.Spec.NameWithOwner, r.DatabaseIdentity, r.CLIVersion)
+	}
+	c.v.State.SetCachedResult(common.ResultCacheKey{
+		QueryPackHash:    r.AnalysisHash,
+		DatabaseIdentity: r.DatabaseIdentity,
+		CLIVersion:       r.CLIVersion,
+		NameWithOwner:    r.Spec.NameWithOwner,
+	}, r)
+}
+
 func (c *CommanderSingle) buildSessionInfoResponseJson(si SessionInfo) ([]byte, error) {
 	// Construct the response bottom-up
 	var controllerRepo common.ControllerRepo
@@ -679,6 +1520,9 @@ func (c *CommanderSingle) buildSessionInfoResponseJson(si SessionInfo) ([]byte,
 		NoCodeqlDBRepos:     noCodeQLDBRepos,
 		OverLimitRepos:      overlimitRepos}
 
+	repoNames, count = nwoToNwoStringArray(si.ReusedRepos)
+	reusedResultRepos := common.ReusedResultRepos{RepositoryCount: count, RepositoryFullNames: repoNames}
+
 	response := common.SubmitResponse{
 		Actor:               actor,
 		ControllerRepo:      controllerRepo,
@@ -689,6 +1533,7 @@ func (c *CommanderSingle) buildSessionInfoResponseJson(si SessionInfo) ([]byte,
 		UpdatedAt:           time.Now().Format(time.RFC3339),
 		Status:              "in_progress",
 		SkippedRepositories: skippedRepositories,
+		ReusedResultRepos:   reusedResultRepos,
 	}
 
 	// Store data needed later
@@ -721,64 +1566,164 @@ func (c *CommanderSingle) buildSessionInfoResponseJson(si SessionInfo) ([]byte,
 
 }
 
-func (c *CommanderSingle) collectRequestInfoAndSaveQueryPack(w http.ResponseWriter, r *http.Request, sessionId int) (queue.QueryLanguage, []common.NameWithOwner, artifactstore.ArtifactLocation, error) {
+// collectRequestInfoAndSaveQueryPack parses and validates a submission and
+// saves its query pack.  Errors are *submissionError values carrying the HTTP
+// status to respond with.
+func (c *CommanderSingle) collectRequestInfoAndSaveQueryPack(r *http.Request, sessionId int) (SubmissionInfo, error) {
 	slog.Debug("Collecting session info")
 
 	if r.Body == nil {
 		err := errors.New("missing request body")
 		slog.Error("Error reading MRVA submission body", "error", err)
-		http.Error(w, err.Error(), http.StatusNoContent)
-		return "", []common.NameWithOwner{}, artifactstore.ArtifactLocation{}, err
+		return SubmissionInfo{}, &submissionError{http.StatusBadRequest, err}
 	}
 
 	buf, err := io.ReadAll(r.Body)
 	if err != nil {
-		var w http.ResponseWriter
 		slog.Error("Error reading MRVA submission body", "error", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return "", []common.NameWithOwner{}, artifactstore.ArtifactLocation{}, err
+		return SubmissionInfo{}, &submissionError{http.StatusBadRequest, err}
 	}
 
 	msg, err := tryParseSubmitMsg(buf)
 	if err != nil {
 		slog.Error("Unknown MRVA submission body format", "err", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return "", []common.NameWithOwner{}, artifactstore.ArtifactLocation{}, err
+		return SubmissionInfo{}, &submissionError{http.StatusBadRequest, err}
 	}
 
-	// 1. Save the query pack and keep the location
+	// 1. Collect the repositories
+	var sessionRepos []common.NameWithOwner
+
+	for _, v := range msg.Repositories {
+		t := strings.Split(v, "/")
+		if len(t) != 2 || t[0] == "" || t[1] == "" {
+			err := fmt.Errorf("invalid owner / repository entry: %q", v)
+			slog.Error("Invalid owner / repository entry", "entry", v)
+			return SubmissionInfo{}, &submissionError{http.StatusBadRequest, err}
+		}
+		sessionRepos = append(sessionRepos,
+			common.NameWithOwner{Owner: t[0], Repo: t[1]})
+	}
+
+	// 2. Validate the query pack against the language
 	if !utils.IsBase64Gzip([]byte(msg.QueryPack)) {
 		slog.Error("MRVA submission body querypack has invalid format")
 		err := errors.New("MRVA submission body querypack has invalid format")
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return "", []common.NameWithOwner{}, artifactstore.ArtifactLocation{}, err
+		return SubmissionInfo{}, &submissionError{http.StatusBadRequest, err}
 	}
 
-	queryPackLocation, err := c.decodeAndSaveBase64QueryPack(msg.QueryPack, sessionId)
+	tgz, err := base64.StdEncoding.DecodeString(msg.QueryPack)
+	if err != nil {
+		slog.Error("Failed to decode query pack body", "err", err)
+		return SubmissionInfo{}, &submissionError{http.StatusBadRequest, err}
+	}
+
+	packInfo, err := querypack.Inspect(tgz)
+	if err == nil {
+		err = packInfo.CheckLanguage(msg.Language)
+	}
+	if err != nil {
+		slog.Error("Invalid query pack", "error", err)
+		return SubmissionInfo{}, &submissionError{http.StatusUnprocessableEntity,
+			fmt.Errorf("invalid query pack: %w", err)}
+	}
+	slog.Debug("Query pack validated", "name", packInfo.Name, "queries", packInfo.Queries)
+
+	// 3. Collect the model packs and threat models
+	modelPacks, err := c.collectModelPacks(msg)
+	if err != nil {
+		slog.Error("Invalid model pack", "error", err)
+		return SubmissionInfo{}, err
+	}
+	for _, tm := range msg.ThreatModels {
+		if !threatModelPattern.MatchString(tm) {
+			err := fmt.Errorf("invalid threat model: %q", tm)
+			return SubmissionInfo{}, &submissionError{http.StatusBadRequest, err}
+		}
+	}
+
+	// 4. Save the packs and keep the locations
+	queryPackLocation, err := c.saveQueryPack(tgz, sessionId)
 	if err != nil {
 		slog.Error("Error processing query pack archive", "error", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return "", []common.NameWithOwner{}, artifactstore.ArtifactLocation{}, err
+		return SubmissionInfo{}, &submissionError{http.StatusInternalServerError, err}
+	}
+
+	var modelPackRefs []queue.ModelPackRef
+	for _, mp := range modelPacks {
+		// Model packs are stored like query packs, one copy per content
+		location, err := c.v.Artifacts.SaveQueryPack(sessionId, mp.data)
+		if err != nil {
+			slog.Error("Failed to save model pack", "name", mp.name, "error", err)
+			// No job will reference the packs saved so far
+			c.releasePacks(sessionId, queryPackLocation, modelPackRefs)
+			return SubmissionInfo{}, &submissionError{http.StatusInternalServerError, err}
+		}
+		modelPackRefs = append(modelPackRefs, queue.ModelPackRef{Name: mp.name, Location: location, Hash: mp.hash})
 	}
 
-	// 2. Save the language
-	sessionLanguage := queue.QueryLanguage(msg.Language)
+	return SubmissionInfo{
+		Language:          queue.QueryLanguage(msg.Language),
+		Repositories:      sessionRepos,
+		QueryPackLocation: queryPackLocation,
+		QueryPackHash:     packInfo.ContentHash,
+		Queries:           packInfo.Queries,
+		CLIVersion:        msg.CLIVersion,
+		ModelPacks:        modelPackRefs,
+		ThreatModels:      msg.ThreatModels,
+		EvaluatorLog:      msg.EvaluatorLog,
+	}, nil
+}
 
-	// 3. Save the repositories
-	var sessionRepos []common.NameWithOwner
+// threatModelPattern matches threat model names, optionally negated.
+var threatModelPattern = regexp.MustCompile(`^!?[a-z][a-z0-9-]*$`)
 
-	for _, v := range msg.Repositories {
-		t := strings.Split(v, "/")
-		if len(t) != 2 {
-			err := "Invalid owner / repository entry"
-			slog.Error(err, "entry", t)
-			http.Error(w, err, http.StatusBadRequest)
+type modelPack struct {
+	name string
+	hash string
+	data []byte
+}
+
+// collectModelPacks decodes the model packs sent with a submission and loads
+// those it names, checking each against the submission language.  Errors are
+// *submissionError values.
+func (c *CommanderSingle) collectModelPacks(msg common.SubmitMsg) ([]modelPack, error) {
+	var packs []modelPack
+	add := func(data []byte) error {
+		info, err := querypack.InspectModelPack(data)
+		if err == nil {
+			err = info.CheckLanguage(msg.Language)
 		}
-		sessionRepos = append(sessionRepos,
-			common.NameWithOwner{Owner: t[0], Repo: t[1]})
+		if err != nil {
+			return &submissionError{http.StatusUnprocessableEntity, fmt.Errorf("invalid model pack: %w", err)}
+		}
+		packs = append(packs, modelPack{name: info.Name, hash: info.ContentHash, data: data})
+		return nil
 	}
 
-	return sessionLanguage, sessionRepos, queryPackLocation, nil
+	for i, encoded := range msg.ModelPacks {
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, &submissionError{http.StatusBadRequest,
+				fmt.Errorf("model pack %d is not base64-encoded: %w", i, err)}
+		}
+		if err := add(data); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, name := range msg.ModelPackNames {
+		data, err := c.v.Artifacts.GetModelPack(name)
+		if errors.Is(err, artifactstore.ErrModelPackNotFound) {
+			return nil, &submissionError{http.StatusUnprocessableEntity, err}
+		}
+		if err != nil {
+			return nil, &submissionError{http.StatusInternalServerError, err}
+		}
+		if err := add(data); err != nil {
+			return nil, err
+		}
+	}
+	return packs, nil
 }
 
 // Try to extract a SubmitMsg from a json-encoded buffer
@@ -792,23 +1737,13 @@ func tryParseSubmitMsg(buf []byte) (common.SubmitMsg, error) {
 	return m, err
 }
 
-func (c *CommanderSingle) decodeAndSaveBase64QueryPack(qp string, sessionId int) (artifactstore.ArtifactLocation, error) {
-	// These are decoded manually via
-	//    base64 -d < foo1 | gunzip | tar t | head -20
-	// base64 decode the body
-	slog.Debug("Extracting query pack")
-
-	tgz, err := base64.StdEncoding.DecodeString(qp)
-	if err != nil {
-		slog.Error("Failed to decode query pack body", "err", err)
-		return artifactstore.ArtifactLocation{}, err
-	}
-
+// saveQueryPack stores the decoded query pack and returns its location.
+func (c *CommanderSingle) saveQueryPack(tgz []byte, sessionId int) (artifactstore.ArtifactLocation, error) {
 	artifactLocation, err := c.v.Artifacts.SaveQueryPack(sessionId, tgz)
 	if err != nil {
 		slog.Error("Failed to save query pack", "err", err)
 		return artifactstore.ArtifactLocation{}, err
 	}
 
-	return artifactLocation, err
+	return artifactLocation, nil
 }
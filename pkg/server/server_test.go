@@ -0,0 +1,1029 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/agent"
+	"github.com/hohn/mrvacommander/pkg/artifactstore"
+	"github.com/hohn/mrvacommander/pkg/codeql"
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/hohn/mrvacommander/pkg/diskcache"
+	"github.com/hohn/mrvacommander/pkg/qldbstore"
+	"github.com/hohn/mrvacommander/pkg/queue"
+	"github.com/hohn/mrvacommander/pkg/state"
+)
+
+const fakeResultCount = 3
+
+// testSystem is a server and one agent worker sharing in-memory components,
+// with the CodeQL CLI replaced by codeql.FakeRunner.
+type testSystem struct {
+	server *httptest.Server
+	c      *CommanderSingle
+}
+
+func newTestSystem(t *testing.T) *testSystem {
+	t.Helper()
+	return newConfiguredTestSystem(t, nil)
+}
+
+// newConfiguredTestSystem lets configure adjust the server's and the agent's
+// components before they start.
+func newConfiguredTestSystem(t *testing.T, configure func(sv *Visibles, av *agent.Visibles)) *testSystem {
+	t.Helper()
+
+	dbDir := t.TempDir()
+	writeTestDatabase(t, dbDir, common.NameWithOwner{Owner: "octo", Repo: "hello"})
+
+	q := queue.NewQueueSingle(1)
+	st := state.NewLocalState(1)
+	artifacts := artifactstore.NewInMemoryArtifactStore()
+	dbs := qldbstore.NewLocalFilesystemCodeQLDatabaseStore(dbDir)
+	packCache, err := diskcache.New("query-packs", t.TempDir(), 64*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sv := &Visibles{
+		Queue:         q,
+		State:         st,
+		Artifacts:     artifacts,
+		CodeQLDBStore: dbs,
+	}
+	av := &agent.Visibles{
+		Queue:         q,
+		Artifacts:     artifacts,
+		CodeQLDBStore: dbs,
+		State:         st,
+		Runner:        codeql.FakeRunner{ResultCount: fakeResultCount},
+		PackCache:     packCache,
+		Scratch:       agent.Scratch{Dir: t.TempDir()},
+		Activity:      agent.NewActivity(),
+	}
+	if configure != nil {
+		configure(sv, av)
+	}
+
+	c := &CommanderSingle{v: sv}
+	go c.ConsumeResults()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go agent.RunWorker(ctx, av, make(chan struct{}), &wg)
+
+	ts := httptest.NewServer(newRouter(c))
+	t.Cleanup(func() {
+		ts.Close()
+		cancel()
+		wg.Wait()
+	})
+	return &testSystem{server: ts, c: c}
+}
+
+// writeTestDatabase stores a minimal database zip in the local store layout.
+func writeTestDatabase(t *testing.T, base string, nwo common.NameWithOwner) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range map[string]string{
+		"db/codeql-database.yml": "primaryLanguage: javascript\n",
+		"db/src.zip":             "",
+	} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(base, nwo.Owner, nwo.Repo)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, nwo.Owner+"_"+nwo.Repo+"_db.zip")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testQueryPack returns a base64-encoded query pack archive.
+func testQueryPack(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		err := tw.WriteHeader(&tar.Header{
+			Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+var validPack = map[string]string{
+	"qlpack.yml":  "name: test/pack\nversion: 0.0.1\ndependencies:\n  codeql/javascript-all: \"*\"\n",
+	"Example.ql":  "select 1\n",
+	".codeql/x.y": "bundled dependency\n",
+}
+
+func (ts *testSystem) submit(t *testing.T, pack string, repos ...string) (*http.Response, []byte) {
+	t.Helper()
+
+	return ts.submitMsg(t, common.SubmitMsg{
+		Language:     "javascript",
+		QueryPack:    pack,
+		Repositories: repos,
+	})
+}
+
+func (ts *testSystem) submitMsg(t *testing.T, msg common.SubmitMsg) (*http.Response, []byte) {
+	t.Helper()
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(ts.server.URL+"/repos/ctrl/repo/code-scanning/codeql/variant-analyses",
+		"application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, data
+}
+
+func (ts *testSystem) get(t *testing.T, path string, v interface{}) []byte {
+	t.Helper()
+
+	resp, err := http.Get(ts.server.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: status %d: %s", path, resp.StatusCode, data)
+	}
+	if v != nil {
+		if err := json.Unmarshal(data, v); err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+	}
+	return data
+}
+
+// awaitStatus polls the session status until it is no longer pending.
+func (ts *testSystem) awaitStatus(t *testing.T, sessionId int) common.StatusResponse {
+	t.Helper()
+
+	path := "/repos/ctrl/repo/code-scanning/codeql/variant-analyses/" + strconv.Itoa(sessionId)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var status common.StatusResponse
+		ts.get(t, path, &status)
+		if status.Status != common.StatusPending.ToExternalString() {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("session %d still pending", sessionId)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestSubmitAnalyzeDownload(t *testing.T) {
+	ts := newTestSystem(t)
+
+	resp, data := ts.submit(t, testQueryPack(t, validPack), "octo/hello", "octo/missing")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("submit: status %d: %s", resp.StatusCode, data)
+	}
+	var submitted common.SubmitResponse
+	if err := json.Unmarshal(data, &submitted); err != nil {
+		t.Fatal(err)
+	}
+	if got := submitted.SkippedRepositories.NotFoundRepos.RepositoryFullNames; len(got) != 1 || got[0] != "octo/missing" {
+		t.Errorf("not found repos = %v, want [octo/missing]", got)
+	}
+
+	status := ts.awaitStatus(t, submitted.ID)
+	if status.Status != common.StatusSucceeded.ToExternalString() {
+		t.Fatalf("session status = %s, want succeeded", status.Status)
+	}
+	if len(status.ScannedRepositories) != 1 {
+		t.Fatalf("scanned repos = %d, want 1", len(status.ScannedRepositories))
+	}
+	scanned := status.ScannedRepositories[0]
+	if scanned.ResultCount != fakeResultCount || scanned.ResultFromCache {
+		t.Errorf("scanned repo = %+v, want %d fresh results", scanned, fakeResultCount)
+	}
+	if scanned.CLIVersion != codeql.FakeCLIVersion {
+		t.Errorf("scanned repo CLI version = %q, want %q", scanned.CLIVersion, codeql.FakeCLIVersion)
+	}
+
+	// The query pack at query_pack_url is released with the finished session
+	if status.QueryPackURL != "" {
+		t.Errorf("finished session query_pack_url = %q, want none", status.QueryPackURL)
+	}
+	jobs, err := ts.c.v.State.GetJobList(submitted.ID)
+	if err != nil || len(jobs) != 1 {
+		t.Fatalf("jobs = %v, %v", jobs, err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := ts.c.v.Artifacts.GetQueryPack(jobs[0].QueryPackLocation); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("query pack still stored after the session finished")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	packURL, err := url.Parse(submitted.QueryPackURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.Get(ts.server.URL + packURL.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGone {
+		t.Errorf("GET %s: status %d, want %d", packURL.Path, resp.StatusCode, http.StatusGone)
+	}
+
+	// Download the results via the artifact URL
+	var download common.DownloadResponse
+	ts.get(t, "/repositories/1/code-scanning/codeql/variant-analyses/"+strconv.Itoa(submitted.ID)+
+		"/repositories/"+strconv.Itoa(scanned.Repository.ID), &download)
+	artifactURL, err := url.Parse(download.ArtifactURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := ts.get(t, artifactURL.Path, nil)
+
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sarif []byte
+	for _, f := range zr.File {
+		if f.Name == "results.sarif" {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sarif, _ = io.ReadAll(rc)
+			rc.Close()
+		}
+	}
+	if !strings.Contains(string(sarif), "https://github.com/octo/hello") {
+		t.Errorf("SARIF lacks repository provenance:\n%s", sarif)
+	}
+
+	// Per-query counts
+	var breakdown common.ResultBreakdownResponse
+	ts.get(t, "/result-breakdown/"+strconv.Itoa(submitted.ID), &breakdown)
+	if len(breakdown.Queries) != 1 || breakdown.Queries[0].QueryID != codeql.FakeQueryID ||
+		breakdown.Queries[0].ResultCount != fakeResultCount {
+		t.Errorf("breakdown queries = %+v", breakdown.Queries)
+	}
+}
+
+func TestResubmissionReusesResults(t *testing.T) {
+	ts := newTestSystem(t)
+	pack := testQueryPack(t, validPack)
+
+	_, data := ts.submit(t, pack, "octo/hello")
+	var first common.SubmitResponse
+	if err := json.Unmarshal(data, &first); err != nil {
+		t.Fatal(err)
+	}
+	ts.awaitStatus(t, first.ID)
+
+	_, data = ts.submit(t, pack, "octo/hello")
+	var second common.SubmitResponse
+	if err := json.Unmarshal(data, &second); err != nil {
+		t.Fatal(err)
+	}
+	if second.ReusedResultRepos.RepositoryCount != 1 {
+		t.Errorf("reused repos = %+v, want octo/hello", second.ReusedResultRepos)
+	}
+	if first.QueryPackURL == "" || second.QueryPackURL != "" {
+		t.Errorf("query_pack_url = %q, then %q; want none once nothing runs the pack",
+			first.QueryPackURL, second.QueryPackURL)
+	}
+
+	status := ts.awaitStatus(t, second.ID)
+	if len(status.ScannedRepositories) != 1 || !status.ScannedRepositories[0].ResultFromCache {
+		t.Errorf("scanned repos = %+v, want one cached result", status.ScannedRepositories)
+	}
+
+	// The same pack compressed differently is the same analysis
+	_, data = ts.submit(t, recompress(t, pack), "octo/hello")
+	var third common.SubmitResponse
+	if err := json.Unmarshal(data, &third); err != nil {
+		t.Fatal(err)
+	}
+	if third.ReusedResultRepos.RepositoryCount != 1 {
+		t.Errorf("recompressed pack reused %+v, want octo/hello", third.ReusedResultRepos)
+	}
+}
+
+// recompress returns the base64-encoded archive compressed anew, with other
+// header fields and level.
+func recompress(t *testing.T, pack string) string {
+	t.Helper()
+
+	tgz, err := base64.StdEncoding.DecodeString(pack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gzr, err := gzip.NewReader(bytes.NewReader(tgz))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	gz, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz.ModTime = time.Unix(1700000000, 0)
+	if _, err := io.Copy(gz, gzr); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(buf.Bytes(), tgz) {
+		t.Fatal("recompressed archive is unchanged")
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func TestInvalidQueryPackRejected(t *testing.T) {
+	ts := newTestSystem(t)
+
+	for name, files := range map[string]map[string]string{
+		"no pack file":   {"Example.ql": "select 1\n"},
+		"wrong language": {"qlpack.yml": "name: test/pack\ndependencies:\n  codeql/python-all: \"*\"\n", "Example.ql": ""},
+		"path traversal": {"../qlpack.yml": "name: test/pack\n", "Example.ql": ""},
+	} {
+		resp, data := ts.submit(t, testQueryPack(t, files), "octo/hello")
+		if resp.StatusCode != http.StatusUnprocessableEntity {
+			t.Errorf("%s: status %d, want 422: %s", name, resp.StatusCode, data)
+		}
+	}
+}
+
+func TestModelPacks(t *testing.T) {
+	ts := newTestSystem(t)
+	pack := testQueryPack(t, validPack)
+
+	modelPack, err := base64.StdEncoding.DecodeString(testQueryPack(t, map[string]string{
+		"qlpack.yml": "name: acme/js-models\nversion: 0.0.1\nlibrary: true\n" +
+			"extensionTargets:\n  codeql/javascript-all: \"*\"\ndataExtensions:\n  - models/*.yml\n",
+		"models/sinks.yml": "extensions: []\n",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodPut, ts.server.URL+"/model-packs/acme/js-models", bytes.NewReader(modelPack))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("upload: status %d", resp.StatusCode)
+	}
+	if got := ts.get(t, "/model-packs/acme/js-models", nil); !bytes.Equal(got, modelPack) {
+		t.Errorf("downloaded model pack differs from upload")
+	}
+
+	resp, data := ts.submitMsg(t, common.SubmitMsg{
+		Language:       "javascript",
+		QueryPack:      pack,
+		Repositories:   []string{"octo/hello"},
+		ModelPackNames: []string{"acme/missing"},
+	})
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("unknown model pack: status %d, want 422: %s", resp.StatusCode, data)
+	}
+
+	resp, data = ts.submitMsg(t, common.SubmitMsg{
+		Language:       "javascript",
+		QueryPack:      pack,
+		Repositories:   []string{"octo/hello"},
+		ModelPackNames: []string{"acme/js-models"},
+		ThreatModels:   []string{"local"},
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("submit: status %d: %s", resp.StatusCode, data)
+	}
+	var submitted common.SubmitResponse
+	if err := json.Unmarshal(data, &submitted); err != nil {
+		t.Fatal(err)
+	}
+	status := ts.awaitStatus(t, submitted.ID)
+	if status.Status != common.StatusSucceeded.ToExternalString() {
+		t.Fatalf("session status = %s, want succeeded", status.Status)
+	}
+
+	// The same query pack without customizations is a different analysis
+	_, data = ts.submit(t, pack, "octo/hello")
+	if err := json.Unmarshal(data, &submitted); err != nil {
+		t.Fatal(err)
+	}
+	if submitted.ReusedResultRepos.RepositoryCount != 0 {
+		t.Errorf("reused repos = %+v, want none", submitted.ReusedResultRepos)
+	}
+}
+
+func TestEvaluatorLogSlowPredicates(t *testing.T) {
+	ts := newTestSystem(t)
+
+	resp, data := ts.submitMsg(t, common.SubmitMsg{
+		Language:     "javascript",
+		QueryPack:    testQueryPack(t, validPack),
+		Repositories: []string{"octo/hello"},
+		EvaluatorLog: true,
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("submit: status %d: %s", resp.StatusCode, data)
+	}
+	var submitted common.SubmitResponse
+	if err := json.Unmarshal(data, &submitted); err != nil {
+		t.Fatal(err)
+	}
+	ts.awaitStatus(t, submitted.ID)
+
+	var slow common.SlowPredicatesResponse
+	ts.get(t, "/slow-predicates/"+strconv.Itoa(submitted.ID), &slow)
+	if slow.Repositories != 1 || len(slow.Predicates) != 1 ||
+		slow.Predicates[0].PredicateName != codeql.FakePredicateName ||
+		slow.Predicates[0].MaxRepository != "octo/hello" {
+		t.Errorf("slow predicates = %+v", slow)
+	}
+
+	summary := ts.get(t, "/evaluator-logs/"+strconv.Itoa(submitted.ID)+"/octo/hello", nil)
+	if !strings.Contains(string(summary), "evaluator log summary") {
+		t.Errorf("evaluator log summary = %q", summary)
+	}
+}
+
+func TestUnpinnedReuseFollowsSelectedCLI(t *testing.T) {
+	ts := newTestSystem(t)
+	pack := testQueryPack(t, validPack)
+
+	submit := func(cliVersion string) common.SubmitResponse {
+		t.Helper()
+		_, data := ts.submitMsg(t, common.SubmitMsg{
+			Language:     "javascript",
+			QueryPack:    pack,
+			Repositories: []string{"octo/hello"},
+			CLIVersion:   cliVersion,
+		})
+		var submitted common.SubmitResponse
+		if err := json.Unmarshal(data, &submitted); err != nil {
+			t.Fatal(err)
+		}
+		ts.awaitStatus(t, submitted.ID)
+		return submitted
+	}
+
+	// A pinned version tells nothing about the one agents select
+	if pinned := submit(codeql.FakeCLIVersion); pinned.ReusedResultRepos.RepositoryCount != 0 {
+		t.Errorf("first submission reused %+v", pinned.ReusedResultRepos)
+	}
+	unpinned := submit("")
+	if unpinned.ReusedResultRepos.RepositoryCount != 0 {
+		t.Errorf("unpinned submission reused the pinned result %+v", unpinned.ReusedResultRepos)
+	}
+
+	// Once agents selected a version for the database, its results are reused
+	if again := submit(""); again.ReusedResultRepos.RepositoryCount != 1 {
+		t.Errorf("reused repos = %+v, want octo/hello", again.ReusedResultRepos)
+	}
+
+	// The selection is kept in the state, across server restarts
+	jobs, err := ts.c.v.State.GetJobList(unpinned.ID)
+	if err != nil || len(jobs) != 1 {
+		t.Fatalf("jobs = %v, %v", jobs, err)
+	}
+	job := jobs[0]
+	job.Spec.SessionID = ts.c.v.State.NextID()
+	restarted := &CommanderSingle{v: ts.c.v}
+	if !restarted.reuseResult(job) {
+		t.Error("restarted server did not reuse the result of the selected CLI")
+	}
+	if pinned := submit(codeql.FakeCLIVersion); pinned.ReusedResultRepos.RepositoryCount != 1 {
+		t.Errorf("reused repos = %+v, want octo/hello", pinned.ReusedResultRepos)
+	}
+}
+
+func TestFailureDiagnostic(t *testing.T) {
+	ts := newTestSystem(t)
+
+	resp, data := ts.submitMsg(t, common.SubmitMsg{
+		Language:     "javascript",
+		QueryPack:    testQueryPack(t, validPack),
+		Repositories: []string{"octo/hello"},
+		CLIVersion:   "9.9.9",
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("submit: status %d: %s", resp.StatusCode, data)
+	}
+	var submitted common.SubmitResponse
+	if err := json.Unmarshal(data, &submitted); err != nil {
+		t.Fatal(err)
+	}
+
+	status := ts.awaitStatus(t, submitted.ID)
+	if status.Status != common.StatusFailed.ToExternalString() {
+		t.Fatalf("session status = %s, want failed", status.Status)
+	}
+	scanned := status.ScannedRepositories[0]
+	if scanned.Diagnostic == nil || scanned.Diagnostic.Kind != common.DiagnosticUnknown ||
+		!strings.Contains(scanned.FailureMessage, "9.9.9 is not available") {
+		t.Errorf("scanned repo = %+v, want failure naming the CLI version", scanned)
+	}
+
+	var download common.DownloadResponse
+	ts.get(t, "/repositories/1/code-scanning/codeql/variant-analyses/"+strconv.Itoa(submitted.ID)+
+		"/repositories/"+strconv.Itoa(scanned.Repository.ID), &download)
+	if download.FailureMessage != scanned.FailureMessage {
+		t.Errorf("download failure message = %q, want %q", download.FailureMessage, scanned.FailureMessage)
+	}
+}
+
+func TestLostAgentJobsRequeued(t *testing.T) {
+	ts := newTestSystem(t)
+
+	_, data := ts.submit(t, testQueryPack(t, validPack), "octo/hello")
+	var submitted common.SubmitResponse
+	if err := json.Unmarshal(data, &submitted); err != nil {
+		t.Fatal(err)
+	}
+	ts.awaitStatus(t, submitted.ID)
+
+	// An agent took the job again and stopped reporting
+	spec := common.JobSpec{
+		SessionID:     submitted.ID,
+		NameWithOwner: common.NameWithOwner{Owner: "octo", Repo: "hello"},
+	}
+	st := ts.c.v.State
+	st.SetStatus(spec, common.StatusInProgress)
+	lastSeen := time.Now().Add(-2 * agentHeartbeatTimeout)
+	ts.c.agents.update(queue.AgentReport{AgentID: "gone", RunningJobs: []common.JobSpec{spec}}, lastSeen)
+
+	var agents common.AgentsResponse
+	ts.get(t, "/agents", &agents)
+	if len(agents.Agents) != 1 || agents.Agents[0].Status != "active" ||
+		len(agents.Agents[0].RunningJobs) != 1 || agents.Agents[0].RunningJobs[0].FullName != "octo/hello" {
+		t.Fatalf("agents = %+v", agents)
+	}
+
+	// The job is run again by the live worker
+	ts.c.recoverOrphanedJobs(time.Now())
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		status, err := st.GetStatus(spec)
+		if err == nil && status == common.StatusSucceeded {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("requeued job status = %v, want succeeded", status)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	ts.get(t, "/agents", &agents)
+	if len(agents.Agents) != 1 || agents.Agents[0].Status != "lost" {
+		t.Errorf("agents = %+v, want the agent lost", agents)
+	}
+}
+
+// heldJobsQueue is the queue of an agent that hangs while holding its jobs,
+// so that only the server requeues them.
+type heldJobsQueue struct {
+	queue.Queue
+	jobs chan queue.AnalyzeJob
+}
+
+func (q heldJobsQueue) Jobs() chan queue.AnalyzeJob {
+	return q.jobs
+}
+
+func TestLostAgentJobsRequeuedWhileHeld(t *testing.T) {
+	st := state.NewLocalState(1)
+	q := heldJobsQueue{jobs: make(chan queue.AnalyzeJob, 1)}
+	c := &CommanderSingle{v: &Visibles{Queue: q, State: st}}
+
+	spec := common.JobSpec{
+		SessionID:     1,
+		NameWithOwner: common.NameWithOwner{Owner: "octo", Repo: "hello"},
+	}
+	st.AddJob(queue.AnalyzeJob{Spec: spec})
+	st.SetStatus(spec, common.StatusInProgress)
+	lastSeen := time.Now().Add(-2 * agentHeartbeatTimeout)
+	c.agents.update(queue.AgentReport{AgentID: "hung", RunningJobs: []common.JobSpec{spec}}, lastSeen)
+
+	c.recoverOrphanedJobs(time.Now())
+	select {
+	case job := <-q.jobs:
+		if job.Spec != spec {
+			t.Errorf("requeued job = %+v, want %v", job, spec)
+		}
+	default:
+		t.Fatal("job of the hung agent not requeued")
+	}
+	if status, err := st.GetStatus(spec); err != nil || status != common.StatusPending {
+		t.Errorf("status = %v, %v; want the job pending", status, err)
+	}
+	if agents := c.agents.list(); len(agents) != 1 || agents[0].Status != "lost" {
+		t.Errorf("agents = %+v, want the agent lost", agents)
+	}
+
+	// The hung agent's late result is dropped once the requeued job succeeded
+	st.SetStatus(spec, common.StatusSucceeded)
+	if c.acceptResult(queue.AnalyzeResult{Spec: spec, Status: common.StatusFailed}) {
+		t.Error("late result of the hung agent accepted")
+	}
+}
+
+func TestRepeatedResultIgnored(t *testing.T) {
+	ts := newTestSystem(t)
+
+	_, data := ts.submit(t, testQueryPack(t, validPack), "octo/hello")
+	var submitted common.SubmitResponse
+	if err := json.Unmarshal(data, &submitted); err != nil {
+		t.Fatal(err)
+	}
+	ts.awaitStatus(t, submitted.ID)
+
+	// A redelivered job's failure must not replace the recorded success
+	spec := common.JobSpec{
+		SessionID:     submitted.ID,
+		NameWithOwner: common.NameWithOwner{Owner: "octo", Repo: "hello"},
+	}
+	if ts.c.acceptResult(queue.AnalyzeResult{Spec: spec, Status: common.StatusFailed}) {
+		t.Error("repeated result of a succeeded job accepted")
+	}
+	other := common.JobSpec{SessionID: submitted.ID + 1, NameWithOwner: spec.NameWithOwner}
+	if !ts.c.acceptResult(queue.AnalyzeResult{Spec: other, Status: common.StatusSucceeded}) {
+		t.Error("result of an unfinished job rejected")
+	}
+}
+
+// deadLetterQueue keeps dead letters in memory.
+type deadLetterQueue struct {
+	queue.Queue
+	letters  []queue.DeadLetter
+	requeued []string
+}
+
+func (q *deadLetterQueue) DeadLetters() ([]queue.DeadLetter, error) {
+	return q.letters, nil
+}
+
+func (q *deadLetterQueue) RequeueDeadLetter(id string) error {
+	if err := q.DiscardDeadLetter(id); err != nil {
+		return err
+	}
+	q.requeued = append(q.requeued, id)
+	return nil
+}
+
+func (q *deadLetterQueue) DiscardDeadLetter(id string) error {
+	for i, d := range q.letters {
+		if d.ID == id {
+			q.letters = append(q.letters[:i], q.letters[i+1:]...)
+			return nil
+		}
+	}
+	return queue.ErrDeadLetterNotFound
+}
+
+func (q *deadLetterQueue) PurgeDeadLetters() (int, error) {
+	n := len(q.letters)
+	q.letters = nil
+	return n, nil
+}
+
+func TestDeadLetters(t *testing.T) {
+	// The dead-lettered job's session finished, failing the job
+	st := state.NewLocalState(1)
+	artifacts := artifactstore.NewInMemoryArtifactStore()
+	spec := common.JobSpec{
+		SessionID:     7,
+		NameWithOwner: common.NameWithOwner{Owner: "octo", Repo: "hello"},
+	}
+	packLocation, err := artifacts.SaveQueryPack(7, []byte("pack"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.AddJob(queue.AnalyzeJob{Spec: spec, QueryPackLocation: packLocation})
+	st.SetStatus(spec, common.StatusFailed)
+	job, err := json.Marshal(queue.AnalyzeJob{Spec: spec, QueryPackLocation: packLocation})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := &deadLetterQueue{letters: []queue.DeadLetter{
+		{ID: "a", SourceQueue: "tasks", Reason: "delivered 3 times without being completed",
+			Attempts: 3, DeadLetteredAt: time.Now(), Body: job},
+		{ID: "b", SourceQueue: "results", Reason: "invalid result", Attempts: 1, Body: []byte("{")},
+		{ID: "c", SourceQueue: "results", Reason: "invalid result", Attempts: 1, Body: []byte("}")},
+	}}
+	c := &CommanderSingle{v: &Visibles{Queue: q, State: st, Artifacts: artifacts}}
+	ts := &testSystem{server: httptest.NewServer(newRouter(c))}
+	t.Cleanup(ts.server.Close)
+
+	// The session keeps its pack while its job may be requeued
+	c.jobFinished(spec)
+	if _, err := artifacts.GetQueryPack(packLocation); err != nil {
+		t.Errorf("pack of dead-lettered job released: %v", err)
+	}
+
+	do := func(method, path string) int {
+		req, err := http.NewRequest(method, ts.server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	var list common.DeadLettersResponse
+	ts.get(t, "/dead-letters", &list)
+	if len(list.DeadLetters) != 3 {
+		t.Fatalf("got %d dead letters, want 3", len(list.DeadLetters))
+	}
+	first := list.DeadLetters[0]
+	if first.Job == nil || first.Job.FullName != "octo/hello" || first.Job.SessionId != 7 ||
+		first.Attempts != 3 || first.Body != "" {
+		t.Errorf("unexpected listing %+v", first)
+	}
+
+	var inspected common.DeadLetter
+	ts.get(t, "/dead-letters/b", &inspected)
+	if inspected.Body != "{" || inspected.Job != nil {
+		t.Errorf("unexpected dead letter %+v", inspected)
+	}
+
+	if code := do(http.MethodPost, "/dead-letters/a/requeue"); code != http.StatusNoContent {
+		t.Errorf("requeue: got status %d", code)
+	}
+	if len(q.requeued) != 1 || q.requeued[0] != "a" {
+		t.Errorf("requeued %v, want [a]", q.requeued)
+	}
+	if status, err := st.GetStatus(spec); err != nil || status != common.StatusPending {
+		t.Errorf("requeued job status = %v, %v; want pending", status, err)
+	}
+
+	// Once the requeued job finished again, nothing holds the pack
+	st.SetStatus(spec, common.StatusFailed)
+	c.jobFinished(spec)
+	if _, err := artifacts.GetQueryPack(packLocation); err == nil {
+		t.Error("pack kept after the requeued job finished")
+	}
+	if code := do(http.MethodPost, "/dead-letters/a/requeue"); code != http.StatusNotFound {
+		t.Errorf("requeue of requeued dead letter: got status %d", code)
+	}
+	if code := do(http.MethodDelete, "/dead-letters/b"); code != http.StatusNoContent {
+		t.Errorf("discard: got status %d", code)
+	}
+
+	var purged common.DeadLettersPurgedResponse
+	req, _ := http.NewRequest(http.MethodDelete, ts.server.URL+"/dead-letters", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&purged); err != nil || purged.Purged != 1 {
+		t.Errorf("purge: got %+v, %v", purged, err)
+	}
+}
+
+// flakyDatabaseStore fails to fetch databases a number of times, as an
+// unreachable store would.
+type flakyDatabaseStore struct {
+	qldbstore.Store
+	mu       sync.Mutex
+	failures int
+}
+
+func (s *flakyDatabaseStore) GetDatabase(nwo common.NameWithOwner) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return nil, &url.Error{Op: "Get", URL: "http://dbstore/" + nwo.Owner + "/" + nwo.Repo,
+			Err: errors.New("connection refused")}
+	}
+	return s.Store.GetDatabase(nwo)
+}
+
+func TestTransientFailureRetried(t *testing.T) {
+	ts := newConfiguredTestSystem(t, func(sv *Visibles, av *agent.Visibles) {
+		sv.Retry = NewRetryPolicy(3, 10*time.Millisecond, 20*time.Millisecond)
+		av.CodeQLDBStore = &flakyDatabaseStore{Store: av.CodeQLDBStore, failures: 2}
+	})
+
+	_, data := ts.submit(t, testQueryPack(t, validPack), "octo/hello")
+	var submitted common.SubmitResponse
+	if err := json.Unmarshal(data, &submitted); err != nil {
+		t.Fatal(err)
+	}
+
+	// The session is in progress while the job waits to be retried
+	path := "/repos/ctrl/repo/code-scanning/codeql/variant-analyses/" + strconv.Itoa(submitted.ID)
+	deadline := time.Now().Add(10 * time.Second)
+	var repo common.ScannedRepo
+	for {
+		var status common.StatusResponse
+		ts.get(t, path, &status)
+		if len(status.ScannedRepositories) == 1 {
+			repo = status.ScannedRepositories[0]
+			if repo.AnalysisStatus != common.StatusPending.ToExternalString() &&
+				repo.AnalysisStatus != common.StatusInProgress.ToExternalString() {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job still running: %+v", repo)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if repo.AnalysisStatus != common.StatusSucceeded.ToExternalString() {
+		t.Fatalf("job status = %s, want succeeded: %+v", repo.AnalysisStatus, repo)
+	}
+	if len(repo.Attempts) != 2 {
+		t.Fatalf("attempts = %+v, want 2 failed attempts", repo.Attempts)
+	}
+	for i, attempt := range repo.Attempts {
+		if attempt.Attempt != i+1 || attempt.Kind != common.DiagnosticNetworkError || attempt.RetryAt == "" {
+			t.Errorf("attempt %d = %+v, want a retried network error", i+1, attempt)
+		}
+	}
+}
+
+func TestRetriesExhausted(t *testing.T) {
+	ts := newConfiguredTestSystem(t, func(sv *Visibles, av *agent.Visibles) {
+		sv.Retry = NewRetryPolicy(2, 10*time.Millisecond, 0)
+		av.CodeQLDBStore = &flakyDatabaseStore{Store: av.CodeQLDBStore, failures: 5}
+	})
+
+	_, data := ts.submit(t, testQueryPack(t, validPack), "octo/hello")
+	var submitted common.SubmitResponse
+	if err := json.Unmarshal(data, &submitted); err != nil {
+		t.Fatal(err)
+	}
+
+	path := "/repos/ctrl/repo/code-scanning/codeql/variant-analyses/" + strconv.Itoa(submitted.ID)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var status common.StatusResponse
+		ts.get(t, path, &status)
+		if len(status.ScannedRepositories) == 1 &&
+			status.ScannedRepositories[0].AnalysisStatus == common.StatusFailed.ToExternalString() {
+			attempts := status.ScannedRepositories[0].Attempts
+			if len(attempts) != 2 || attempts[0].RetryAt == "" || attempts[1].RetryAt != "" {
+				t.Errorf("attempts = %+v, want one retried and one final attempt", attempts)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job not failed: %+v", status.ScannedRepositories)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	p := NewRetryPolicy(5, time.Second, 3*time.Second)
+	network := common.JobAttempt{Kind: common.DiagnosticNetworkError}
+	compile := common.JobAttempt{Kind: common.DiagnosticCompilationError}
+
+	for _, tc := range []struct {
+		attempts []common.JobAttempt
+		delay    time.Duration
+		retry    bool
+	}{
+		{[]common.JobAttempt{network}, time.Second, true},
+		{[]common.JobAttempt{network, network}, 2 * time.Second, true},
+		{[]common.JobAttempt{network, network, network}, 3 * time.Second, true},
+		{[]common.JobAttempt{network, network, network, network, network}, 0, false},
+		{[]common.JobAttempt{compile}, 0, false},
+	} {
+		delay, retry := p.retryDelay(tc.attempts)
+		if delay != tc.delay || retry != tc.retry {
+			t.Errorf("retryDelay(%d attempts) = %v, %v, want %v, %v",
+				len(tc.attempts), delay, retry, tc.delay, tc.retry)
+		}
+	}
+	if _, retry := (*RetryPolicy)(nil).retryDelay([]common.JobAttempt{network}); retry {
+		t.Error("nil policy retries")
+	}
+}
+
+func TestRequeueAfterQueueClosed(t *testing.T) {
+	st := state.NewLocalState(1)
+	q := queue.NewQueueSingle(1)
+	c := &CommanderSingle{v: &Visibles{
+		Queue:     q,
+		State:     st,
+		Artifacts: artifactstore.NewInMemoryArtifactStore(),
+		Retry:     NewRetryPolicy(3, time.Millisecond, time.Millisecond),
+	}}
+	spec := common.JobSpec{
+		SessionID:     1,
+		NameWithOwner: common.NameWithOwner{Owner: "octo", Repo: "hello"},
+	}
+	st.AddJob(queue.AnalyzeJob{Spec: spec})
+	st.SetStatus(spec, common.StatusInProgress)
+
+	// A retry scheduled while the queue is open is dropped when it closes
+	r := queue.AnalyzeResult{
+		Spec:       spec,
+		Status:     common.StatusFailed,
+		Diagnostic: &common.Diagnostic{Kind: common.DiagnosticNetworkError},
+	}
+	if !c.recordAttempt(&r, time.Now()) {
+		t.Fatal("transient failure not retried")
+	}
+	q.Close()
+
+	// Once closed, the failure stands instead
+	r = queue.AnalyzeResult{
+		Spec:       spec,
+		Status:     common.StatusFailed,
+		Diagnostic: &common.Diagnostic{Kind: common.DiagnosticNetworkError},
+		Attempts:   r.Attempts,
+	}
+	if c.recordAttempt(&r, time.Now()) {
+		t.Error("retry scheduled on a closed queue")
+	}
+	if last := r.Attempts[len(r.Attempts)-1]; last.RetryAt != "" {
+		t.Errorf("last attempt = %+v, want no retry time", last)
+	}
+
+	// So does the loss of the agent
+	st.SetStatus(spec, common.StatusInProgress)
+	lastSeen := time.Now().Add(-2 * agentHeartbeatTimeout)
+	c.agents.update(queue.AgentReport{AgentID: "gone", RunningJobs: []common.JobSpec{spec}}, lastSeen)
+	c.recoverOrphanedJobs(time.Now())
+	if status, err := st.GetStatus(spec); err != nil || status != common.StatusFailed {
+		t.Errorf("status = %v, %v; want the job failed", status, err)
+	}
+}
@@ -15,16 +15,44 @@ type SessionInfo struct {
 	AccessMismatchRepos []common.NameWithOwner
 	NotFoundRepos       []common.NameWithOwner
 	NoCodeqlDBRepos     []common.NameWithOwner
+	ReusedRepos         []common.NameWithOwner
 }
 
+// SubmissionInfo is what the server keeps from a submitted analysis request.
+type SubmissionInfo struct {
+	Language          queue.QueryLanguage
+	Repositories      []common.NameWithOwner
+	QueryPackLocation artifactstore.ArtifactLocation
+	QueryPackHash     string
+	Queries           []string
+	CLIVersion        string
+	ModelPacks        []queue.ModelPackRef
+	ThreatModels      []string
+	EvaluatorLog      bool
+}
+
+// submissionError is a rejected submission and the HTTP status to report.
+type submissionError struct {
+	status int
+	err    error
+}
+
+func (e *submissionError) Error() string { return e.err.Error() }
+
+func (e *submissionError) Unwrap() error { return e.err }
+
 type CommanderSingle struct {
 	v *Visibles
+
+	// agents are the agents known from their heartbeats.
+	agents agentRegistry
 }
 
 func NewCommanderSingle(st *Visibles) *CommanderSingle {
 	c := CommanderSingle{v: st}
 	setupEndpoints(&c)
 	go c.ConsumeResults()
+	go c.ConsumeAgentReports()
 	return &c
 }
 
@@ -33,4 +61,7 @@ type Visibles struct {
 	State         state.ServerState
 	Artifacts     artifactstore.Store
 	CodeQLDBStore qldbstore.Store
+	// Retry bounds the retries of jobs failing for transient causes; nil
+	// fails them at once.
+	Retry *RetryPolicy
 }
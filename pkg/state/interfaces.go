@@ -44,4 +44,18 @@ type ServerState interface {
 
 	// AddJob adds an analysis job to the list of jobs for the specified session ID.
 	AddJob(job queue.AnalyzeJob)
+
+	// GetCachedResult retrieves a successful earlier result for the same analysis.
+	GetCachedResult(key common.ResultCacheKey) (queue.AnalyzeResult, bool)
+
+	// SetCachedResult records a successful result for reuse by later sessions.
+	SetCachedResult(key common.ResultCacheKey, ar queue.AnalyzeResult)
+
+	// GetSelectedCLI retrieves the CodeQL CLI version the agents selected for
+	// the latest result without a pinned version on the database version.
+	GetSelectedCLI(nwo common.NameWithOwner, databaseIdentity string) (string, bool)
+
+	// SetSelectedCLI records the CodeQL CLI version the agents selected for
+	// a result without a pinned version on the database version.
+	SetSelectedCLI(nwo common.NameWithOwner, databaseIdentity string, cliVersion string)
 }
@@ -15,10 +15,19 @@ type LocalState struct {
 	status               map[common.JobSpec]common.Status
 	result               map[common.JobSpec]queue.AnalyzeResult
 	sessionToJobIdToSpec map[int]map[int]common.JobSpec
+	resultCache          map[common.ResultCacheKey]queue.AnalyzeResult
+	selectedCLIs         map[selectedCLIKey]string
+	repoIds              map[common.NameWithOwner]int
 	mutex                sync.Mutex
 	currentID            int
 }
 
+// selectedCLIKey identifies a stored version of a database.
+type selectedCLIKey struct {
+	nwo      common.NameWithOwner
+	identity string
+}
+
 func NewLocalState(startingID int) *LocalState {
 	state := &LocalState{
 		jobs:                 make(map[int][]queue.AnalyzeJob),
@@ -26,6 +35,9 @@ func NewLocalState(startingID int) *LocalState {
 		status:               make(map[common.JobSpec]common.Status),
 		result:               make(map[common.JobSpec]queue.AnalyzeResult),
 		sessionToJobIdToSpec: make(map[int]map[int]common.JobSpec),
+		resultCache:          make(map[common.ResultCacheKey]queue.AnalyzeResult),
+		selectedCLIs:         make(map[selectedCLIKey]string),
+		repoIds:              make(map[common.NameWithOwner]int),
 		currentID:            startingID,
 	}
 	state.sessionToJobIdToSpec[startingID] = make(map[int]common.JobSpec)
@@ -159,15 +171,33 @@ func (s *LocalState) SetStatus(js common.JobSpec, status common.Status) {
 	s.mutex.Unlock()
 }
 
+// GetRepoId returns a stable unique ID for a given (owner, repo), assigning
+// the next free one on first use.
+func (s *LocalState) GetRepoId(nwo common.NameWithOwner) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.repoId(nwo)
+}
+
+// repoId is GetRepoId for callers holding the mutex.
+func (s *LocalState) repoId(nwo common.NameWithOwner) int {
+	id, ok := s.repoIds[nwo]
+	if !ok {
+		id = len(s.repoIds) + 1
+		s.repoIds[nwo] = id
+	}
+	return id
+}
+
 func (s *LocalState) AddJob(job queue.AnalyzeJob) {
 	s.mutex.Lock()
 	sessionID := job.Spec.SessionID
 	s.jobs[sessionID] = append(s.jobs[sessionID], job)
-	// Map the job index to JobSpec for quick result lookup
+	// Map the repo ID to JobSpec for quick result lookup
 	if _, ok := s.sessionToJobIdToSpec[sessionID]; !ok {
 		s.sessionToJobIdToSpec[sessionID] = make(map[int]common.JobSpec)
 	}
-	s.sessionToJobIdToSpec[sessionID][len(s.sessionToJobIdToSpec[sessionID])] = job.Spec
+	s.sessionToJobIdToSpec[sessionID][s.repoId(job.Spec.NameWithOwner)] = job.Spec
 	if len(s.jobs[sessionID]) != len(s.sessionToJobIdToSpec[sessionID]) {
 		msg := fmt.Sprintf("Unequal job list and job id map length. Session ID: %v", sessionID)
 		slog.Error(msg)
@@ -175,3 +205,29 @@ func (s *LocalState) AddJob(job queue.AnalyzeJob) {
 	}
 	s.mutex.Unlock()
 }
+
+func (s *LocalState) GetCachedResult(key common.ResultCacheKey) (queue.AnalyzeResult, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ar, ok := s.resultCache[key]
+	return ar, ok
+}
+
+func (s *LocalState) SetCachedResult(key common.ResultCacheKey, ar queue.AnalyzeResult) {
+	s.mutex.Lock()
+	s.resultCache[key] = ar
+	s.mutex.Unlock()
+}
+
+func (s *LocalState) GetSelectedCLI(nwo common.NameWithOwner, databaseIdentity string) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	version, ok := s.selectedCLIs[selectedCLIKey{nwo, databaseIdentity}]
+	return version, ok
+}
+
+func (s *LocalState) SetSelectedCLI(nwo common.NameWithOwner, databaseIdentity string, cliVersion string) {
+	s.mutex.Lock()
+	s.selectedCLIs[selectedCLIKey{nwo, databaseIdentity}] = cliVersion
+	s.mutex.Unlock()
+}
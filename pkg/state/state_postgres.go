@@ -5,12 +5,14 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
 
 	"github.com/hohn/mrvacommander/pkg/common"
 	"github.com/hohn/mrvacommander/pkg/queue"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -179,6 +181,32 @@ func SetupSchemas(pool *pgxpool.Pool) {
 				);
 			`,
 		},
+		{
+			name: "result_cache",
+			sql: `
+				CREATE TABLE IF NOT EXISTS result_cache (
+					query_pack_hash TEXT NOT NULL,
+					owner TEXT NOT NULL,
+					repo TEXT NOT NULL,
+					database_identity TEXT NOT NULL,
+					cli_version TEXT NOT NULL,
+					result JSONB NOT NULL,
+					PRIMARY KEY (query_pack_hash, owner, repo, database_identity, cli_version)
+				);
+			`,
+		},
+		{
+			name: "selected_cli",
+			sql: `
+				CREATE TABLE IF NOT EXISTS selected_cli (
+					owner TEXT NOT NULL,
+					repo TEXT NOT NULL,
+					database_identity TEXT NOT NULL,
+					cli_version TEXT NOT NULL,
+					PRIMARY KEY (owner, repo, database_identity)
+				);
+			`,
+		},
 		{
 			name: "job_status",
 			sql: `
@@ -514,3 +542,83 @@ func (s *PGState) GetJobSpecByRepoId(sessionId, jobRepoId int) (common.JobSpec,
 		},
 	}, nil
 }
+
+func (s *PGState) GetCachedResult(key common.ResultCacheKey) (queue.AnalyzeResult, bool) {
+	ctx := context.Background()
+
+	var jsonBytes []byte
+	err := s.pool.QueryRow(ctx, `
+		SELECT result FROM result_cache
+		WHERE query_pack_hash = $1 AND owner = $2 AND repo = $3
+		  AND database_identity = $4 AND cli_version = $5
+	`, key.QueryPackHash, key.Owner, key.Repo, key.DatabaseIdentity, key.CLIVersion).Scan(&jsonBytes)
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			slog.Error("GetCachedResult: query failed", "key", key, "error", err)
+		}
+		return queue.AnalyzeResult{}, false
+	}
+
+	var ar queue.AnalyzeResult
+	if err := json.Unmarshal(jsonBytes, &ar); err != nil {
+		slog.Error("GetCachedResult: unmarshal failed", "key", key, "error", err)
+		return queue.AnalyzeResult{}, false
+	}
+
+	return ar, true
+}
+
+func (s *PGState) SetCachedResult(key common.ResultCacheKey, ar queue.AnalyzeResult) {
+	ctx := context.Background()
+
+	jsonBytes, err := json.Marshal(ar)
+	if err != nil {
+		slog.Error("SetCachedResult: JSON marshal failed", "key", key, "error", err)
+		panic("SetCachedResult(): " + err.Error())
+	}
+
+	_, err = s.pool.Exec(ctx, `
+		INSERT INTO result_cache (query_pack_hash, owner, repo, database_identity, cli_version, result)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (query_pack_hash, owner, repo, database_identity, cli_version)
+		DO UPDATE SET result = EXCLUDED.result
+	`, key.QueryPackHash, key.Owner, key.Repo, key.DatabaseIdentity, key.CLIVersion, jsonBytes)
+
+	if err != nil {
+		slog.Error("SetCachedResult: insert/update failed", "key", key, "error", err)
+		panic("SetCachedResult(): " + err.Error())
+	}
+}
+
+func (s *PGState) GetSelectedCLI(nwo common.NameWithOwner, databaseIdentity string) (string, bool) {
+	ctx := context.Background()
+
+	var version string
+	err := s.pool.QueryRow(ctx, `
+		SELECT cli_version FROM selected_cli
+		WHERE owner = $1 AND repo = $2 AND database_identity = $3
+	`, nwo.Owner, nwo.Repo, databaseIdentity).Scan(&version)
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			slog.Error("GetSelectedCLI: query failed", "owner", nwo.Owner, "repo", nwo.Repo, "error", err)
+		}
+		return "", false
+	}
+	return version, true
+}
+
+func (s *PGState) SetSelectedCLI(nwo common.NameWithOwner, databaseIdentity string, cliVersion string) {
+	ctx := context.Background()
+
+	_, err := s.pool.Exec(ctx, `
+		INSERT INTO selected_cli (owner, repo, database_identity, cli_version)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (owner, repo, database_identity)
+		DO UPDATE SET cli_version = EXCLUDED.cli_version
+	`, nwo.Owner, nwo.Repo, databaseIdentity, cliVersion)
+
+	if err != nil {
+		slog.Error("SetSelectedCLI: insert/update failed", "owner", nwo.Owner, "repo", nwo.Repo, "error", err)
+		panic("SetSelectedCLI(): " + err.Error())
+	}
+}
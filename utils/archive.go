@@ -14,6 +14,20 @@ import (
 	"strings"
 )
 
+// UnzippedSize returns the total size of the files in a zip archive once
+// extracted, as recorded in the archive.
+func UnzippedSize(data []byte) (uint64, error) {
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return 0, err
+	}
+	var size uint64
+	for _, f := range r.File {
+		size += f.UncompressedSize64
+	}
+	return size, nil
+}
+
 // UnzipFile extracts a zip file to the specified destination
 func UnzipFile(zipFile, dest string) error {
 	r, err := zip.OpenReader(zipFile)